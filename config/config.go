@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
 	"github.com/Trendyol/go-dcp/config"
 	"github.com/Trendyol/go-dcp/helpers"
 )
@@ -19,26 +20,45 @@ func NormalizeClusterKey(clusterKey string) string {
 }
 
 type Elasticsearch struct {
-	BatchByteSizeLimit          any                      `yaml:"batchByteSizeLimit"`
-	BatchCommitTickerDuration   *time.Duration           `yaml:"batchCommitTickerDuration"`
-	CollectionIndexMapping      map[string]string        `yaml:"collectionIndexMapping"`
-	MaxConnsPerHost             *int                     `yaml:"maxConnsPerHost"`
-	MaxIdleConnDuration         *time.Duration           `yaml:"maxIdleConnDuration"`
-	DiscoverNodesInterval       *time.Duration           `yaml:"discoverNodesInterval"`
-	Retry                       *Retry                   `yaml:"retry"`
-	TLS                         *TLS                     `yaml:"tls"`
-	Clusters                    map[string]Elasticsearch `yaml:"clusters"`
-	RejectionLog                RejectionLog             `yaml:"rejectionLog"`
-	Username                    string                   `yaml:"username"`
-	Password                    string                   `yaml:"password"`
-	TypeName                    string                   `yaml:"typeName"`
-	Urls                        []string                 `yaml:"urls"`
-	BatchSizeLimit              int                      `yaml:"batchSizeLimit"`
-	BatchTickerDuration         time.Duration            `yaml:"batchTickerDuration"`
-	ConcurrentRequest           int                      `yaml:"concurrentRequest"`
-	MaxRetries                  int                      `yaml:"maxRetries"`
-	CompressionEnabled          bool                     `yaml:"compressionEnabled"`
-	DisableDiscoverNodesOnStart bool                     `yaml:"disableDiscoverNodesOnStart"`
+	BatchByteSizeLimit          any                               `yaml:"batchByteSizeLimit"`
+	BatchCommitTickerDuration   *time.Duration                    `yaml:"batchCommitTickerDuration"`
+	CollectionIndexMapping      map[string]string                 `yaml:"collectionIndexMapping"`
+	CollectionRoutingMapping    map[string]string                 `yaml:"collectionRoutingMapping"`
+	IndexPipelineMapping        map[string]string                 `yaml:"indexPipelineMapping"`
+	IndexUpdateOptions          map[string]document.UpdateOptions `yaml:"indexUpdateOptions"`
+	DocumentMappings            map[string]DocumentMapping        `yaml:"documentMappings"`
+	ReplicationMetadata         map[string]ReplicationMetadata    `yaml:"replicationMetadata"`
+	DeletionPolicies            map[string]DeletionPolicy         `yaml:"deletionPolicies"`
+	Filter                      map[string]string                 `yaml:"filter"`
+	ValueDecoders               map[string]string                 `yaml:"valueDecoders"`
+	DeleteResolution            map[string]string                 `yaml:"deleteResolution"`
+	MaxConnsPerHost             *int                              `yaml:"maxConnsPerHost"`
+	MaxIdleConnDuration         *time.Duration                    `yaml:"maxIdleConnDuration"`
+	DiscoverNodesInterval       *time.Duration                    `yaml:"discoverNodesInterval"`
+	Retry                       *Retry                            `yaml:"retry"`
+	Validation                  *Validation                       `yaml:"validation"`
+	SchemaValidation            *SchemaValidation                 `yaml:"schemaValidation"`
+	ExternalVersioning          *ExternalVersioning               `yaml:"externalVersioning"`
+	TLS                         *TLS                              `yaml:"tls"`
+	Clusters                    map[string]Elasticsearch          `yaml:"clusters"`
+	Scripts                     map[string]Script                 `yaml:"scripts"`
+	DataStreams                 []string                          `yaml:"dataStreams"`
+	RejectionLog                RejectionLog                      `yaml:"rejectionLog"`
+	Enrichment                  Enrichment                        `yaml:"enrichment"`
+	Username                    string                            `yaml:"username"`
+	Password                    string                            `yaml:"password"`
+	TypeName                    string                            `yaml:"typeName"`
+	Pipeline                    string                            `yaml:"pipeline"`
+	MappingErrorPolicy          string                            `yaml:"mappingErrorPolicy"`
+	UnmappedCollectionPolicy    string                            `yaml:"unmappedCollectionPolicy"`
+	DefaultIndex                string                            `yaml:"defaultIndex"`
+	Urls                        []string                          `yaml:"urls"`
+	BatchSizeLimit              int                               `yaml:"batchSizeLimit"`
+	BatchTickerDuration         time.Duration                     `yaml:"batchTickerDuration"`
+	ConcurrentRequest           int                               `yaml:"concurrentRequest"`
+	MaxRetries                  int                               `yaml:"maxRetries"`
+	CompressionEnabled          bool                              `yaml:"compressionEnabled"`
+	DisableDiscoverNodesOnStart bool                              `yaml:"disableDiscoverNodesOnStart"`
 }
 
 // Retry configures an optional layer that re-submits only the retryable items
@@ -50,14 +70,188 @@ type Elasticsearch struct {
 // Backoff sleeps happen while the flush lock is held, so a single flush can be
 // delayed by up to MaxInterval*MaxRetries when a cluster is unhealthy; size
 // these values with that latency ceiling in mind.
+//
+// ConflictRetries enables compare-and-set semantics for conditional actions
+// (IfSeqNo/IfPrimaryTerm): an item rejected with 409 is rebuilt by re-running
+// the mapper for its event, which reads the current document again, and
+// re-submitted up to ConflictRetries times per item. Zero disables it. It
+// requires Enabled, and the mapper then runs in the flush goroutine with the
+// flush lock held, so it should not block.
 type Retry struct {
 	RetryOnStatus   []int         `yaml:"retryOnStatus"`
 	MaxRetries      int           `yaml:"maxRetries"`
+	ConflictRetries int           `yaml:"conflictRetries"`
 	InitialInterval time.Duration `yaml:"initialInterval"`
 	MaxInterval     time.Duration `yaml:"maxInterval"`
 	Enabled         bool          `yaml:"enabled"`
 }
 
+const (
+	// MappingErrorPolicySkip acknowledges an event whose mapper returned an
+	// error without writing anything for it.
+	MappingErrorPolicySkip = "skip"
+	// MappingErrorPolicyFail stops the connector with a panic.
+	MappingErrorPolicyFail = "fail"
+)
+
+const (
+	VersionSourceCas   = "cas"
+	VersionSourceRevNo = "revNo"
+)
+
+// ExternalVersioning makes the default mapper send Index and Delete actions
+// with an external version taken from the Couchbase event (CAS or revision
+// number), so a late retry or a replay after rebalance cannot overwrite a newer
+// document with an older one. Writes rejected as stale are reported to
+// OnSuccess as no-ops. Custom mappers set ESActionDocument.Version themselves.
+// Only the default cluster's block is used; a block in a clusters entry is
+// rejected at startup.
+type ExternalVersioning struct {
+	Source  string `yaml:"source"`
+	Type    string `yaml:"type"`
+	Enabled bool   `yaml:"enabled"`
+}
+
+const (
+	ValidationCheckJSON      = "json"
+	ValidationCheckIDLength  = "idLength"
+	ValidationCheckIndexName = "indexName"
+	ValidationCheckRouting   = "routing"
+)
+
+// Validation configures the pre-flight checks run on every action returned by
+// the mapper before it enters the batch. Actions that fail a check are passed
+// to SinkResponseHandler.OnError with an elasticsearch.ValidationError and are
+// never sent. Checks defaults to all of them when enabled. Only the default
+// cluster's block is used; it applies to actions of every cluster.
+type Validation struct {
+	Checks     []string `yaml:"checks"`
+	MaxIDBytes int      `yaml:"maxIdBytes"`
+	Enabled    bool     `yaml:"enabled"`
+}
+
+const (
+	// SchemaViolationPolicyReject passes a violating action to
+	// SinkResponseHandler.OnError.
+	SchemaViolationPolicyReject = "reject"
+	// SchemaViolationPolicyQuarantine writes a violating action's document to
+	// QuarantineIndex instead.
+	SchemaViolationPolicyQuarantine = "quarantine"
+)
+
+// SchemaValidation checks the source the mapper built for index and create
+// actions against a JSON Schema file before they enter the batch. Schemas maps
+// a collectionIndexMapping key to a schema path, so an event is checked
+// against the schema of the entry its index comes from; $1 and ${name} in the
+// path are expanded from a pattern key. Violations are handled by Policy
+// (reject by default). Only the default cluster's block is used; it applies to
+// actions of every cluster.
+type SchemaValidation struct {
+	Schemas         map[string]string `yaml:"schemas"`
+	Policy          string            `yaml:"policy"`
+	QuarantineIndex string            `yaml:"quarantineIndex"`
+}
+
+const (
+	CoerceString = "string"
+	CoerceInt    = "int"
+	CoerceFloat  = "float"
+	CoerceBool   = "bool"
+)
+
+// DocumentMapping reshapes the JSON value of a collection's documents before
+// the mapper sees it. Steps run in field order: Flatten, Include, Exclude,
+// Rename, Coerce, then Constant. Fields are dotted paths into nested objects;
+// after flattening, the flattened names are used.
+type DocumentMapping struct {
+	// Rename maps a field to its new name. All renames read the document
+	// before any field moves, so a→b with b→c moves the original b to c.
+	Rename map[string]string `yaml:"rename"`
+	// Coerce maps a field to the type it is converted to: string, int, float
+	// or bool.
+	Coerce map[string]string `yaml:"coerce"`
+	// Constant sets fields to fixed values.
+	Constant map[string]any `yaml:"constant"`
+	// Flatten replaces each listed object with its leaf fields, named by
+	// joining the path with FlattenSeparator ("_" by default).
+	Flatten          []string `yaml:"flatten"`
+	Include          []string `yaml:"include"`
+	Exclude          []string `yaml:"exclude"`
+	FlattenSeparator string   `yaml:"flattenSeparator"`
+}
+
+const (
+	// UnmappedCollectionPolicyPanic stops the connector when an action's
+	// collection has no index mapping.
+	UnmappedCollectionPolicyPanic = "panic"
+	// UnmappedCollectionPolicySkip drops the action and acknowledges the event.
+	UnmappedCollectionPolicySkip = "skip"
+	// UnmappedCollectionPolicyDefaultIndex writes the action to DefaultIndex.
+	UnmappedCollectionPolicyDefaultIndex = "defaultIndex"
+)
+
+const (
+	ReplicationMetadataCollection = "collection"
+	ReplicationMetadataCas        = "cas"
+	ReplicationMetadataSeqNo      = "seqNo"
+	ReplicationMetadataVbID       = "vbId"
+	ReplicationMetadataRevNo      = "revNo"
+	ReplicationMetadataEventTime  = "eventTime"
+	ReplicationMetadataGroup      = "group"
+)
+
+// ReplicationMetadata adds the Couchbase provenance of a collection's
+// documents as an object under Field ("_cb" by default) to the source of
+// index, create and doc update actions. Fields lists the metadata to add, in
+// order, and defaults to all of it but collection. Only the default cluster's
+// entries are used.
+type ReplicationMetadata struct {
+	Field  string   `yaml:"field"`
+	Fields []string `yaml:"fields"`
+}
+
+const (
+	// DeletionPolicyDelete sends the mapper's actions, a delete for the
+	// default mapper.
+	DeletionPolicyDelete = "delete"
+	// DeletionPolicyIgnore acknowledges the event without writes.
+	DeletionPolicyIgnore = "ignore"
+	// DeletionPolicySoftDelete marks the document as deleted with a partial
+	// update.
+	DeletionPolicySoftDelete = "softDelete"
+)
+
+// DeletionPolicy decides what deletions and expirations of a collection's
+// documents do. A soft delete updates the document with
+// {"deleted":true,"deletedAt":<event time>,"reason":"deleted"|"expired"}.
+// With PurgeAfter set, soft-deleted documents older than it are removed every
+// PurgeInterval (1h by default) from PurgeIndex, an index name or pattern.
+// PurgeIndex defaults to the collection's collectionIndexMapping entry and is
+// required when that entry is a template or the key is a pattern.
+type DeletionPolicy struct {
+	Deletion      string        `yaml:"deletion"`
+	Expiration    string        `yaml:"expiration"`
+	PurgeIndex    string        `yaml:"purgeIndex"`
+	PurgeAfter    time.Duration `yaml:"purgeAfter"`
+	PurgeInterval time.Duration `yaml:"purgeInterval"`
+}
+
+// Script is a script uploaded as a stored script at startup. Mappers
+// reference it by name through the script registry of their MapperContext.
+type Script struct {
+	Source string `yaml:"source"`
+	Lang   string `yaml:"lang"`
+}
+
+// Enrichment configures the lookup cache of the mappers' Enricher: at
+// most CacheSize documents are kept, each for at most TTL, and a batch of KV
+// gets fails after Timeout. Only the default cluster's block is used.
+type Enrichment struct {
+	CacheSize int           `yaml:"cacheSize"`
+	TTL       time.Duration `yaml:"ttl"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
 type RejectionLog struct {
 	Index         string `yaml:"index"`
 	TargetCluster string `yaml:"targetCluster"`
@@ -102,9 +296,111 @@ func ApplyElasticsearchDefaults(es *Elasticsearch) {
 		es.MaxRetries = math.MaxInt
 	}
 
+	if es.MappingErrorPolicy == "" {
+		es.MappingErrorPolicy = MappingErrorPolicySkip
+	}
+
+	if es.UnmappedCollectionPolicy == "" {
+		es.UnmappedCollectionPolicy = UnmappedCollectionPolicyPanic
+	}
+
 	if es.Retry != nil && es.Retry.Enabled {
 		ApplyRetryDefaults(es.Retry)
 	}
+
+	if es.ExternalVersioning != nil && es.ExternalVersioning.Enabled {
+		ApplyExternalVersioningDefaults(es.ExternalVersioning)
+	}
+
+	if es.Validation != nil && es.Validation.Enabled {
+		ApplyValidationDefaults(es.Validation)
+	}
+
+	ApplyEnrichmentDefaults(&es.Enrichment)
+
+	if es.SchemaValidation != nil && es.SchemaValidation.Policy == "" {
+		es.SchemaValidation.Policy = SchemaViolationPolicyReject
+	}
+
+	for collection, m := range es.ReplicationMetadata {
+		ApplyReplicationMetadataDefaults(&m)
+		es.ReplicationMetadata[collection] = m
+	}
+
+	for collection, p := range es.DeletionPolicies {
+		ApplyDeletionPolicyDefaults(&p)
+		es.DeletionPolicies[collection] = p
+	}
+}
+
+func ApplyEnrichmentDefaults(e *Enrichment) {
+	if e.CacheSize == 0 {
+		e.CacheSize = 10000
+	}
+
+	if e.TTL == 0 {
+		e.TTL = 5 * time.Minute
+	}
+
+	if e.Timeout == 0 {
+		e.Timeout = 2500 * time.Millisecond
+	}
+}
+
+func ApplyDeletionPolicyDefaults(p *DeletionPolicy) {
+	if p.Deletion == "" {
+		p.Deletion = DeletionPolicyDelete
+	}
+
+	if p.Expiration == "" {
+		p.Expiration = DeletionPolicyDelete
+	}
+
+	if p.PurgeAfter > 0 && p.PurgeInterval == 0 {
+		p.PurgeInterval = time.Hour
+	}
+}
+
+func ApplyReplicationMetadataDefaults(m *ReplicationMetadata) {
+	if m.Field == "" {
+		m.Field = "_cb"
+	}
+
+	if len(m.Fields) == 0 {
+		m.Fields = []string{
+			ReplicationMetadataCas,
+			ReplicationMetadataSeqNo,
+			ReplicationMetadataVbID,
+			ReplicationMetadataRevNo,
+			ReplicationMetadataEventTime,
+			ReplicationMetadataGroup,
+		}
+	}
+}
+
+func ApplyValidationDefaults(v *Validation) {
+	if len(v.Checks) == 0 {
+		v.Checks = []string{
+			ValidationCheckJSON,
+			ValidationCheckIDLength,
+			ValidationCheckIndexName,
+			ValidationCheckRouting,
+		}
+	}
+
+	if v.MaxIDBytes == 0 {
+		v.MaxIDBytes = 512
+	}
+}
+
+func ApplyExternalVersioningDefaults(v *ExternalVersioning) {
+	if v.Source == "" {
+		v.Source = VersionSourceCas
+	}
+
+	if v.Type == "" {
+		v.Type = "external"
+	}
 }
 
 func ApplyRetryDefaults(r *Retry) {
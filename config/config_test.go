@@ -92,3 +92,85 @@ func Test_ApplyDefaults_ClusterNoInheritWhenDefaultRetryNil(t *testing.T) {
 		t.Fatal("cluster must not gain retry when default cluster has none")
 	}
 }
+
+func Test_ApplyDefaults_ExternalVersioning(t *testing.T) {
+	c := &Config{Elasticsearch: Elasticsearch{
+		Urls:               []string{"http://localhost:9200"},
+		ExternalVersioning: &ExternalVersioning{Enabled: true},
+	}}
+	c.ApplyDefaults()
+
+	v := c.Elasticsearch.ExternalVersioning
+	if v.Source != VersionSourceCas {
+		t.Fatalf("Source = %q, want %q", v.Source, VersionSourceCas)
+	}
+	if v.Type != "external" {
+		t.Fatalf("Type = %q, want external", v.Type)
+	}
+}
+
+func Test_ApplyDefaults_Validation(t *testing.T) {
+	c := &Config{Elasticsearch: Elasticsearch{
+		Urls:       []string{"http://localhost:9200"},
+		Validation: &Validation{Enabled: true},
+	}}
+	c.ApplyDefaults()
+
+	v := c.Elasticsearch.Validation
+	if len(v.Checks) != 4 {
+		t.Fatalf("Checks = %v, want all checks", v.Checks)
+	}
+	if v.MaxIDBytes != 512 {
+		t.Fatalf("MaxIDBytes = %d, want 512", v.MaxIDBytes)
+	}
+}
+
+func Test_ApplyDefaults_MappingErrorPolicy(t *testing.T) {
+	c := &Config{Elasticsearch: Elasticsearch{Urls: []string{"http://localhost:9200"}}}
+	c.ApplyDefaults()
+
+	if c.Elasticsearch.MappingErrorPolicy != MappingErrorPolicySkip {
+		t.Fatalf("MappingErrorPolicy = %q, want %q", c.Elasticsearch.MappingErrorPolicy, MappingErrorPolicySkip)
+	}
+}
+
+func Test_ApplyDefaults_ReplicationMetadata(t *testing.T) {
+	c := &Config{Elasticsearch: Elasticsearch{
+		Urls:                []string{"http://localhost:9200"},
+		ReplicationMetadata: map[string]ReplicationMetadata{"orders": {}},
+	}}
+	c.ApplyDefaults()
+
+	m := c.Elasticsearch.ReplicationMetadata["orders"]
+	if m.Field != "_cb" || len(m.Fields) != 6 {
+		t.Fatalf("ReplicationMetadata = %+v, want _cb with all fields", m)
+	}
+}
+
+func Test_ApplyDefaults_DeletionPolicies(t *testing.T) {
+	c := &Config{Elasticsearch: Elasticsearch{
+		Urls: []string{"http://localhost:9200"},
+		DeletionPolicies: map[string]DeletionPolicy{
+			"orders": {Expiration: DeletionPolicySoftDelete, PurgeAfter: 24 * time.Hour},
+		},
+	}}
+	c.ApplyDefaults()
+
+	p := c.Elasticsearch.DeletionPolicies["orders"]
+	if p.Deletion != DeletionPolicyDelete || p.Expiration != DeletionPolicySoftDelete || p.PurgeInterval != time.Hour {
+		t.Fatalf("DeletionPolicy = %+v", p)
+	}
+}
+
+func Test_ApplyDefaults_Enrichment(t *testing.T) {
+	c := &Config{Elasticsearch: Elasticsearch{
+		Urls:       []string{"http://localhost:9200"},
+		Enrichment: Enrichment{TTL: time.Minute},
+	}}
+	c.ApplyDefaults()
+
+	e := c.Elasticsearch.Enrichment
+	if e.CacheSize != 10000 || e.TTL != time.Minute || e.Timeout != 2500*time.Millisecond {
+		t.Fatalf("Enrichment = %+v", e)
+	}
+}
@@ -14,11 +14,13 @@ import (
 	jsoniter "github.com/json-iterator/go"
 
 	dcpCouchbase "github.com/Trendyol/go-dcp/couchbase"
+	"github.com/couchbase/gocbcore/v10"
 
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/client"
 	"github.com/elastic/go-elasticsearch/v7"
 
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/script"
 	"github.com/Trendyol/go-dcp/helpers"
 
 	"github.com/sirupsen/logrus"
@@ -27,8 +29,11 @@ import (
 
 	"github.com/Trendyol/go-dcp-elasticsearch/config"
 	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/decoder"
 	dcpElasticsearch "github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/bulk"
+	"github.com/Trendyol/go-dcp-elasticsearch/enrichment"
+	"github.com/Trendyol/go-dcp-elasticsearch/filter"
 	"github.com/Trendyol/go-dcp-elasticsearch/metric"
 	"gopkg.in/yaml.v3"
 
@@ -44,16 +49,23 @@ type Connector interface {
 
 type connector struct {
 	dcp                 dcp.Dcp
-	mapper              Mapper
+	mapper              ErrorMapper
 	config              *config.Config
 	bulk                *bulk.Bulk
 	esClient            *elasticsearch.Client
+	scriptRegistry      *script.Registry
+	enricher            *enrichment.Enricher
+	scopeName           string
+	filters             map[string]*filter.Filter
+	valueDecoders       map[string]decoder.ValueDecoder
+	purger              *purger
 	sinkResponseHandler dcpElasticsearch.SinkResponseHandler
 }
 
 func (c *connector) Start() {
 	go func() {
 		<-c.dcp.WaitUntilReady()
+		c.purger.start()
 		c.bulk.StartBulk()
 	}()
 	c.dcp.Start()
@@ -61,6 +73,7 @@ func (c *connector) Start() {
 
 func (c *connector) Close() {
 	c.dcp.Close()
+	c.purger.close()
 	c.bulk.Close()
 }
 
@@ -81,6 +94,10 @@ func (c *connector) listener(ctx *models.ListenerContext) {
 			event.Key, event.Value,
 			event.CollectionName, event.Cas, event.EventTime, event.VbID, event.SeqNo, event.RevNo,
 		)
+		e.Flags = event.Flags
+		e.Expiry = event.Expiry
+		e.LockTime = event.LockTime
+		e.Datatype = event.Datatype
 	case models.DcpExpiration:
 		e = couchbase.NewExpireEvent(
 			c.esClient,
@@ -93,12 +110,43 @@ func (c *connector) listener(ctx *models.ListenerContext) {
 			event.Key, nil,
 			event.CollectionName, event.Cas, event.EventTime, event.VbID, event.SeqNo, event.RevNo,
 		)
+		e.Datatype = event.Datatype
 	default:
 		return
 	}
 
 	e.ListenerTrace = listenerTrace
-	actions := c.mapper(e)
+	e.ScopeName = c.scopeName
+
+	c.enricher.Invalidate(e.QualifiedCollectionName(), e.Key)
+
+	if e.IsMutated {
+		if err := c.decodeValue(&e); err != nil {
+			logger.Log.Error("error while decoding value, collection: %s, key: %s, err: %v", e.CollectionName, e.Key, err)
+			c.bulk.RejectEvent(e, err)
+			ctx.Ack()
+			return
+		}
+	}
+
+	if f, ok := filter.Lookup(c.filters, e); ok {
+		match, err := f.Match(e)
+		if err != nil {
+			c.handleFilterError(ctx, e, err)
+			return
+		}
+		if !match {
+			c.bulk.CountFilteredEvent(e.CollectionName)
+			ctx.Ack()
+			return
+		}
+	}
+
+	actions, err := c.mapper(e)
+	if err != nil {
+		c.handleMappingError(ctx, e, err)
+		return
+	}
 
 	if len(actions) == 0 {
 		ctx.Ack()
@@ -110,11 +158,59 @@ func (c *connector) listener(ctx *models.ListenerContext) {
 		chunks := helpers.ChunkSliceWithSize[document.ESActionDocument](actions, batchSizeLimit)
 		lastChunkIndex := len(chunks) - 1
 		for idx, chunk := range chunks {
-			c.bulk.AddActions(ctx, e.EventTime, chunk, e.CollectionName, idx == lastChunkIndex)
+			c.bulk.AddEventActions(ctx, e, chunk, idx == lastChunkIndex)
 		}
 	} else {
-		c.bulk.AddActions(ctx, e.EventTime, actions, e.CollectionName, true)
+		c.bulk.AddEventActions(ctx, e, actions, true)
+	}
+}
+
+// decodeValue replaces the value of e with the output of the value decoder
+// configured for its collection, if any.
+func (c *connector) decodeValue(e *couchbase.Event) error {
+	d, ok := c.valueDecoders[e.QualifiedCollectionName()]
+	if !ok {
+		if d, ok = c.valueDecoders[e.CollectionName]; !ok {
+			return nil
+		}
+	}
+	value, err := d.Decode(e.Value)
+	if err != nil {
+		return fmt.Errorf("decode value: %w", err)
 	}
+	e.Value = value
+	return nil
+}
+
+// handleFilterError reports an elasticsearch.filter expression that failed
+// for e and applies the mapping error policy to it. It is counted apart from
+// mapper errors.
+func (c *connector) handleFilterError(ctx *models.ListenerContext, e couchbase.Event, err error) {
+	logger.Log.Error("error while filtering event, collection: %s, key: %s, err: %v", e.CollectionName, e.Key, err)
+	c.bulk.CountFilterError(e.CollectionName)
+	c.applyMappingErrorPolicy(ctx, e, fmt.Errorf("filter: %w", err))
+}
+
+// handleMappingError reports a mapper error and applies the mapping error
+// policy: the event is acknowledged without writes, or the connector stops.
+func (c *connector) handleMappingError(ctx *models.ListenerContext, e couchbase.Event, err error) {
+	logger.Log.Error("error while mapping event, collection: %s, key: %s, err: %v", e.CollectionName, e.Key, err)
+	c.bulk.CountMappingError(e.CollectionName)
+	c.applyMappingErrorPolicy(ctx, e, err)
+}
+
+// applyMappingErrorPolicy passes an event that could not be mapped to the
+// MappingErrorHandler, then acknowledges it or panics as
+// elasticsearch.mappingErrorPolicy says.
+func (c *connector) applyMappingErrorPolicy(ctx *models.ListenerContext, e couchbase.Event, err error) {
+	if handler, ok := c.sinkResponseHandler.(dcpElasticsearch.MappingErrorHandler); ok {
+		handler.OnMappingError(&dcpElasticsearch.MappingErrorContext{Event: e, Err: err})
+	}
+
+	if c.config.Elasticsearch.MappingErrorPolicy == config.MappingErrorPolicyFail {
+		panic(fmt.Errorf("mapping error for key %s: %w", e.Key, err))
+	}
+	ctx.Ack()
 }
 
 func newConnectorConfigFromPath(path string) (*config.Config, error) {
@@ -156,7 +252,15 @@ func newConfig(cf any) (*config.Config, error) {
 	}
 }
 
-func newConnector(cf any, mapper Mapper, sinkResponseHandler dcpElasticsearch.SinkResponseHandler, metricCollectors ...prometheus.Collector) (Connector, error) { //nolint:lll
+func newConnector(
+	cf any,
+	mapper ErrorMapper,
+	mapperFactory MapperFactory,
+	middlewares []MapperMiddleware,
+	decoders *decoder.Registry,
+	sinkResponseHandler dcpElasticsearch.SinkResponseHandler,
+	metricCollectors ...prometheus.Collector,
+) (Connector, error) {
 	cfg, err := newConfig(cf)
 	if err != nil {
 		return nil, err
@@ -166,8 +270,28 @@ func newConnector(cf any, mapper Mapper, sinkResponseHandler dcpElasticsearch.Si
 		return nil, err
 	}
 
+	switch cfg.Elasticsearch.MappingErrorPolicy {
+	case config.MappingErrorPolicySkip, config.MappingErrorPolicyFail:
+	default:
+		return nil, fmt.Errorf("elasticsearch.mappingErrorPolicy: unknown policy %q", cfg.Elasticsearch.MappingErrorPolicy)
+	}
+	if err := checkExternalVersioning(cfg.Elasticsearch); err != nil {
+		return nil, err
+	}
+
+	filters, err := filter.NewFilters(cfg.Elasticsearch.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	valueDecoders, err := decoders.Resolve(cfg.Elasticsearch.ValueDecoders)
+	if err != nil {
+		return nil, err
+	}
+
 	connector := &connector{
-		mapper:              mapper,
+		filters:             filters,
+		valueDecoders:       valueDecoders,
 		config:              cfg,
 		sinkResponseHandler: sinkResponseHandler,
 	}
@@ -184,6 +308,38 @@ func newConnector(cf any, mapper Mapper, sinkResponseHandler dcpElasticsearch.Si
 
 	dcpConfig := dcp.GetConfig()
 	dcpConfig.Checkpoint.Type = "manual"
+	connector.scopeName = dcpConfig.ScopeName
+	connector.enricher = enrichment.New(
+		enrichment.NewCouchbaseFetcher(func() *gocbcore.Agent { return dcp.GetClient().GetAgent() }, cfg.Elasticsearch.Enrichment.Timeout),
+		cfg.Elasticsearch.Enrichment,
+		dcpConfig.ScopeName,
+	)
+
+	connector.scriptRegistry = script.NewRegistry(cfg.Elasticsearch.Scripts)
+
+	if mapperFactory != nil {
+		mapper, err = mapperFactory(MapperContext{ScriptRegistry: connector.scriptRegistry, Enricher: connector.enricher})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if mapper == nil {
+		mapper = toErrorMapper(NewDefaultMapper(cfg.Elasticsearch.ExternalVersioning))
+	}
+	if len(cfg.Elasticsearch.DocumentMappings) > 0 {
+		mapper, err = newDocumentMappingErrorMapper(cfg.Elasticsearch.DocumentMappings, mapper)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Elasticsearch.DeletionPolicies) > 0 {
+		mapper, err = newDeletionPolicyMapper(cfg.Elasticsearch.DeletionPolicies, mapper)
+		if err != nil {
+			return nil, err
+		}
+	}
+	mapper = ChainErrorMapper(mapper, middlewares...)
+	connector.mapper = mapper
 
 	esClients, err := buildElasticsearchClients(cfg)
 	if err != nil {
@@ -191,17 +347,27 @@ func newConnector(cf any, mapper Mapper, sinkResponseHandler dcpElasticsearch.Si
 	}
 	connector.esClient = esClients[""]
 
+	if err := connector.scriptRegistry.Upload(esClients); err != nil {
+		return nil, err
+	}
+
 	connector.dcp = dcp
-	connector.bulk, err = bulk.NewBulk(
+	connector.bulk, err = bulk.NewBulkWithMapper(
 		cfg,
 		dcp.Commit,
 		esClients,
 		sinkResponseHandler,
+		mapper,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	connector.purger, err = newPurger(cfg.Elasticsearch.DeletionPolicies, connector.bulk)
+	if err != nil {
+		return nil, err
+	}
+
 	connector.dcp.SetEventHandler(
 		&DcpEventHandler{
 			isFinite: dcpConfig.IsDcpModeFinite(),
@@ -209,31 +375,68 @@ func newConnector(cf any, mapper Mapper, sinkResponseHandler dcpElasticsearch.Si
 		})
 
 	metricCollector := metric.NewMetricCollector(connector.bulk)
-	dcp.SetMetricCollectors(metricCollector)
+	dcp.SetMetricCollectors(metricCollector, metric.NewEnrichmentCollector(connector.enricher))
 
 	return connector, nil
 }
 
 type ConnectorBuilder struct {
-	mapper              Mapper
+	mapper              ErrorMapper
+	mapperFactory       MapperFactory
 	config              any
+	middlewares         []MapperMiddleware
+	decoders            *decoder.Registry
 	sinkResponseHandler dcpElasticsearch.SinkResponseHandler
 	metricCollectors    []prometheus.Collector
 }
 
 func NewConnectorBuilder(config any) *ConnectorBuilder {
 	return &ConnectorBuilder{
-		config: config,
-		mapper: DefaultMapper,
+		config:   config,
+		decoders: decoder.NewRegistry(),
 	}
 }
 
 func (c *ConnectorBuilder) Build() (Connector, error) {
-	return newConnector(c.config, c.mapper, c.sinkResponseHandler, c.metricCollectors...)
+	return newConnector(c.config, c.mapper, c.mapperFactory, c.middlewares, c.decoders, c.sinkResponseHandler, c.metricCollectors...)
 }
 
 func (c *ConnectorBuilder) SetMapper(mapper Mapper) *ConnectorBuilder {
+	c.mapper = toErrorMapper(mapper)
+	c.mapperFactory = nil
+	return c
+}
+
+// SetErrorMapper sets a mapper that can return an error; it replaces a mapper
+// set with SetMapper.
+func (c *ConnectorBuilder) SetErrorMapper(mapper ErrorMapper) *ConnectorBuilder {
 	c.mapper = mapper
+	c.mapperFactory = nil
+	return c
+}
+
+// SetMapperFactory sets a function that builds the mapper from the stored
+// scripts and the enricher the connector creates from its configuration. It
+// is called once by Build and replaces a mapper set with SetMapper or
+// SetErrorMapper.
+func (c *ConnectorBuilder) SetMapperFactory(factory MapperFactory) *ConnectorBuilder {
+	c.mapper = nil
+	c.mapperFactory = factory
+	return c
+}
+
+// UseMapperMiddleware wraps the mapper, including the default one, with
+// middlewares. The first middleware sees each event first; they run before
+// elasticsearch.documentMappings.
+func (c *ConnectorBuilder) UseMapperMiddleware(middlewares ...MapperMiddleware) *ConnectorBuilder {
+	c.middlewares = append(c.middlewares, middlewares...)
+	return c
+}
+
+// RegisterValueDecoder makes valueDecoder available to elasticsearch.valueDecoders
+// under name, next to the built-in snappy, msgpack and base64 decoders.
+func (c *ConnectorBuilder) RegisterValueDecoder(name string, valueDecoder decoder.ValueDecoder) *ConnectorBuilder {
+	c.decoders.Register(name, valueDecoder)
 	return c
 }
 
@@ -12,16 +12,31 @@ type Event struct {
 	ElasticsearchClient *elasticsearch.Client
 	ListenerTrace       tracing.ListenerTrace
 	EventTime           time.Time
-	CollectionName      string
-	Key                 []byte
-	Value               []byte
-	Cas                 uint64
-	VbID                uint16
-	IsDeleted           bool
-	IsExpired           bool
-	IsMutated           bool
-	SeqNo               uint64
-	RevNo               uint64
+	// ScopeName is the scope of CollectionName, dcp.scopeName.
+	ScopeName      string
+	CollectionName string
+	Key            []byte
+	Value          []byte
+	Cas            uint64
+	VbID           uint16
+	IsDeleted      bool
+	IsExpired      bool
+	IsMutated      bool
+	SeqNo          uint64
+	RevNo          uint64
+	// Flags, Expiry and LockTime are only set for mutations. Expiry is the
+	// document's expiration as Unix seconds, 0 when it has none.
+	Flags    uint32
+	Expiry   uint32
+	LockTime uint32
+	// Datatype is the document's datatype bit field (JSON, snappy, xattr),
+	// set for mutations and deletions.
+	Datatype uint8
+}
+
+// QualifiedCollectionName returns the event's collection as scope.collection.
+func (e Event) QualifiedCollectionName() string {
+	return e.ScopeName + "." + e.CollectionName
 }
 
 func NewDeleteEvent(
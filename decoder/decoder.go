@@ -0,0 +1,106 @@
+package decoder
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Names of the built-in decoders.
+const (
+	Snappy  = "snappy"
+	Msgpack = "msgpack"
+	Base64  = "base64"
+)
+
+// ValueDecoder turns a document value stored in Couchbase into the JSON
+// document sent to Elasticsearch.
+type ValueDecoder interface {
+	Decode(value []byte) ([]byte, error)
+}
+
+// Func adapts a function to a ValueDecoder.
+type Func func(value []byte) ([]byte, error)
+
+func (f Func) Decode(value []byte) ([]byte, error) {
+	return f(value)
+}
+
+// Registry holds the decoders elasticsearch.valueDecoders can name.
+type Registry struct {
+	decoders map[string]ValueDecoder
+	mu       sync.RWMutex
+}
+
+// NewRegistry returns a registry with the built-in decoders:
+//
+//	snappy   Snappy-compressed (block format) JSON
+//	msgpack  a MessagePack document, converted to JSON
+//	base64   any binary value, wrapped as {"value":"<base64>"}
+func NewRegistry() *Registry {
+	return &Registry{decoders: map[string]ValueDecoder{
+		Snappy:  Func(decodeSnappy),
+		Msgpack: Func(decodeMsgpack),
+		Base64:  Func(wrapBase64),
+	}}
+}
+
+// Register adds decoder under name, replacing a decoder of the same name.
+func (r *Registry) Register(name string, decoder ValueDecoder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.decoders[name] = decoder
+}
+
+func (r *Registry) Get(name string) (ValueDecoder, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	decoder, ok := r.decoders[name]
+	return decoder, ok
+}
+
+// Resolve returns the decoder of every collection in valueDecoders
+// (elasticsearch.valueDecoders), which maps a collection to a decoder name.
+func (r *Registry) Resolve(valueDecoders map[string]string) (map[string]ValueDecoder, error) {
+	resolved := make(map[string]ValueDecoder, len(valueDecoders))
+	for collection, name := range valueDecoders {
+		decoder, ok := r.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("elasticsearch.valueDecoders.%s: unknown decoder %q", collection, name)
+		}
+		resolved[collection] = decoder
+	}
+	return resolved, nil
+}
+
+func decodeSnappy(value []byte) ([]byte, error) {
+	decoded, err := snappy.Decode(nil, value)
+	if err != nil {
+		return nil, err
+	}
+	if !jsoniter.Valid(decoded) {
+		return nil, fmt.Errorf("snappy: decompressed value is not JSON")
+	}
+	return decoded, nil
+}
+
+func decodeMsgpack(value []byte) ([]byte, error) {
+	var document any
+	if err := msgpack.Unmarshal(value, &document); err != nil {
+		return nil, err
+	}
+	return jsoniter.Marshal(document)
+}
+
+func wrapBase64(value []byte) ([]byte, error) {
+	result := make([]byte, 0, base64.StdEncoding.EncodedLen(len(value))+12)
+	result = append(result, `{"value":"`...)
+	result = base64.StdEncoding.AppendEncode(result, value)
+	return append(result, `"}`...), nil
+}
@@ -0,0 +1,59 @@
+package decoder
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestRegistry_BuiltIns(t *testing.T) {
+	packed, _ := msgpack.Marshal(map[string]any{"name": "a", "tags": []string{"x"}})
+
+	tests := []struct {
+		name  string
+		value []byte
+		want  string
+	}{
+		{Snappy, snappy.Encode(nil, []byte(`{"a":1}`)), `{"a":1}`},
+		{Msgpack, packed, `{"name":"a","tags":["x"]}`},
+		{Base64, []byte{0x0a, 0x01, 0xff}, `{"value":"CgH/"}`},
+	}
+
+	r := NewRegistry()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder, ok := r.Get(tt.name)
+			if !ok {
+				t.Fatalf("decoder %s is not registered", tt.name)
+			}
+			got, err := decoder.Decode(tt.value)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("Decode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistry_Errors(t *testing.T) {
+	r := NewRegistry()
+	snappyDecoder, _ := r.Get(Snappy)
+	if _, err := snappyDecoder.Decode([]byte(`{"a":1}`)); err == nil {
+		t.Fatal("uncompressed value must return an error")
+	}
+	if _, err := snappyDecoder.Decode(snappy.Encode(nil, []byte{0xff})); err == nil {
+		t.Fatal("non-JSON value must return an error")
+	}
+
+	if _, err := r.Resolve(map[string]string{"orders": "protobuf"}); err == nil {
+		t.Fatal("unknown decoder must be rejected")
+	}
+	r.Register("protobuf", Func(func([]byte) ([]byte, error) { return nil, errors.New("x") }))
+	if _, err := r.Resolve(map[string]string{"orders": "protobuf"}); err != nil {
+		t.Fatalf("registered decoder must resolve, got %v", err)
+	}
+}
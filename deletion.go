@@ -0,0 +1,205 @@
+package dcpelasticsearch
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Trendyol/go-dcp/logger"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/bulk"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+const (
+	tombstoneReasonDeleted = "deleted"
+	tombstoneReasonExpired = "expired"
+	tombstoneTimeLayout    = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// newDeletionPolicyMapper applies elasticsearch.deletionPolicies to the
+// deletions and expirations of the listed collections; other events are
+// passed on to next.
+func newDeletionPolicyMapper(policies map[string]config.DeletionPolicy, next ErrorMapper) (ErrorMapper, error) {
+	for collection, p := range policies {
+		for _, policy := range []string{p.Deletion, p.Expiration} {
+			switch policy {
+			case config.DeletionPolicyDelete, config.DeletionPolicyIgnore, config.DeletionPolicySoftDelete:
+			default:
+				return nil, fmt.Errorf("elasticsearch.deletionPolicies.%s: unknown policy %q", collection, policy)
+			}
+		}
+	}
+
+	return func(event couchbase.Event) ([]document.ESActionDocument, error) {
+		if event.IsMutated {
+			return next(event)
+		}
+		p, ok := deletionPolicy(policies, event)
+		if !ok {
+			return next(event)
+		}
+
+		policy, reason := p.Deletion, tombstoneReasonDeleted
+		if event.IsExpired {
+			policy, reason = p.Expiration, tombstoneReasonExpired
+		}
+		switch policy {
+		case config.DeletionPolicyIgnore:
+			return nil, nil
+		case config.DeletionPolicySoftDelete:
+			// A document that was never indexed has nothing to mark: without
+			// the upsert it is not created, and the 404 is a no-op.
+			return []document.ESActionDocument{
+				document.DocUpdateAction(event.Key).
+					Source(tombstone(event.EventTime, reason)).
+					DocAsUpsert(false).
+					IgnoreMissing(true).
+					Build(),
+			}, nil
+		default:
+			return next(event)
+		}
+	}, nil
+}
+
+func deletionPolicy(policies map[string]config.DeletionPolicy, event couchbase.Event) (config.DeletionPolicy, bool) {
+	if event.ScopeName != "" {
+		if p, ok := policies[event.QualifiedCollectionName()]; ok {
+			return p, true
+		}
+	}
+	p, ok := policies[event.CollectionName]
+	return p, ok
+}
+
+func tombstone(deletedAt time.Time, reason string) []byte {
+	result := make([]byte, 0, 80)
+	result = append(result, `{"deleted":true,"deletedAt":"`...)
+	result = deletedAt.UTC().AppendFormat(result, tombstoneTimeLayout)
+	result = append(result, `","reason":`...)
+	result = strconv.AppendQuote(result, reason)
+	return append(result, '}')
+}
+
+// purgeQuery matches the documents soft deleted more than purgeAfter ago.
+func purgeQuery(purgeAfter time.Duration) []byte {
+	return []byte(fmt.Sprintf(
+		`{"bool":{"filter":[{"term":{"deleted":true}},{"range":{"deletedAt":{"lt":"now-%ds"}}}]}}`,
+		int64(purgeAfter.Seconds()),
+	))
+}
+
+// purger periodically removes soft-deleted documents of the collections whose
+// deletion policy has a purgeAfter, with a delete-by-query sent through the
+// bulk.
+type purger struct {
+	bulk  *bulk.Bulk
+	done  chan struct{}
+	wg    sync.WaitGroup
+	items []purgeItem
+}
+
+type purgeItem struct {
+	collection string
+	index      string
+	query      []byte
+	interval   time.Duration
+}
+
+func newPurger(policies map[string]config.DeletionPolicy, b *bulk.Bulk) (*purger, error) {
+	p := &purger{bulk: b, done: make(chan struct{})}
+	for collection, policy := range policies {
+		if policy.PurgeAfter <= 0 {
+			continue
+		}
+		index, err := purgeIndex(collection, policy, b.IndexMappingEntry)
+		if err != nil {
+			return nil, fmt.Errorf("elasticsearch.deletionPolicies.%s: %w", collection, err)
+		}
+		p.items = append(p.items, purgeItem{
+			collection: collection,
+			index:      index,
+			query:      purgeQuery(policy.PurgeAfter),
+			interval:   policy.PurgeInterval,
+		})
+	}
+	return p, nil
+}
+
+// purgeIndex returns the index or index pattern a collection's purge deletes
+// from: the policy's purgeIndex, or else the collection's collectionIndexMapping
+// entry. A templated entry renders a different index over time and a pattern
+// key names no single collection, so a purge resolved from them would miss
+// older or sibling indices; both need an explicit purgeIndex.
+func purgeIndex(
+	collection string,
+	policy config.DeletionPolicy,
+	indexMappingEntry func(event couchbase.Event) (string, bool, error),
+) (string, error) {
+	if policy.PurgeIndex != "" {
+		return policy.PurgeIndex, nil
+	}
+	if bulk.IsCollectionPattern(collection) {
+		return "", errors.New("purgeIndex is required for a pattern key")
+	}
+	text, ok, err := indexMappingEntry(purgeEvent(collection))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New("purgeIndex is required, the collection has no collectionIndexMapping entry")
+	}
+	if strings.Contains(text, "{{") {
+		return "", errors.New("purgeIndex is required, the collection's collectionIndexMapping entry is a template")
+	}
+	return text, nil
+}
+
+func (p *purger) start() {
+	for _, item := range p.items {
+		p.wg.Add(1)
+		go p.run(item)
+	}
+}
+
+func (p *purger) run(item purgeItem) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(item.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			logger.Log.Info("purging soft-deleted documents of collection %s", item.collection)
+			// The empty routing keeps collectionRoutingMapping from limiting
+			// the purge to one shard.
+			p.bulk.AddEventActions(nil, purgeEvent(item.collection), []document.ESActionDocument{
+				document.DeleteByQueryAction(item.query).Index(item.index).Routing("").Build(),
+			}, false)
+		}
+	}
+}
+
+// purgeEvent is the document-less event a purge is added with and its default
+// index is looked up for; a scope.collection key is split into its scope and
+// collection.
+func purgeEvent(collection string) couchbase.Event {
+	event := couchbase.Event{CollectionName: collection, EventTime: time.Now()}
+	if scope, name, ok := strings.Cut(collection, "."); ok {
+		event.ScopeName, event.CollectionName = scope, name
+	}
+	return event
+}
+
+func (p *purger) close() {
+	close(p.done)
+	p.wg.Wait()
+}
@@ -0,0 +1,139 @@
+package dcpelasticsearch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+func TestDeletionPolicyMapper(t *testing.T) {
+	mapper, err := newDeletionPolicyMapper(map[string]config.DeletionPolicy{
+		"orders": {Deletion: config.DeletionPolicySoftDelete, Expiration: config.DeletionPolicySoftDelete},
+		"carts":  {Deletion: config.DeletionPolicyDelete, Expiration: config.DeletionPolicyIgnore},
+	}, toErrorMapper(DefaultMapper))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	eventTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		event    couchbase.Event
+		wantType document.EsAction
+		wantBody string
+		want     int
+	}{
+		{
+			name:     "soft_delete_deletion",
+			event:    couchbase.NewDeleteEvent(nil, []byte("1"), nil, "orders", 1, eventTime, 0, 1, 1),
+			want:     1,
+			wantType: document.DocUpdate,
+			wantBody: `{"deleted":true,"deletedAt":"2024-05-01T10:00:00.000Z","reason":"deleted"}`,
+		},
+		{
+			name:     "soft_delete_expiration",
+			event:    couchbase.NewExpireEvent(nil, []byte("1"), nil, "orders", 1, eventTime, 0, 1, 1),
+			want:     1,
+			wantType: document.DocUpdate,
+			wantBody: `{"deleted":true,"deletedAt":"2024-05-01T10:00:00.000Z","reason":"expired"}`,
+		},
+		{
+			name:     "delete",
+			event:    couchbase.NewDeleteEvent(nil, []byte("1"), nil, "carts", 1, eventTime, 0, 1, 1),
+			want:     1,
+			wantType: document.Delete,
+		},
+		{
+			name:  "ignore",
+			event: couchbase.NewExpireEvent(nil, []byte("1"), nil, "carts", 1, eventTime, 0, 1, 1),
+		},
+		{
+			name:     "mutation",
+			event:    couchbase.NewMutateEvent(nil, []byte("1"), []byte(`{}`), "orders", 1, eventTime, 0, 1, 1),
+			want:     1,
+			wantType: document.Index,
+			wantBody: `{}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actions, err := mapper(tt.event)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(actions) != tt.want {
+				t.Fatalf("got %d actions, want %d", len(actions), tt.want)
+			}
+			if tt.want == 0 {
+				return
+			}
+			if actions[0].Type != tt.wantType || string(actions[0].Source) != tt.wantBody {
+				t.Fatalf("got %s %s, want %s %s", actions[0].Type, actions[0].Source, tt.wantType, tt.wantBody)
+			}
+			if opts := actions[0].UpdateOptions; tt.wantType == document.DocUpdate &&
+				(opts == nil || opts.DocAsUpsert == nil || *opts.DocAsUpsert || opts.IgnoreMissing == nil || !*opts.IgnoreMissing) {
+				t.Fatalf("soft delete must not upsert and must ignore missing documents, got %+v", opts)
+			}
+		})
+	}
+}
+
+func TestDeletionPolicyMapper_UnknownPolicy(t *testing.T) {
+	_, err := newDeletionPolicyMapper(map[string]config.DeletionPolicy{
+		"orders": {Deletion: "archive", Expiration: config.DeletionPolicyDelete},
+	}, toErrorMapper(DefaultMapper))
+	if err == nil {
+		t.Fatal("unknown policy must be rejected")
+	}
+}
+
+func TestPurgeQuery(t *testing.T) {
+	want := `{"bool":{"filter":[{"term":{"deleted":true}},{"range":{"deletedAt":{"lt":"now-86400s"}}}]}}`
+	if got := string(purgeQuery(24 * time.Hour)); got != want {
+		t.Fatalf("purgeQuery() = %s, want %s", got, want)
+	}
+}
+
+func TestPurgeIndex(t *testing.T) {
+	mapping := map[string]string{
+		"orders":   "orders",
+		"invoices": `invoices-{{ .EventTime | date "2006.01" }}`,
+	}
+	lookup := func(event couchbase.Event) (string, bool, error) {
+		text, ok := mapping[event.CollectionName]
+		return text, ok, nil
+	}
+	purge := config.DeletionPolicy{PurgeAfter: time.Hour}
+
+	tests := []struct {
+		name       string
+		collection string
+		purgeIndex string
+		want       string
+		wantErr    bool
+	}{
+		{name: "static_mapping", collection: "orders", want: "orders"},
+		{name: "scope_collection", collection: "sales.orders", want: "orders"},
+		{name: "explicit", collection: "invoices", purgeIndex: "invoices-*", want: "invoices-*"},
+		{name: "templated_mapping", collection: "invoices", wantErr: true},
+		{name: "pattern_key", collection: "order*", wantErr: true},
+		{name: "unmapped", collection: "carts", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := purge
+			policy.PurgeIndex = tt.purgeIndex
+			got, err := purgeIndex(tt.collection, policy, lookup)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("purgeIndex() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
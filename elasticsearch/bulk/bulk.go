@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +21,7 @@ import (
 	"github.com/Trendyol/go-dcp/logger"
 
 	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
 	dcpElasticsearch "github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
 	"github.com/Trendyol/go-dcp-elasticsearch/helper"
@@ -29,7 +32,15 @@ import (
 
 type Bulk struct {
 	sinkResponseHandler dcpElasticsearch.SinkResponseHandler
+	mapper              func(event couchbase.Event) ([]document.ESActionDocument, error)
 	metric              *Metric
+	validator           *validator
+	schemaValidator     *schemaValidator
+	deleteResolution    *indexMapping
+	recentWrites        *recentWrites
+	replicationMetadata map[string]*ReplicationMetadata
+	templates           templateCache
+	indexMappings       indexMappingCache
 	config              *config.Config
 	batchKeys           map[string]int
 	dcpCheckpointCommit func()
@@ -56,10 +67,26 @@ type Bulk struct {
 type Metric struct {
 	IndexingSuccessActionCounter map[string]int64
 	IndexingErrorActionCounter   map[string]int64
+	CreationSuccessActionCounter map[string]int64
+	CreationErrorActionCounter   map[string]int64
 	DeletionSuccessActionCounter map[string]int64
 	DeletionErrorActionCounter   map[string]int64
-	ProcessLatencyMs             int64
-	BulkRequestProcessLatencyMs  int64
+	// MappingErrorCounter counts mapper errors by collection name.
+	MappingErrorCounter map[string]int64
+	// FilteredEventCounter counts events dropped by elasticsearch.filter by
+	// collection name.
+	FilteredEventCounter map[string]int64
+	// FilterErrorCounter counts events whose elasticsearch.filter expression
+	// failed by collection name.
+	FilterErrorCounter map[string]int64
+	// UnmappedCollectionSkipCounter counts actions skipped by
+	// unmappedCollectionPolicy skip by collection name.
+	UnmappedCollectionSkipCounter map[string]int64
+	// SchemaViolationCounter counts actions that failed
+	// elasticsearch.schemaValidation by index name.
+	SchemaViolationCounter      map[string]int64
+	ProcessLatencyMs            int64
+	BulkRequestProcessLatencyMs int64
 }
 
 func NewBulk(
@@ -67,11 +94,60 @@ func NewBulk(
 	dcpCheckpointCommit func(),
 	esClients map[string]*elasticsearch.Client,
 	sinkResponseHandler dcpElasticsearch.SinkResponseHandler,
+) (*Bulk, error) {
+	return NewBulkWithMapper(config, dcpCheckpointCommit, esClients, sinkResponseHandler, nil)
+}
+
+// NewBulkWithMapper is NewBulk with the mapper that produced the actions. It is
+// re-run for conditional actions that lose a version conflict, see
+// config.Retry.ConflictRetries.
+func NewBulkWithMapper(
+	config *config.Config,
+	dcpCheckpointCommit func(),
+	esClients map[string]*elasticsearch.Client,
+	sinkResponseHandler dcpElasticsearch.SinkResponseHandler,
+	mapper func(event couchbase.Event) ([]document.ESActionDocument, error),
 ) (*Bulk, error) {
 	if esClients == nil || esClients[""] == nil {
 		return nil, fmt.Errorf("bulk: elasticsearch clients map must include default cluster (empty key)")
 	}
 
+	replicationMetadata, err := newReplicationMetadata(config.Elasticsearch.ReplicationMetadata, config.Dcp.Dcp.Group.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	validator, err := newValidator(config.Elasticsearch.Validation)
+	if err != nil {
+		return nil, err
+	}
+
+	schemaValidator, err := newSchemaValidator(config.Elasticsearch.SchemaValidation, config.Elasticsearch.CollectionIndexMapping)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteResolution, err := compileDeleteResolution(config.Elasticsearch.DeleteResolution)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkTemplates(config.Elasticsearch); err != nil {
+		return nil, err
+	}
+	if err := checkIndexMappings(config.Elasticsearch); err != nil {
+		return nil, err
+	}
+	if err := checkRetry(config.Elasticsearch); err != nil {
+		return nil, err
+	}
+	if err := checkDataStreams(config.Elasticsearch); err != nil {
+		return nil, err
+	}
+	if err := checkIndexPatterns(config.Elasticsearch); err != nil {
+		return nil, err
+	}
+
 	readers := make([]*helper.MultiDimByteReader, config.Elasticsearch.ConcurrentRequest)
 	for i := 0; i < config.Elasticsearch.ConcurrentRequest; i++ {
 		readers[i] = helper.NewMultiDimByteReader(nil)
@@ -87,10 +163,17 @@ func NewBulk(
 		dcpCheckpointCommit: dcpCheckpointCommit,
 		esClients:           esClients,
 		metric: &Metric{
-			IndexingSuccessActionCounter: make(map[string]int64),
-			IndexingErrorActionCounter:   make(map[string]int64),
-			DeletionSuccessActionCounter: make(map[string]int64),
-			DeletionErrorActionCounter:   make(map[string]int64),
+			IndexingSuccessActionCounter:  make(map[string]int64),
+			IndexingErrorActionCounter:    make(map[string]int64),
+			CreationSuccessActionCounter:  make(map[string]int64),
+			CreationErrorActionCounter:    make(map[string]int64),
+			DeletionSuccessActionCounter:  make(map[string]int64),
+			DeletionErrorActionCounter:    make(map[string]int64),
+			MappingErrorCounter:           make(map[string]int64),
+			FilteredEventCounter:          make(map[string]int64),
+			FilterErrorCounter:            make(map[string]int64),
+			UnmappedCollectionSkipCounter: make(map[string]int64),
+			SchemaViolationCounter:        make(map[string]int64),
 		},
 		config:              config,
 		typeName:            helper.Byte(config.Elasticsearch.TypeName),
@@ -98,6 +181,15 @@ func NewBulk(
 		concurrentRequest:   config.Elasticsearch.ConcurrentRequest,
 		batchKeys:           make(map[string]int, config.Elasticsearch.BatchSizeLimit),
 		sinkResponseHandler: sinkResponseHandler,
+		mapper:              mapper,
+		validator:           validator,
+		schemaValidator:     schemaValidator,
+		deleteResolution:    deleteResolution,
+		replicationMetadata: replicationMetadata,
+	}
+
+	if deleteResolution != nil {
+		bulk.recentWrites = newRecentWrites(maxRecentWrites)
 	}
 
 	if config.Elasticsearch.BatchCommitTickerDuration != nil {
@@ -147,48 +239,66 @@ func (b *Bulk) AddActions(
 	collectionName string,
 	isLastChunk bool,
 ) {
+	b.AddEventActions(ctx, couchbase.Event{CollectionName: collectionName, EventTime: eventTime}, actions, isLastChunk)
+}
+
+// AddEventActions is AddActions for the actions the mapper returned for event.
+// Index and routing templates, scope.collection mappings, replication metadata
+// and conflict remapping use the event; AddActions only passes on its
+// collection name and event time.
+func (b *Bulk) AddEventActions(
+	ctx *models.ListenerContext,
+	event couchbase.Event,
+	actions []document.ESActionDocument,
+	isLastChunk bool,
+) {
+	actions, unresolved, rejected := b.resolveDeletes(event, actions)
+
 	b.flushLock.Lock()
 	if b.isDcpRebalancing {
 		logger.Log.Warn("could not add new message to batch while rebalancing")
 		b.flushLock.Unlock()
 		return
 	}
+	if len(unresolved) > 0 {
+		var unsent []*dcpElasticsearch.SinkResponseHandlerContext
+		actions, unsent = b.expandUnresolvedDeletes(actions, unresolved)
+		rejected = append(rejected, unsent...)
+	}
+	var skipped int
 	for i := range actions {
-		clusterKey := config.NormalizeClusterKey(actions[i].ClusterKey)
-		actions[i].ClusterKey = clusterKey
-		actions[i].EventTime = eventTime
-
-		if clusterKey != "" {
-			if _, ok := b.esClients[clusterKey]; !ok {
-				err := fmt.Errorf("unknown elasticsearch cluster key %q", clusterKey)
-				logger.Log.Error("error while validating cluster key, err: %v", err)
-				panic(err)
+		if err := b.resolveAction(&actions[i], event); err != nil {
+			if errors.Is(err, errUnmappedCollection) {
+				skipped++
+				continue
 			}
+			rejected = append(rejected, &dcpElasticsearch.SinkResponseHandlerContext{Action: &actions[i], Err: err})
+			continue
+		}
+		if err := b.checkAction(&actions[i], event); err != nil {
+			rejected = append(rejected, &dcpElasticsearch.SinkResponseHandlerContext{Action: &actions[i], Err: err})
+			continue
+		}
+		if isByQuery(&actions[i]) {
+			b.addByQueryAction(&actions[i])
+			continue
 		}
+		value := getEsActionJSON(&actions[i], b.typeName)
 
-		indexName := b.getIndexName(collectionName, actions[i].IndexName, clusterKey)
-		actions[i].IndexName = indexName
-		value := getEsActionJSON(
-			actions[i].ID,
-			actions[i].Type,
-			actions[i].IndexName,
-			actions[i].Routing,
-			actions[i].Source,
-			b.typeName,
-		)
+		item := &dcpElasticsearch.BatchItem{
+			Action: &actions[i],
+			Bytes:  value,
+		}
+		if b.mapper != nil && isConditional(&actions[i]) {
+			item.Remap = b.remapFunc(event)
+		}
 
 		key := getActionKey(actions[i])
 		if batchIndex, ok := b.batchKeys[key]; ok {
 			b.batchByteSize += len(value) - len(b.batch[batchIndex].Bytes)
-			b.batch[batchIndex] = &dcpElasticsearch.BatchItem{
-				Action: &actions[i],
-				Bytes:  value,
-			}
+			b.batch[batchIndex] = item
 		} else {
-			b.batch = append(b.batch, &dcpElasticsearch.BatchItem{
-				Action: &actions[i],
-				Bytes:  value,
-			})
+			b.batch = append(b.batch, item)
 			b.batchKeys[key] = b.batchIndex
 			b.batchIndex++
 			b.batchSize++
@@ -201,25 +311,152 @@ func (b *Bulk) AddActions(
 
 	b.flushLock.Unlock()
 
+	b.rejectActions(rejected)
+	if skipped > 0 {
+		b.countUnmappedCollectionSkip(event.CollectionName, skipped)
+	}
+
 	if isLastChunk {
-		b.metric.ProcessLatencyMs = time.Since(eventTime).Milliseconds()
+		b.metric.ProcessLatencyMs = time.Since(event.EventTime).Milliseconds()
 	}
 	if b.batchSize >= b.batchSizeLimit || b.batchByteSize >= b.batchByteSizeLimit {
 		b.flushMessages()
 	}
 }
 
+// checkAction returns why a resolved action must not be sent, or nil.
+func (b *Bulk) checkAction(action *document.ESActionDocument, event couchbase.Event) error {
+	if err := updateOptionsError(action); err != nil {
+		return err
+	}
+	if b.isDataStream(action.IndexName, action.ClusterKey) {
+		if err := dataStreamActionError(action); err != nil {
+			return err
+		}
+	}
+	if b.validator != nil {
+		return b.validator.validate(action)
+	}
+	return nil
+}
+
+// rejectActions reports actions rejected by checkAction without sending them.
+func (b *Bulk) rejectActions(rejected []*dcpElasticsearch.SinkResponseHandlerContext) {
+	for _, ctx := range rejected {
+		logger.Log.Warn("action rejected, id: %s, err: %v", ctx.Action.ID, ctx.Err)
+		go b.countError(ctx.Action)
+		if b.sinkResponseHandler != nil {
+			b.sinkResponseHandler.OnError(ctx)
+		}
+	}
+}
+
+// RejectEvent reports an event that could not be turned into actions, such as
+// a value no decoder could read, to the sink response handler's OnError as an
+// index action for the event's document.
+func (b *Bulk) RejectEvent(event couchbase.Event, err error) {
+	action := document.IndexAction(event.Key).Source(event.Value).Build()
+	action.EventTime = event.EventTime
+	if indexName, lookupErr := b.lookupIndexName(event, "", ""); lookupErr == nil {
+		action.IndexName = indexName
+	}
+	b.rejectActions([]*dcpElasticsearch.SinkResponseHandlerContext{{Action: &action, Err: err}})
+}
+
+// resolveAction resolves the cluster key, event time, index name and routing
+// of an action produced by the mapper for event. It returns an error when an
+// index or routing template cannot be rendered for event. The source the
+// mapper built is checked against its schema before @timestamp and
+// replication metadata are added; with the quarantine policy, a violating
+// action is replaced by its quarantine document, which is sent as it is.
+func (b *Bulk) resolveAction(action *document.ESActionDocument, event couchbase.Event) error {
+	clusterKey := config.NormalizeClusterKey(action.ClusterKey)
+	action.ClusterKey = clusterKey
+	action.EventTime = event.EventTime
+
+	if clusterKey != "" {
+		if _, ok := b.esClients[clusterKey]; !ok {
+			err := fmt.Errorf("unknown elasticsearch cluster key %q", clusterKey)
+			logger.Log.Error("error while validating cluster key, err: %v", err)
+			panic(err)
+		}
+	}
+
+	var err error
+	if action.IndexName, err = b.getIndexName(event, action.IndexName, clusterKey); err != nil {
+		return err
+	}
+	if action.Routing == nil {
+		if action.Routing, err = b.getRouting(event, clusterKey); err != nil {
+			return err
+		}
+	}
+	if b.schemaValidator != nil {
+		if quarantined, err := b.checkSchema(action, event); err != nil || quarantined {
+			return err
+		}
+	}
+	if b.isDataStream(action.IndexName, clusterKey) {
+		toDataStreamAction(action, event)
+	}
+	b.addReplicationMetadata(action, event)
+	if action.Pipeline == "" && acceptsPipeline(action) {
+		action.Pipeline = b.getPipeline(action.IndexName, clusterKey)
+	}
+	if isUpdate(action) {
+		esSettings := b.elasticsearchSettingsForCluster(clusterKey)
+		if defaults, ok := indexEntry(esSettings.IndexUpdateOptions, action.IndexName); ok {
+			action.UpdateOptions = action.UpdateOptions.WithDefaults(defaults)
+		}
+	}
+	return nil
+}
+
+// remapFunc returns a function that re-runs the mapper for event, and
+// resolves and checks the resulting actions like AddActions does. An action
+// that cannot be resolved or fails a check fails the remap.
+func (b *Bulk) remapFunc(event couchbase.Event) func() ([]document.ESActionDocument, error) {
+	return func() ([]document.ESActionDocument, error) {
+		actions, err := b.mapper(event)
+		if err != nil {
+			return nil, err
+		}
+		for i := range actions {
+			if err := b.resolveAction(&actions[i], event); err != nil {
+				return nil, fmt.Errorf("resolve remapped action %s: %w", actions[i].ID, err)
+			}
+			if err := b.checkAction(&actions[i], event); err != nil {
+				return nil, fmt.Errorf("check remapped action %s: %w", actions[i].ID, err)
+			}
+		}
+		return actions, nil
+	}
+}
+
 var (
-	indexPrefix       = helper.Byte(`{"index":{"_index":"`)
-	deletePrefix      = helper.Byte(`{"delete":{"_index":"`)
-	updatePrefix      = helper.Byte(`{"update":{"_index":"`)
-	scriptPrefix      = helper.Byte(`{"script":`)
-	idPrefix          = helper.Byte(`","_id":"`)
-	typePrefix        = helper.Byte(`","_type":"`)
-	routingPrefix     = helper.Byte(`","routing":"`)
-	postFix           = helper.Byte(`"}}`)
-	scriptPostfix     = helper.Byte(`,"scripted_upsert":true}`)
-	updateDocTemplate = `{"doc":%s, "doc_as_upsert":true}`
+	indexPrefix           = helper.Byte(`{"index":{"_index":"`)
+	createPrefix          = helper.Byte(`{"create":{"_index":"`)
+	deletePrefix          = helper.Byte(`{"delete":{"_index":"`)
+	updatePrefix          = helper.Byte(`{"update":{"_index":"`)
+	scriptPrefix          = helper.Byte(`{"script":`)
+	idPrefix              = helper.Byte(`","_id":"`)
+	typePrefix            = helper.Byte(`","_type":"`)
+	routingPrefix         = helper.Byte(`","routing":"`)
+	pipelinePrefix        = helper.Byte(`","pipeline":"`)
+	versionPrefix         = helper.Byte(`,"version":`)
+	versionTypePrefix     = helper.Byte(`,"version_type":"`)
+	ifSeqNoPrefix         = helper.Byte(`,"if_seq_no":`)
+	ifPrimaryTermPrefix   = helper.Byte(`,"if_primary_term":`)
+	retryOnConflictPrefix = helper.Byte(`,"retry_on_conflict":`)
+	postFix               = helper.Byte(`}}`)
+	docPrefix             = helper.Byte(`{"doc":`)
+	docAsUpsertPrefix     = helper.Byte(`,"doc_as_upsert":`)
+	scriptedUpsertPrefix  = helper.Byte(`,"scripted_upsert":`)
+	upsertPrefix          = helper.Byte(`,"upsert":`)
+	detectNoopPrefix      = helper.Byte(`,"detect_noop":`)
+	returnSourcePrefix    = helper.Byte(`,"_source":`)
+	scriptSourcePrefix    = helper.Byte(`{"source":`)
+	paramsPrefix          = helper.Byte(`,"params":`)
 )
 
 var metaPool = sync.Pool{
@@ -228,43 +465,62 @@ var metaPool = sync.Pool{
 	},
 }
 
-func getEsActionJSON(docID []byte, action document.EsAction, indexName string, routing *string, source []byte, typeName []byte) []byte {
+func getEsActionJSON(action *document.ESActionDocument, typeName []byte) []byte {
 	meta := metaPool.Get().([]byte)[:0]
 
-	switch action {
+	switch action.Type {
 	case document.Index:
 		meta = append(meta, indexPrefix...)
+	case document.Create:
+		meta = append(meta, createPrefix...)
 	case document.DocUpdate, document.ScriptUpdate:
 		meta = append(meta, updatePrefix...)
 	case document.Delete:
 		meta = append(meta, deletePrefix...)
 	}
 
-	meta = append(meta, helper.Byte(indexName)...)
+	meta = append(meta, helper.Byte(action.IndexName)...)
 	meta = append(meta, idPrefix...)
-	meta = append(meta, helper.EscapePredefinedBytes(docID)...)
-	if routing != nil {
+	meta = append(meta, helper.EscapePredefinedBytes(action.ID)...)
+	if action.Routing != nil {
 		meta = append(meta, routingPrefix...)
-		meta = append(meta, helper.Byte(*routing)...)
+		meta = append(meta, helper.Byte(*action.Routing)...)
 	}
 	if typeName != nil {
 		meta = append(meta, typePrefix...)
 		meta = append(meta, typeName...)
 	}
+	if action.Pipeline != "" && acceptsPipeline(action) {
+		meta = append(meta, pipelinePrefix...)
+		meta = append(meta, helper.Byte(action.Pipeline)...)
+	}
+	meta = append(meta, '"')
+	if hasExternalVersion(action) {
+		meta = append(meta, versionPrefix...)
+		meta = strconv.AppendUint(meta, *action.Version, 10)
+		meta = append(meta, versionTypePrefix...)
+		meta = append(meta, helper.Byte(string(externalVersionType(action)))...)
+		meta = append(meta, '"')
+	}
+	if isConditional(action) {
+		meta = append(meta, ifSeqNoPrefix...)
+		meta = strconv.AppendInt(meta, *action.IfSeqNo, 10)
+		meta = append(meta, ifPrimaryTermPrefix...)
+		meta = strconv.AppendInt(meta, *action.IfPrimaryTerm, 10)
+	}
+	if isUpdate(action) && action.UpdateOptions != nil && action.UpdateOptions.RetryOnConflict != nil {
+		meta = append(meta, retryOnConflictPrefix...)
+		meta = strconv.AppendInt(meta, int64(*action.UpdateOptions.RetryOnConflict), 10)
+	}
 	meta = append(meta, postFix...)
 
-	switch action {
-	case document.Index:
-		meta = append(meta, '\n')
-		meta = append(meta, source...)
-	case document.DocUpdate:
+	switch action.Type {
+	case document.Index, document.Create:
 		meta = append(meta, '\n')
-		meta = append(meta, []byte(fmt.Sprintf(updateDocTemplate, source))...)
-	case document.ScriptUpdate:
+		meta = append(meta, action.Source...)
+	case document.DocUpdate, document.ScriptUpdate:
 		meta = append(meta, '\n')
-		meta = append(meta, scriptPrefix...)
-		meta = append(meta, source...)
-		meta = append(meta, scriptPostfix...)
+		meta = appendUpdateBody(meta, action)
 	case document.Delete:
 		// Delete action doesn't need a body
 	}
@@ -273,6 +529,132 @@ func getEsActionJSON(docID []byte, action document.EsAction, indexName string, r
 	return meta
 }
 
+var defaultUpdateOptions document.UpdateOptions
+
+// appendUpdateBody renders the body of a DocUpdate or ScriptUpdate action.
+// Upserts are on unless the update options turn them off; doc_as_upsert is
+// off by default when an explicit Upsert document is given, since
+// Elasticsearch would ignore it.
+func appendUpdateBody(meta []byte, action *document.ESActionDocument) []byte {
+	opts := action.UpdateOptions
+	if opts == nil {
+		opts = &defaultUpdateOptions
+	}
+
+	if action.Type == document.DocUpdate {
+		meta = append(meta, docPrefix...)
+		meta = append(meta, action.Source...)
+		meta = append(meta, docAsUpsertPrefix...)
+		meta = strconv.AppendBool(meta, opts.DocAsUpsert == nil && opts.Upsert == nil || opts.DocAsUpsert != nil && *opts.DocAsUpsert)
+	} else {
+		meta = append(meta, scriptPrefix...)
+		meta = appendScript(meta, action.Source, opts.ScriptParams)
+		meta = append(meta, scriptedUpsertPrefix...)
+		meta = strconv.AppendBool(meta, opts.ScriptedUpsert == nil || *opts.ScriptedUpsert)
+	}
+
+	if opts.Upsert != nil {
+		meta = append(meta, upsertPrefix...)
+		meta = append(meta, opts.Upsert...)
+	}
+	if opts.DetectNoop != nil {
+		meta = append(meta, detectNoopPrefix...)
+		meta = strconv.AppendBool(meta, *opts.DetectNoop)
+	}
+	if len(opts.SourceIncludes) > 0 || len(opts.SourceExcludes) > 0 {
+		filter, _ := jsoniter.Marshal(sourceFilter{Includes: opts.SourceIncludes, Excludes: opts.SourceExcludes})
+		meta = append(meta, returnSourcePrefix...)
+		meta = append(meta, filter...)
+	}
+	return append(meta, '}')
+}
+
+type sourceFilter struct {
+	Includes []string `json:"includes,omitempty"`
+	Excludes []string `json:"excludes,omitempty"`
+}
+
+// appendScript renders a script, adding params when they are kept apart from
+// the script body. A script given as a bare string is expanded to its object
+// form so params can be attached.
+func appendScript(meta []byte, script []byte, params []byte) []byte {
+	if params == nil {
+		return append(meta, script...)
+	}
+
+	script = bytes.TrimSpace(script)
+	switch {
+	case len(script) < 2 || script[0] != '{':
+		meta = append(meta, scriptSourcePrefix...)
+		meta = append(meta, script...)
+	case len(bytes.TrimSpace(script[1:len(script)-1])) == 0:
+		// empty script object: params are its only field
+		meta = append(meta, '{')
+		meta = append(meta, paramsPrefix[1:]...)
+		meta = append(meta, params...)
+		return append(meta, '}')
+	default:
+		meta = append(meta, script[:len(script)-1]...)
+	}
+	meta = append(meta, paramsPrefix...)
+	meta = append(meta, params...)
+	return append(meta, '}')
+}
+
+func isUpdate(action *document.ESActionDocument) bool {
+	return action.Type == document.DocUpdate || action.Type == document.ScriptUpdate
+}
+
+// hasExternalVersion reports whether the action is sent with an external
+// version. Elasticsearch only accepts external versioning on index and delete
+// operations, so the version of any other action type is ignored.
+func hasExternalVersion(action *document.ESActionDocument) bool {
+	if action.Version == nil {
+		return false
+	}
+	return action.Type == document.Index || action.Type == document.Delete
+}
+
+// acceptsPipeline reports whether the action type can run through an ingest
+// pipeline. Elasticsearch only applies pipelines to index and create
+// operations.
+func acceptsPipeline(action *document.ESActionDocument) bool {
+	return action.Type == document.Index || action.Type == document.Create
+}
+
+// isConditional reports whether the action is sent with if_seq_no and
+// if_primary_term. Create actions never overwrite, so they are never
+// conditional.
+// updateOptionsError returns a dcpElasticsearch.ErrUpdateOptions error for an
+// update action whose options Elasticsearch would reject or ignore, or nil.
+func updateOptionsError(action *document.ESActionDocument) error {
+	opts := action.UpdateOptions
+	if !isUpdate(action) || opts == nil {
+		return nil
+	}
+	if action.Type == document.DocUpdate && opts.Upsert != nil && opts.DocAsUpsert != nil && *opts.DocAsUpsert {
+		return fmt.Errorf("%w: an upsert document is ignored with doc_as_upsert", dcpElasticsearch.ErrUpdateOptions)
+	}
+	if opts.RetryOnConflict != nil && isConditional(action) {
+		return fmt.Errorf("%w: retry_on_conflict cannot be used with if_seq_no and if_primary_term", dcpElasticsearch.ErrUpdateOptions)
+	}
+	return nil
+}
+
+func isConditional(action *document.ESActionDocument) bool {
+	if action.IfSeqNo == nil || action.IfPrimaryTerm == nil {
+		return false
+	}
+	return action.Type != document.Create && !isByQuery(action)
+}
+
+func externalVersionType(action *document.ESActionDocument) document.VersionType {
+	if action.VersionType == "" {
+		return document.VersionTypeExternal
+	}
+	return action.VersionType
+}
+
 func (b *Bulk) Close() {
 	b.batchTicker.Stop()
 	if b.batchCommitTicker != nil {
@@ -306,8 +688,10 @@ func (b *Bulk) flushMessages() {
 		}
 		b.batchTicker.Reset(b.batchTickerDuration)
 		for _, batch := range b.batch {
-			//nolint:staticcheck
-			metaPool.Put(batch.Bytes)
+			if batch.Bytes != nil {
+				//nolint:staticcheck
+				metaPool.Put(batch.Bytes)
+			}
 		}
 		b.batch = b.batch[:0]
 		b.batchKeys = make(map[string]int, b.batchSizeLimit)
@@ -355,12 +739,12 @@ func (b *Bulk) requestFunc(
 					}
 				}
 
-				b.finalizeProcess(actionsOfBatchItems, fillErrorDataWithBulkRequestError(actionsOfBatchItems, err))
+				b.finalizeProcess(actionsOfBatchItems, fillErrorDataWithBulkRequestError(actionsOfBatchItems, err), nil)
 				return err
 			}
 
-			errorData, err := hasResponseError(r, actionsOfBatchItems)
-			b.finalizeProcess(actionsOfBatchItems, errorData)
+			errorData, noops, err := b.hasResponseError(r, actionsOfBatchItems)
+			b.finalizeProcess(actionsOfBatchItems, errorData, noops)
 			if err != nil {
 				return err
 			}
@@ -393,12 +777,11 @@ func (b *Bulk) requestFuncWithRetry(
 	retry *config.Retry,
 ) func() error {
 	return func() error {
-		allActions := getActions(batchItems)
-		allBytes := getBytes(batchItems)
+		items := getItems(batchItems)
 
-		finalErrorData := b.retryBulk(allActions, allBytes, esClient, retry)
+		finalErrorData, noops := b.retryBulk(items, esClient, retry)
 
-		b.finalizeProcess(allActions, finalErrorData)
+		b.finalizeProcess(getActions(items), finalErrorData, noops)
 
 		if len(finalErrorData) > 0 {
 			var sb strings.Builder
@@ -414,13 +797,15 @@ func (b *Bulk) requestFuncWithRetry(
 
 // retryBulk re-submits the retryable items of a bulk request with exponential
 // backoff until nothing retryable remains or maxRetries is exhausted, and
-// returns the terminal per-item errors keyed by action key.
+// returns the terminal per-item errors and the stale (no-op) items, both keyed
+// by action key. Conditional items that lost a version conflict are rebuilt
+// in place from a fresh mapper run, up to retry.ConflictRetries times each, so
+// items holds the final action of each entry on return.
 func (b *Bulk) retryBulk(
-	allActions []*document.ESActionDocument,
-	allBytes [][]byte,
+	items []*dcpElasticsearch.BatchItem,
 	esClient *elasticsearch.Client,
 	retry *config.Retry,
-) map[string]string {
+) (map[string]string, map[string]struct{}) {
 	// Use a dedicated reader instead of the shared b.readers[i] slot: the
 	// per-cluster fan-out in bulkRequest runs partitions concurrently and
 	// each enumerates chunk indexes from 0, so sharing a slot across
@@ -428,47 +813,55 @@ func (b *Bulk) retryBulk(
 	reader := helper.NewMultiDimByteReader(nil)
 
 	finalErrorData := make(map[string]string)
+	noops := make(map[string]struct{})
 
-	// pending holds indexes into allActions/allBytes still to be tried.
-	pending := make([]int, len(allActions))
+	// pending holds indexes into items still to be tried, and remaps counts
+	// the version conflicts each of them was remapped after.
+	pending := make([]int, len(items))
 	for i := range pending {
 		pending[i] = i
 	}
+	remaps := make([]int, len(items))
 
 	for attempt := 0; len(pending) > 0; attempt++ {
-		pending = b.attemptBulk(attempt, pending, allActions, allBytes, esClient, retry, reader, finalErrorData)
+		var conflicts []int
+		pending, conflicts = b.attemptBulk(attempt, pending, items, esClient, retry, reader, remaps, finalErrorData, noops)
+		pending = append(pending, b.remapConflicts(conflicts, items, remaps, finalErrorData, noops)...)
 		if len(pending) > 0 {
 			time.Sleep(backoffDuration(attempt+1, retry.InitialInterval, retry.MaxInterval))
 		}
 	}
 
-	return finalErrorData
+	return finalErrorData, noops
 }
 
 // attemptBulk submits the pending items once and classifies the outcome. It
 // returns the indexes that should be retried on the next attempt: the same
 // pending set for a retryable transport/whole-response failure, the subset of
-// retryable per-item failures, or nil when nothing remains. Terminal failures
-// are written to finalErrorData before returning.
+// retryable per-item failures, or nil when nothing remains. Conditional items
+// that lost a version conflict and may be remapped are returned separately.
+// Terminal failures are written to finalErrorData and stale version conflicts
+// to noops before returning.
 func (b *Bulk) attemptBulk(
 	attempt int,
 	pending []int,
-	allActions []*document.ESActionDocument,
-	allBytes [][]byte,
+	items []*dcpElasticsearch.BatchItem,
 	esClient *elasticsearch.Client,
 	retry *config.Retry,
 	reader *helper.MultiDimByteReader,
+	remaps []int,
 	finalErrorData map[string]string,
-) []int {
+	noops map[string]struct{},
+) ([]int, []int) {
 	reqBytes := make([][]byte, 0, len(pending))
 	for _, idx := range pending {
-		reqBytes = append(reqBytes, allBytes[idx])
+		reqBytes = append(reqBytes, items[idx].Bytes)
 	}
 	reader.Reset(reqBytes)
 
 	markErrors := func(msg string) {
 		for _, idx := range pending {
-			finalErrorData[getActionKey(*allActions[idx])] = msg
+			finalErrorData[getActionKey(*items[idx].Action)] = msg
 		}
 	}
 
@@ -479,10 +872,10 @@ func (b *Bulk) attemptBulk(
 				"retrying bulk request after transport error (attempt %d/%d, %d items): %v",
 				attempt+1, retry.MaxRetries, len(pending), err,
 			)
-			return pending
+			return pending, nil
 		}
 		markErrors(err.Error())
-		return nil
+		return nil, nil
 	}
 
 	if r.IsError() {
@@ -494,35 +887,40 @@ func (b *Bulk) attemptBulk(
 				"retrying bulk request after retryable status %d (attempt %d/%d, %d items)",
 				status, attempt+1, retry.MaxRetries, len(pending),
 			)
-			return pending
+			return pending, nil
 		}
 		markErrors(msg)
-		return nil
+		return nil, nil
 	}
 
 	itemErrors, parseErr := parseBulkItemErrors(r)
 	if parseErr != nil {
 		markErrors(parseErr.Error())
-		return nil
+		return nil, nil
 	}
 	if len(itemErrors) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	return b.classifyItemErrors(attempt, pending, allActions, retry, itemErrors, finalErrorData)
+	return b.classifyItemErrors(attempt, pending, items, retry, itemErrors, remaps, finalErrorData, noops)
 }
 
-// classifyItemErrors splits per-item bulk failures into the retryable set
-// (returned as global indexes) and terminal ones (written to finalErrorData).
+// classifyItemErrors splits per-item bulk failures into the retryable set and
+// the remappable conflicts (both returned as global indexes), stale version
+// conflicts (written to noops) and terminal ones (written to finalErrorData).
+// A conflicted item is remappable while it has been remapped fewer than
+// retry.ConflictRetries times, whatever the attempt.
 func (b *Bulk) classifyItemErrors(
 	attempt int,
 	pending []int,
-	allActions []*document.ESActionDocument,
+	items []*dcpElasticsearch.BatchItem,
 	retry *config.Retry,
 	itemErrors []bulkItemError,
+	remaps []int,
 	finalErrorData map[string]string,
-) []int {
-	var nextPending []int
+	noops map[string]struct{},
+) ([]int, []int) {
+	var nextPending, conflicts []int
 	for _, ie := range itemErrors {
 		// Defend against a malformed response reporting more items (or an
 		// out-of-range position) than we submitted: pending[ie.position] would
@@ -531,10 +929,16 @@ func (b *Bulk) classifyItemErrors(
 			continue
 		}
 		globalIdx := pending[ie.position]
-		if attempt < retry.MaxRetries && isRetryableStatus(ie.status, retry.RetryOnStatus) {
+		action := items[globalIdx].Action
+		switch {
+		case b.isNoopItemError(action, ie.status):
+			noops[getActionKey(*action)] = struct{}{}
+		case remaps[globalIdx] < retry.ConflictRetries && isRemappableConflict(items[globalIdx], ie.status):
+			conflicts = append(conflicts, globalIdx)
+		case attempt < retry.MaxRetries && isRetryableStatus(ie.status, retry.RetryOnStatus):
 			nextPending = append(nextPending, globalIdx)
-		} else {
-			finalErrorData[getActionKey(*allActions[globalIdx])] = ie.msg
+		default:
+			finalErrorData[getActionKey(*action)] = itemErrorMessage(action, ie.status, ie.msg)
 		}
 	}
 
@@ -544,7 +948,78 @@ func (b *Bulk) classifyItemErrors(
 			len(nextPending), attempt+1, retry.MaxRetries,
 		)
 	}
-	return nextPending
+	return nextPending, conflicts
+}
+
+// isRemappableConflict reports whether a failed item is a conditional write
+// that lost a version conflict and can be rebuilt by re-running the mapper.
+func isRemappableConflict(item *dcpElasticsearch.BatchItem, status int) bool {
+	return status == http.StatusConflict && item.Remap != nil && isConditional(item.Action)
+}
+
+// remapConflicts re-runs the mapper for each conflicted item so it can read the
+// current document again, and replaces the item with the action of the same
+// key from the new result. It counts the remap in remaps and returns the
+// indexes to submit on the next attempt. The mapper runs in the flush
+// goroutine, with the flush lock held. When the mapper no longer emits that action the write is no longer
+// needed and the item is recorded as a no-op. When the mapper fails the
+// conflict is recorded as a terminal error in finalErrorData.
+func (b *Bulk) remapConflicts(
+	conflicts []int,
+	items []*dcpElasticsearch.BatchItem,
+	remaps []int,
+	finalErrorData map[string]string,
+	noops map[string]struct{},
+) []int {
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	logger.Log.Warn("remapping %d conditional bulk item(s) after version conflict", len(conflicts))
+
+	var remapped []int
+	for _, idx := range conflicts {
+		item := items[idx]
+		key := getActionKey(*item.Action)
+		remaps[idx]++
+
+		var next *dcpElasticsearch.BatchItem
+		actions, err := remap(item)
+		if err != nil {
+			finalErrorData[key] = fmt.Sprintf("remapping after version conflict failed: %v", err)
+			continue
+		}
+		for i := range actions {
+			if getActionKey(actions[i]) == key {
+				next = &dcpElasticsearch.BatchItem{
+					Action: &actions[i],
+					Bytes:  getEsActionJSON(&actions[i], b.typeName),
+					Remap:  item.Remap,
+				}
+				break
+			}
+		}
+
+		if next == nil {
+			noops[key] = struct{}{}
+			continue
+		}
+		items[idx] = next
+		remapped = append(remapped, idx)
+	}
+	return remapped
+}
+
+// remap runs the item's Remap, turning a panic of the mapper or of action
+// resolution (e.g. an unknown cluster key) into an error so it fails the item
+// instead of the request goroutine.
+func remap(item *dcpElasticsearch.BatchItem) (actions []document.ESActionDocument, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return item.Remap()
 }
 
 // parseBulkItemErrors extracts the failed items (with per-item HTTP status)
@@ -588,13 +1063,9 @@ func parseBulkItemErrors(r *esapi.Response) ([]bulkItemError, error) {
 				continue
 			}
 			if iv["error"] != nil {
-				status := 0
-				if s, ok := iv["status"].(float64); ok {
-					status = int(s)
-				}
 				result = append(result, bulkItemError{
 					position: idx,
-					status:   status,
+					status:   itemStatus(iv),
 					msg:      fmt.Sprintf("%v\n", i),
 				})
 			}
@@ -603,9 +1074,35 @@ func parseBulkItemErrors(r *esapi.Response) ([]bulkItemError, error) {
 	return result, nil
 }
 
+// bulkRequest sends the batch. By-query actions split it into segments that
+// are sent in order: the bulk actions before a by-query action complete before
+// it runs, and the ones after it are sent once it has completed.
 func (b *Bulk) bulkRequest() error {
+	startedTime := time.Now()
+
+	var errs []error
+	start := 0
+	for i, item := range b.batch {
+		if item.Action == nil || !isByQuery(item.Action) {
+			continue
+		}
+		errs = append(errs, b.bulkRequestSegment(b.batch[start:i]))
+		if !item.IsSkipped {
+			errs = append(errs, b.byQueryRequest(item.Action))
+		}
+		start = i + 1
+	}
+	errs = append(errs, b.bulkRequestSegment(b.batch[start:]))
+
+	b.metric.BulkRequestProcessLatencyMs = time.Since(startedTime).Milliseconds()
+
+	return errors.Join(errs...)
+}
+
+// bulkRequestSegment sends bulk actions to their clusters concurrently.
+func (b *Bulk) bulkRequestSegment(segment []*dcpElasticsearch.BatchItem) error {
 	byCluster := make(map[string][]*dcpElasticsearch.BatchItem)
-	for _, item := range b.batch {
+	for _, item := range segment {
 		if item.Action == nil {
 			continue
 		}
@@ -620,7 +1117,6 @@ func (b *Bulk) bulkRequest() error {
 	sort.Strings(clusterKeys)
 
 	eg, _ := errgroup.WithContext(context.Background())
-	startedTime := time.Now()
 
 	for _, ck := range clusterKeys {
 		ck := ck
@@ -633,11 +1129,7 @@ func (b *Bulk) bulkRequest() error {
 		})
 	}
 
-	err := eg.Wait()
-
-	b.metric.BulkRequestProcessLatencyMs = time.Since(startedTime).Milliseconds()
-
-	return err
+	return eg.Wait()
 }
 
 func (b *Bulk) bulkRequestPartition(
@@ -670,40 +1162,50 @@ func (b *Bulk) GetMetric() *Metric {
 	return b.metric
 }
 
-func hasResponseError(r *esapi.Response, batchActions []*document.ESActionDocument) (map[string]string, error) {
+// hasResponseError returns the failed items of a bulk response and the stale
+// (no-op) items, both keyed by action key. The error is non-nil only when at
+// least one item really failed.
+func (b *Bulk) hasResponseError(
+	r *esapi.Response,
+	batchActions []*document.ESActionDocument,
+) (map[string]string, map[string]struct{}, error) {
 	if r == nil {
-		return nil, fmt.Errorf("esapi response is nil")
+		return nil, nil, fmt.Errorf("esapi response is nil")
 	}
 	if r.IsError() {
-		return nil, fmt.Errorf("bulk request has error %v", r.String())
+		return nil, nil, fmt.Errorf("bulk request has error %v", r.String())
 	}
 	rb := new(bytes.Buffer)
 
 	defer r.Body.Close()
 	_, err := rb.ReadFrom(r.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	body := make(map[string]any)
 	err = jsoniter.Unmarshal(rb.Bytes(), &body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	hasError, ok := body["errors"].(bool)
 	if !ok || !hasError {
-		return nil, nil
+		return nil, nil, nil
 	}
-	return joinErrors(body, batchActions)
+	return b.joinErrors(body, batchActions)
 }
 
-func joinErrors(body map[string]any, batchActions []*document.ESActionDocument) (map[string]string, error) {
+func (b *Bulk) joinErrors(
+	body map[string]any,
+	batchActions []*document.ESActionDocument,
+) (map[string]string, map[string]struct{}, error) {
 	var sb strings.Builder
 	ivd := make(map[string]string)
+	noops := make(map[string]struct{})
 	sb.WriteString("bulk request has error. Errors will be listed below:\n")
 
 	items, ok := body["items"].([]any)
 	if !ok {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	for idx, i := range items {
@@ -719,14 +1221,80 @@ func joinErrors(body map[string]any, batchActions []*document.ESActionDocument)
 			}
 
 			if iv["error"] != nil {
+				actionKey := bulkErrorItemKey(batchActions, idx, iv)
+				if idx < len(batchActions) && b.isNoopItemError(batchActions[idx], itemStatus(iv)) {
+					noops[actionKey] = struct{}{}
+					continue
+				}
 				itemValue := fmt.Sprintf("%v\n", i)
 				sb.WriteString(itemValue)
-				actionKey := bulkErrorItemKey(batchActions, idx, iv)
+				if idx < len(batchActions) {
+					itemValue = itemErrorMessage(batchActions[idx], itemStatus(iv), itemValue)
+				}
 				ivd[actionKey] = itemValue
 			}
 		}
 	}
-	return ivd, fmt.Errorf("%s", sb.String())
+	if len(ivd) == 0 {
+		return nil, noops, nil
+	}
+	return ivd, noops, fmt.Errorf("%s", sb.String())
+}
+
+// itemStatus returns the per-item HTTP status of a bulk response item, or 0
+// when it is missing.
+func itemStatus(iv map[string]any) int {
+	if s, ok := iv["status"].(float64); ok {
+		return int(s)
+	}
+	return 0
+}
+
+// documentAlreadyExistsPrefix marks the error message of a Create action that
+// was rejected because the document already exists. finalizeProcess turns it
+// back into an error wrapping dcpElasticsearch.ErrDocumentAlreadyExists.
+var documentAlreadyExistsPrefix = dcpElasticsearch.ErrDocumentAlreadyExists.Error() + ": "
+
+// isNoopItemError reports whether a failed item is a write that needs no
+// retry or error report: a stale version conflict, an update of a missing
+// document with IgnoreMissing set, or a data stream event written before.
+func (b *Bulk) isNoopItemError(action *document.ESActionDocument, status int) bool {
+	return isStaleVersionConflict(action, status) || isIgnoredMissingDocument(action, status) ||
+		b.isDuplicateDataStreamEvent(action, status)
+}
+
+// isIgnoredMissingDocument reports whether a failed item is a 404 on an update
+// whose update options ignore missing documents.
+func isIgnoredMissingDocument(action *document.ESActionDocument, status int) bool {
+	if action == nil || status != http.StatusNotFound || !isUpdate(action) || action.UpdateOptions == nil {
+		return false
+	}
+	return action.UpdateOptions.IgnoreMissing != nil && *action.UpdateOptions.IgnoreMissing
+}
+
+// isStaleVersionConflict reports whether a failed item is a 409 on an
+// externally versioned write, meaning Elasticsearch already holds the same or a
+// newer version of the document. Such writes are safe to drop.
+func isStaleVersionConflict(action *document.ESActionDocument, status int) bool {
+	return action != nil && status == http.StatusConflict && hasExternalVersion(action)
+}
+
+// itemErrorMessage returns the message recorded for a failed bulk item,
+// tagging create conflicts so they can be told apart from real failures.
+func itemErrorMessage(action *document.ESActionDocument, status int, msg string) string {
+	if action != nil && action.Type == document.Create && status == http.StatusConflict {
+		return documentAlreadyExistsPrefix + msg
+	}
+	return msg
+}
+
+// itemError converts a recorded error message into the error passed to
+// SinkResponseHandler.OnError.
+func itemError(msg string) error {
+	if strings.HasPrefix(msg, documentAlreadyExistsPrefix) {
+		return fmt.Errorf("%w: %s", dcpElasticsearch.ErrDocumentAlreadyExists, strings.TrimPrefix(msg, documentAlreadyExistsPrefix))
+	}
+	return fmt.Errorf("%s", msg)
 }
 
 func bulkErrorItemKey(batchActions []*document.ESActionDocument, itemIdx int, iv map[string]any) string {
@@ -752,24 +1320,95 @@ func (b *Bulk) collectionMappingForCluster(clusterKey string) map[string]string
 	return b.config.Elasticsearch.Clusters[clusterKey].CollectionIndexMapping
 }
 
-func (b *Bulk) getIndexName(collectionName, actionIndexName, clusterKey string) string {
+// lookupIndexName returns the index of an action: its own IndexName or the
+// index mapped to its collection, rendered for event when it is a template. It
+// returns an empty string when neither is set.
+func (b *Bulk) lookupIndexName(event couchbase.Event, actionIndexName, clusterKey string) (string, error) {
 	if actionIndexName != "" {
-		return actionIndexName
+		return actionIndexName, nil
+	}
+	mapping, err := b.indexMappings.get(clusterKey, b.collectionMappingForCluster(clusterKey))
+	if err != nil {
+		return "", err
+	}
+	text, ok := mapping.lookup(event)
+	if !ok {
+		return "", nil
+	}
+	indexName, err := b.templates.render(text, event)
+	if err != nil {
+		return "", fmt.Errorf("index name of collection %s: %w", event.CollectionName, err)
+	}
+	return indexName, nil
+}
+
+// collectionEntry returns the entry of a collection mapping for the event's
+// collection, preferring a scope.collection key over a collection key.
+func collectionEntry[V any](mapping map[string]V, event couchbase.Event) (V, bool) {
+	if event.ScopeName != "" {
+		if entry, ok := mapping[event.QualifiedCollectionName()]; ok {
+			return entry, true
+		}
 	}
+	entry, ok := mapping[event.CollectionName]
+	return entry, ok
+}
 
-	mapping := b.collectionMappingForCluster(clusterKey)
-	indexName := mapping[collectionName]
+// getIndexName is lookupIndexName applying elasticsearch.unmappedCollectionPolicy
+// when the collection has no index mapping: it returns errUnmappedCollection
+// (skip), the default index (defaultIndex) or panics. With the indexName
+// validation check enabled, a missing mapping is reported by the check
+// instead of panicking.
+func (b *Bulk) getIndexName(event couchbase.Event, actionIndexName, clusterKey string) (string, error) {
+	indexName, err := b.lookupIndexName(event, actionIndexName, clusterKey)
+	if err != nil {
+		return "", err
+	}
 	if indexName == "" {
+		switch b.config.Elasticsearch.UnmappedCollectionPolicy {
+		case config.UnmappedCollectionPolicySkip:
+			return "", errUnmappedCollection
+		case config.UnmappedCollectionPolicyDefaultIndex:
+			return b.config.Elasticsearch.DefaultIndex, nil
+		}
+		if b.validator != nil && b.validator.indexName {
+			return "", nil
+		}
 		err := fmt.Errorf(
 			"there is no index mapping for collection: %s on your elasticsearch cluster configuration (clusterKey=%q)",
-			collectionName,
+			event.CollectionName,
 			clusterKey,
 		)
 		logger.Log.Error("error while get index name, err: %v", err)
 		panic(err)
 	}
 
-	return indexName
+	return indexName, nil
+}
+
+// getRouting returns the routing mapped to the event's collection in
+// collectionRoutingMapping, rendered for event, or nil when there is none.
+func (b *Bulk) getRouting(event couchbase.Event, clusterKey string) (*string, error) {
+	text, ok := collectionEntry(b.elasticsearchSettingsForCluster(clusterKey).CollectionRoutingMapping, event)
+	if !ok {
+		return nil, nil
+	}
+	routing, err := b.templates.render(text, event)
+	if err != nil {
+		return nil, fmt.Errorf("routing of collection %s: %w", event.CollectionName, err)
+	}
+	return &routing, nil
+}
+
+// getPipeline returns the default ingest pipeline of an index on a cluster:
+// the per-index mapping (a name or pattern, see indexEntry) first, then the
+// cluster-wide default.
+func (b *Bulk) getPipeline(indexName, clusterKey string) string {
+	esSettings := b.elasticsearchSettingsForCluster(clusterKey)
+	if pipeline, ok := indexEntry(esSettings.IndexPipelineMapping, indexName); ok {
+		return pipeline
+	}
+	return esSettings.Pipeline
 }
 
 func fillErrorDataWithBulkRequestError(batchActions []*document.ESActionDocument, err error) map[string]string {
@@ -789,7 +1428,11 @@ func (b *Bulk) UnlockMetrics() {
 	b.metricCounterMutex.Unlock()
 }
 
-func (b *Bulk) finalizeProcess(batchActions []*document.ESActionDocument, errorData map[string]string) {
+func (b *Bulk) finalizeProcess(
+	batchActions []*document.ESActionDocument,
+	errorData map[string]string,
+	noops map[string]struct{},
+) {
 	for _, action := range batchActions {
 		key := getActionKey(*action)
 		if _, ok := errorData[key]; ok {
@@ -797,28 +1440,74 @@ func (b *Bulk) finalizeProcess(batchActions []*document.ESActionDocument, errorD
 			if b.sinkResponseHandler != nil {
 				b.sinkResponseHandler.OnError(&dcpElasticsearch.SinkResponseHandlerContext{
 					Action: action,
-					Err:    fmt.Errorf("%s", errorData[key]),
+					Err:    itemError(errorData[key]),
 				})
 			}
 		} else {
 			go b.countSuccess(action)
+			b.recentWrites.record(action)
 			if b.sinkResponseHandler != nil {
+				_, isNoop := noops[key]
 				b.sinkResponseHandler.OnSuccess(&dcpElasticsearch.SinkResponseHandlerContext{
 					Action: action,
+					IsNoop: isNoop,
 				})
 			}
 		}
 	}
 }
 
+// CountMappingError counts an event of collectionName whose mapper returned an
+// error.
+func (b *Bulk) CountMappingError(collectionName string) {
+	b.LockMetrics()
+	defer b.UnlockMetrics()
+
+	b.metric.MappingErrorCounter[collectionName]++
+}
+
+func (b *Bulk) countUnmappedCollectionSkip(collectionName string, count int) {
+	b.LockMetrics()
+	defer b.UnlockMetrics()
+
+	b.metric.UnmappedCollectionSkipCounter[collectionName] += int64(count)
+}
+
+func (b *Bulk) countSchemaViolation(indexName string) {
+	b.LockMetrics()
+	defer b.UnlockMetrics()
+
+	b.metric.SchemaViolationCounter[indexName]++
+}
+
+// CountFilteredEvent counts an event of collectionName that did not match the
+// collection's elasticsearch.filter expression.
+func (b *Bulk) CountFilteredEvent(collectionName string) {
+	b.LockMetrics()
+	defer b.UnlockMetrics()
+
+	b.metric.FilteredEventCounter[collectionName]++
+}
+
+// CountFilterError counts an event of collectionName whose
+// elasticsearch.filter expression failed.
+func (b *Bulk) CountFilterError(collectionName string) {
+	b.LockMetrics()
+	defer b.UnlockMetrics()
+
+	b.metric.FilterErrorCounter[collectionName]++
+}
+
 func (b *Bulk) countError(action *document.ESActionDocument) {
 	b.LockMetrics()
 	defer b.UnlockMetrics()
 
 	switch action.Type {
-	case document.Index, document.DocUpdate, document.ScriptUpdate:
+	case document.Index, document.DocUpdate, document.ScriptUpdate, document.UpdateByQuery:
 		b.metric.IndexingErrorActionCounter[action.IndexName]++
-	case document.Delete:
+	case document.Create:
+		b.metric.CreationErrorActionCounter[action.IndexName]++
+	case document.Delete, document.DeleteByQuery:
 		b.metric.DeletionErrorActionCounter[action.IndexName]++
 	}
 }
@@ -828,9 +1517,11 @@ func (b *Bulk) countSuccess(action *document.ESActionDocument) {
 	defer b.UnlockMetrics()
 
 	switch action.Type {
-	case document.Index, document.DocUpdate, document.ScriptUpdate:
+	case document.Index, document.DocUpdate, document.ScriptUpdate, document.UpdateByQuery:
 		b.metric.IndexingSuccessActionCounter[action.IndexName]++
-	case document.Delete:
+	case document.Create:
+		b.metric.CreationSuccessActionCounter[action.IndexName]++
+	case document.Delete, document.DeleteByQuery:
 		b.metric.DeletionSuccessActionCounter[action.IndexName]++
 	}
 }
@@ -861,6 +1552,18 @@ func getBytes(batchItems []*dcpElasticsearch.BatchItem) [][]byte {
 	return batchBytes
 }
 
+func getItems(batchItems []*dcpElasticsearch.BatchItem) []*dcpElasticsearch.BatchItem {
+	result := make([]*dcpElasticsearch.BatchItem, 0, len(batchItems))
+	for _, batchItem := range batchItems {
+		if batchItem.IsSkipped {
+			continue
+		}
+
+		result = append(result, batchItem)
+	}
+	return result
+}
+
 func getActions(batchItems []*dcpElasticsearch.BatchItem) []*document.ESActionDocument {
 	result := make([]*document.ESActionDocument, 0, len(batchItems))
 	for _, batchItem := range batchItems {
@@ -1,6 +1,7 @@
 package bulk
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/client"
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
@@ -71,16 +73,12 @@ func indexItem(id string) *elasticsearch.BatchItem {
 
 func buildBulk(esClient *esv7.Client, handler *recordingHandler) *Bulk {
 	return &Bulk{
-		readers:           []*helper.MultiDimByteReader{helper.NewMultiDimByteReader(nil)},
-		concurrentRequest: 1,
-		esClients:         map[string]*esv7.Client{"": esClient},
-		metric: &Metric{
-			IndexingSuccessActionCounter: map[string]int64{},
-			IndexingErrorActionCounter:   map[string]int64{},
-			DeletionSuccessActionCounter: map[string]int64{},
-			DeletionErrorActionCounter:   map[string]int64{},
-		},
+		readers:             []*helper.MultiDimByteReader{helper.NewMultiDimByteReader(nil)},
+		concurrentRequest:   1,
+		esClients:           map[string]*esv7.Client{"": esClient},
+		metric:              newMetric(),
 		sinkResponseHandler: handler,
+		config:              &config.Config{},
 	}
 }
 
@@ -430,6 +428,374 @@ func Test_parseBulkItemErrors_ErrorCases(t *testing.T) {
 	}
 }
 
+// errRecordingHandler keeps the error passed to OnError so tests can inspect
+// how a failure was classified.
+type errRecordingHandler struct {
+	recordingHandler
+	errs []error
+}
+
+func (h *errRecordingHandler) OnError(ctx *elasticsearch.SinkResponseHandlerContext) {
+	h.recordingHandler.OnError(ctx)
+	h.mu.Lock()
+	h.errs = append(h.errs, ctx.Err)
+	h.mu.Unlock()
+}
+
+func createItem(id string) *elasticsearch.BatchItem {
+	return &elasticsearch.BatchItem{
+		Action: &document.ESActionDocument{ID: []byte(id), IndexName: "idx", Type: document.Create},
+		Bytes:  []byte(`{"create":{"_index":"idx","_id":"` + id + `"}}` + "\n" + `{"v":1}` + "\n"),
+	}
+}
+
+// A 409 on a create action must reach OnError wrapping ErrDocumentAlreadyExists
+// on both the retry and the legacy path, while a 409 on index stays a plain error.
+func Test_createConflictIsMarked(t *testing.T) {
+	conflict := func(_ int) (*http.Response, error) {
+		return jsonResp(200, `{"errors":true,"items":[`+
+			`{"create":{"_index":"idx","_id":"1","status":409,"error":{"type":"version_conflict_engine_exception"}}},`+
+			`{"index":{"_index":"idx","_id":"2","status":409,"error":{"type":"version_conflict_engine_exception"}}}]}`), nil
+	}
+	items := func() []*elasticsearch.BatchItem { return []*elasticsearch.BatchItem{createItem("1"), indexItem("2")} }
+
+	for name, settings := range map[string]config.Elasticsearch{
+		"retry":  {Retry: fastRetry()},
+		"legacy": {MaxRetries: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			handler := &errRecordingHandler{}
+			b := buildBulk(esClientWithTransport(t, &stubTransport{responder: conflict}), nil)
+			b.sinkResponseHandler = handler
+
+			if err := b.bulkRequestPartition(items(), b.esClients[""], settings); err == nil {
+				t.Fatal("conflicts must still surface as a bulk error")
+			}
+			if len(handler.errs) != 2 {
+				t.Fatalf("expected 2 errored items, got %v", handler.errored)
+			}
+			for i, id := range handler.errored {
+				isConflict := errors.Is(handler.errs[i], elasticsearch.ErrDocumentAlreadyExists)
+				if isConflict != (id == "1") {
+					t.Fatalf("item %s: errors.Is(ErrDocumentAlreadyExists) = %v", id, isConflict)
+				}
+			}
+		})
+	}
+}
+
+// A 409 on an externally versioned write means Elasticsearch already holds a
+// newer document: it must be reported as a no-op success, not as an error.
+func Test_staleVersionConflictIsNoop(t *testing.T) {
+	stale := func(_ int) (*http.Response, error) {
+		return jsonResp(200, `{"errors":true,"items":[`+
+			`{"index":{"_index":"idx","_id":"1","status":409,"error":{"type":"version_conflict_engine_exception"}}},`+
+			`{"index":{"_index":"idx","_id":"2","status":201}}]}`), nil
+	}
+	items := func() []*elasticsearch.BatchItem {
+		version := uint64(5)
+		versioned := indexItem("1")
+		versioned.Action.Version = &version
+		return []*elasticsearch.BatchItem{versioned, indexItem("2")}
+	}
+
+	for name, settings := range map[string]config.Elasticsearch{
+		"retry":  {Retry: fastRetry()},
+		"legacy": {MaxRetries: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			handler := &noopRecordingHandler{}
+			b := buildBulk(esClientWithTransport(t, &stubTransport{responder: stale}), nil)
+			b.sinkResponseHandler = handler
+
+			if err := b.bulkRequestPartition(items(), b.esClients[""], settings); err != nil {
+				t.Fatalf("stale conflict must not surface as error, got %v", err)
+			}
+			if len(handler.errored) != 0 || len(handler.success) != 2 {
+				t.Fatalf("expected 0 errored / 2 success, got %v / %v", handler.errored, handler.success)
+			}
+			if len(handler.noops) != 1 || handler.noops[0] != "1" {
+				t.Fatalf("only item 1 must be a no-op, got %v", handler.noops)
+			}
+		})
+	}
+}
+
+// An update of a missing document with IgnoreMissing set is a no-op, while
+// the same 404 without it stays an error.
+func Test_ignoredMissingDocumentIsNoop(t *testing.T) {
+	missing := func(_ int) (*http.Response, error) {
+		return jsonResp(200, `{"errors":true,"items":[`+
+			`{"update":{"_index":"idx","_id":"1","status":404,"error":{"type":"document_missing_exception"}}},`+
+			`{"update":{"_index":"idx","_id":"2","status":404,"error":{"type":"document_missing_exception"}}}]}`), nil
+	}
+	items := func() []*elasticsearch.BatchItem {
+		ignored := document.DocUpdateAction([]byte("1")).Index("idx").Source([]byte(`{"deleted":true}`)).
+			DocAsUpsert(false).IgnoreMissing(true).Build()
+		failed := document.DocUpdateAction([]byte("2")).Index("idx").Source([]byte(`{"deleted":true}`)).
+			DocAsUpsert(false).Build()
+		return []*elasticsearch.BatchItem{
+			{Action: &ignored, Bytes: getEsActionJSON(&ignored, nil)},
+			{Action: &failed, Bytes: getEsActionJSON(&failed, nil)},
+		}
+	}
+
+	for name, settings := range map[string]config.Elasticsearch{
+		"retry":  {Retry: fastRetry()},
+		"legacy": {MaxRetries: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			handler := &noopRecordingHandler{}
+			b := buildBulk(esClientWithTransport(t, &stubTransport{responder: missing}), nil)
+			b.sinkResponseHandler = handler
+
+			if err := b.bulkRequestPartition(items(), b.esClients[""], settings); err == nil {
+				t.Fatal("missing document without IgnoreMissing must surface as error")
+			}
+			if len(handler.errored) != 1 || handler.errored[0] != "2" {
+				t.Fatalf("only item 2 must fail, got %v", handler.errored)
+			}
+			if len(handler.noops) != 1 || handler.noops[0] != "1" {
+				t.Fatalf("only item 1 must be a no-op, got %v", handler.noops)
+			}
+		})
+	}
+}
+
+type noopRecordingHandler struct {
+	recordingHandler
+	noops []string
+}
+
+func (h *noopRecordingHandler) OnSuccess(ctx *elasticsearch.SinkResponseHandlerContext) {
+	h.recordingHandler.OnSuccess(ctx)
+	if ctx.IsNoop {
+		h.mu.Lock()
+		h.noops = append(h.noops, string(ctx.Action.ID))
+		h.mu.Unlock()
+	}
+}
+
+func conditionalItem(id string, seqNo int64) *elasticsearch.BatchItem {
+	primaryTerm := int64(1)
+	action := &document.ESActionDocument{
+		ID: []byte(id), IndexName: "idx", Type: document.DocUpdate, Source: []byte(`{"v":1}`),
+		IfSeqNo: &seqNo, IfPrimaryTerm: &primaryTerm,
+	}
+	return &elasticsearch.BatchItem{Action: action, Bytes: getEsActionJSON(action, nil)}
+}
+
+// A conditional item that loses a version conflict is rebuilt by re-running the
+// mapper and re-submitted with the fresh sequence number.
+func Test_requestFuncWithRetry_RemapsConflictedConditionalItem(t *testing.T) {
+	var bodies []string
+	st := &stubTransport{responder: func(call int) (*http.Response, error) {
+		if call == 1 {
+			return jsonResp(200, `{"errors":true,"items":[`+
+				`{"update":{"_index":"idx","_id":"1","status":409,"error":{"type":"version_conflict_engine_exception"}}}]}`), nil
+		}
+		return jsonResp(200, `{"errors":false}`), nil
+	}}
+	recording := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "_bulk") {
+			body, _ := io.ReadAll(req.Body)
+			bodies = append(bodies, string(body))
+		}
+		return st.RoundTrip(req)
+	})
+	handler := &recordingHandler{}
+	b := buildBulk(esClientWithTransport(t, recording), handler)
+
+	item := conditionalItem("1", 7)
+	var remaps int
+	item.Remap = func() ([]document.ESActionDocument, error) {
+		remaps++
+		return []document.ESActionDocument{*conditionalItem("1", 8).Action}, nil
+	}
+
+	retry := fastRetry()
+	retry.ConflictRetries = 1
+	err := b.requestFuncWithRetry(0, []*elasticsearch.BatchItem{item}, b.esClients[""], retry)()
+	if err != nil {
+		t.Fatalf("remapped item must succeed, got %v", err)
+	}
+	if remaps != 1 || st.calls() != 2 {
+		t.Fatalf("expected 1 remap and 2 bulk calls, got %d / %d", remaps, st.calls())
+	}
+	if !strings.Contains(bodies[1], `"if_seq_no":8`) {
+		t.Fatalf("retry must carry the fresh sequence number, got %s", bodies[1])
+	}
+	if len(handler.success) != 1 || len(handler.errored) != 0 {
+		t.Fatalf("expected 1 success / 0 errored, got %v / %v", handler.success, handler.errored)
+	}
+}
+
+func Test_requestFuncWithRetry_ConflictWithoutConflictRetriesIsTerminal(t *testing.T) {
+	st := &stubTransport{responder: func(_ int) (*http.Response, error) {
+		return jsonResp(200, `{"errors":true,"items":[`+
+			`{"update":{"_index":"idx","_id":"1","status":409,"error":{"type":"version_conflict_engine_exception"}}}]}`), nil
+	}}
+	handler := &recordingHandler{}
+	b := buildBulk(esClientWithTransport(t, st), handler)
+
+	item := conditionalItem("1", 7)
+	item.Remap = func() ([]document.ESActionDocument, error) {
+		t.Fatal("mapper must not be re-run when conflict retries are disabled")
+		return nil, nil
+	}
+
+	err := b.requestFuncWithRetry(0, []*elasticsearch.BatchItem{item}, b.esClients[""], fastRetry())()
+	if err == nil {
+		t.Fatal("conflict must surface when conflict retries are disabled")
+	}
+	if st.calls() != 1 || len(handler.errored) != 1 {
+		t.Fatalf("expected 1 call and 1 errored item, got %d / %v", st.calls(), handler.errored)
+	}
+}
+
+// A mapper error while remapping a conflicted item fails that item instead of
+// retrying it.
+func Test_requestFuncWithRetry_RemapErrorFailsItem(t *testing.T) {
+	st := &stubTransport{responder: func(_ int) (*http.Response, error) {
+		return jsonResp(200, `{"errors":true,"items":[`+
+			`{"update":{"_index":"idx","_id":"1","status":409,"error":{"type":"version_conflict_engine_exception"}}}]}`), nil
+	}}
+	handler := &recordingHandler{}
+	b := buildBulk(esClientWithTransport(t, st), handler)
+
+	item := conditionalItem("1", 7)
+	item.Remap = func() ([]document.ESActionDocument, error) {
+		return nil, errors.New("source document is unreadable")
+	}
+
+	retry := fastRetry()
+	retry.ConflictRetries = 1
+	err := b.requestFuncWithRetry(0, []*elasticsearch.BatchItem{item}, b.esClients[""], retry)()
+	if err == nil || !strings.Contains(err.Error(), "source document is unreadable") {
+		t.Fatalf("remap error must surface, got %v", err)
+	}
+	if st.calls() != 1 || len(handler.errored) != 1 {
+		t.Fatalf("expected 1 call and 1 errored item, got %d / %v", st.calls(), handler.errored)
+	}
+}
+
+// A panic while remapping a conflicted item, such as an unknown cluster key,
+// fails that item instead of crashing the request goroutine.
+func Test_requestFuncWithRetry_RemapPanicFailsItem(t *testing.T) {
+	st := &stubTransport{responder: func(_ int) (*http.Response, error) {
+		return jsonResp(200, `{"errors":true,"items":[`+
+			`{"update":{"_index":"idx","_id":"1","status":409,"error":{"type":"version_conflict_engine_exception"}}}]}`), nil
+	}}
+	handler := &recordingHandler{}
+	b := buildBulk(esClientWithTransport(t, st), handler)
+
+	item := conditionalItem("1", 7)
+	item.Remap = func() ([]document.ESActionDocument, error) {
+		panic(`unknown elasticsearch cluster key "missing"`)
+	}
+
+	retry := fastRetry()
+	retry.ConflictRetries = 1
+	err := b.requestFuncWithRetry(0, []*elasticsearch.BatchItem{item}, b.esClients[""], retry)()
+	if err == nil || !strings.Contains(err.Error(), "unknown elasticsearch cluster key") {
+		t.Fatalf("remap panic must surface as an item error, got %v", err)
+	}
+	if st.calls() != 1 || len(handler.errored) != 1 {
+		t.Fatalf("expected 1 call and 1 errored item, got %d / %v", st.calls(), handler.errored)
+	}
+}
+
+// Conflict retries are counted per item: an item that first needed a
+// transient retry can still be remapped once.
+func Test_requestFuncWithRetry_CountsConflictRetriesPerItem(t *testing.T) {
+	conflict := jsonResp(200, `{"errors":true,"items":[`+
+		`{"update":{"_index":"idx","_id":"1","status":409,"error":{"type":"version_conflict_engine_exception"}}}]}`)
+	st := &stubTransport{responder: func(call int) (*http.Response, error) {
+		switch call {
+		case 1:
+			return jsonResp(200, `{"errors":true,"items":[{"update":{"_index":"idx","_id":"1","status":503,"error":{}}}]}`), nil
+		case 2:
+			return conflict, nil
+		}
+		return jsonResp(200, `{"errors":false}`), nil
+	}}
+	handler := &recordingHandler{}
+	b := buildBulk(esClientWithTransport(t, st), handler)
+
+	item := conditionalItem("1", 7)
+	var remaps int
+	item.Remap = func() ([]document.ESActionDocument, error) {
+		remaps++
+		return []document.ESActionDocument{*conditionalItem("1", 8).Action}, nil
+	}
+
+	retry := fastRetry()
+	retry.ConflictRetries = 1
+	if err := b.requestFuncWithRetry(0, []*elasticsearch.BatchItem{item}, b.esClients[""], retry)(); err != nil {
+		t.Fatalf("remapped item must succeed, got %v", err)
+	}
+	if remaps != 1 || st.calls() != 3 {
+		t.Fatalf("expected 1 remap and 3 bulk calls, got %d / %d", remaps, st.calls())
+	}
+}
+
+// An item is remapped at most ConflictRetries times.
+func Test_requestFuncWithRetry_StopsRemappingAfterConflictRetries(t *testing.T) {
+	st := &stubTransport{responder: func(_ int) (*http.Response, error) {
+		return jsonResp(200, `{"errors":true,"items":[`+
+			`{"update":{"_index":"idx","_id":"1","status":409,"error":{"type":"version_conflict_engine_exception"}}}]}`), nil
+	}}
+	handler := &recordingHandler{}
+	b := buildBulk(esClientWithTransport(t, st), handler)
+
+	item := conditionalItem("1", 7)
+	var remaps int
+	item.Remap = func() ([]document.ESActionDocument, error) {
+		remaps++
+		return []document.ESActionDocument{*conditionalItem("1", 8).Action}, nil
+	}
+
+	retry := fastRetry()
+	retry.ConflictRetries = 1
+	if err := b.requestFuncWithRetry(0, []*elasticsearch.BatchItem{item}, b.esClients[""], retry)(); err == nil {
+		t.Fatal("conflict must surface once conflict retries are used up")
+	}
+	if remaps != 1 || st.calls() != 2 || len(handler.errored) != 1 {
+		t.Fatalf("expected 1 remap, 2 calls and 1 errored item, got %d / %d / %v", remaps, st.calls(), handler.errored)
+	}
+}
+
+// Remapped actions go through the same checks as the mapper's first result.
+func Test_remapFunc_ChecksActions(t *testing.T) {
+	b := buildBulk(nil, &recordingHandler{})
+	b.validator, _ = newValidator(&config.Validation{Enabled: true, Checks: []string{config.ValidationCheckJSON}})
+	b.mapper = func(event couchbase.Event) ([]document.ESActionDocument, error) {
+		return []document.ESActionDocument{document.IndexAction(event.Key).Source([]byte(`{"v":`)).Index("idx").Build()}, nil
+	}
+
+	_, err := b.remapFunc(couchbase.Event{Key: []byte("1")})()
+	var validationErr *elasticsearch.ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("remapped action must be validated, got %v", err)
+	}
+}
+
+func Test_CountMappingError(t *testing.T) {
+	b := buildBulk(nil, &recordingHandler{})
+	b.CountMappingError("orders")
+	b.CountMappingError("orders")
+
+	if got := b.GetMetric().MappingErrorCounter["orders"]; got != 2 {
+		t.Fatalf("MappingErrorCounter[orders] = %d, want 2", got)
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
 func clusterItem(id, clusterKey string) *elasticsearch.BatchItem {
 	return &elasticsearch.BatchItem{
 		Action: &document.ESActionDocument{ID: []byte(id), IndexName: "idx", Type: document.Index, ClusterKey: clusterKey},
@@ -439,10 +805,17 @@ func clusterItem(id, clusterKey string) *elasticsearch.BatchItem {
 
 func newMetric() *Metric {
 	return &Metric{
-		IndexingSuccessActionCounter: map[string]int64{},
-		IndexingErrorActionCounter:   map[string]int64{},
-		DeletionSuccessActionCounter: map[string]int64{},
-		DeletionErrorActionCounter:   map[string]int64{},
+		IndexingSuccessActionCounter:  map[string]int64{},
+		IndexingErrorActionCounter:    map[string]int64{},
+		CreationSuccessActionCounter:  map[string]int64{},
+		CreationErrorActionCounter:    map[string]int64{},
+		DeletionSuccessActionCounter:  map[string]int64{},
+		DeletionErrorActionCounter:    map[string]int64{},
+		MappingErrorCounter:           map[string]int64{},
+		FilteredEventCounter:          map[string]int64{},
+		FilterErrorCounter:            map[string]int64{},
+		UnmappedCollectionSkipCounter: map[string]int64{},
+		SchemaViolationCounter:        map[string]int64{},
 	}
 }
 
@@ -9,6 +9,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
 )
@@ -30,7 +32,12 @@ func Test_getEsActionJSON(t *testing.T) {
 	t.Run("basic_index_actions", testBasicIndexActions)
 	t.Run("routing_index_actions", testRoutingIndexActions)
 	t.Run("type_index_actions", testTypeIndexActions)
+	t.Run("create_actions", testCreateActions)
 	t.Run("delete_actions", testDeleteActions)
+	t.Run("versioned_actions", testVersionedActions)
+	t.Run("conditional_actions", testConditionalActions)
+	t.Run("pipeline_actions", testPipelineActions)
+	t.Run("update_options", testUpdateOptions)
 	t.Run("update_actions", testUpdateActions)
 	t.Run("script_update_actions", testScriptUpdateActions)
 }
@@ -42,7 +49,9 @@ func testBasicIndexActions(t *testing.T) {
 	var routing *string
 	var typeName []byte
 
-	actionJSON := getEsActionJSON(docID, action, testIndexName, routing, source, typeName)
+	actionJSON := getEsActionJSON(&document.ESActionDocument{
+		ID: docID, Type: action, IndexName: testIndexName, Routing: routing, Source: source,
+	}, typeName)
 
 	expectedAction := fmt.Sprintf(`{"index":{"_index":"%s","_id":"%s"}}`, testIndexName, testDocID) + "\n" + testSimpleDoc + "\n"
 	assertJSONEqual(t, expectedAction, string(actionJSON))
@@ -55,7 +64,9 @@ func testRoutingIndexActions(t *testing.T) {
 	routing := testRouting
 	var typeName []byte
 
-	actionJSON := getEsActionJSON(docID, action, testIndexName, &routing, source, typeName)
+	actionJSON := getEsActionJSON(&document.ESActionDocument{
+		ID: docID, Type: action, IndexName: testIndexName, Routing: &routing, Source: source,
+	}, typeName)
 
 	expectedAction := fmt.Sprintf(
 		`{"index":{"_index":"%s","_id":"%s","routing":"%s"}}`,
@@ -73,7 +84,9 @@ func testTypeIndexActions(t *testing.T) {
 	var routing *string
 	typeName := []byte("_doc")
 
-	actionJSON := getEsActionJSON(docID, action, testIndexName, routing, source, typeName)
+	actionJSON := getEsActionJSON(&document.ESActionDocument{
+		ID: docID, Type: action, IndexName: testIndexName, Routing: routing, Source: source,
+	}, typeName)
 
 	expectedAction := fmt.Sprintf(
 		`{"index":{"_index":"%s","_id":"%s","_type":"_doc"}}`,
@@ -83,6 +96,26 @@ func testTypeIndexActions(t *testing.T) {
 	assertJSONEqual(t, expectedAction, string(actionJSON))
 }
 
+func testCreateActions(t *testing.T) {
+	docID := []byte(testDocID)
+	action := document.Create
+	source := []byte(testSimpleDoc)
+	routing := testRouting
+	var typeName []byte
+
+	actionJSON := getEsActionJSON(&document.ESActionDocument{
+		ID: docID, Type: action, IndexName: testIndexName, Routing: &routing, Source: source,
+	}, typeName)
+
+	expectedAction := fmt.Sprintf(
+		`{"create":{"_index":"%s","_id":"%s","routing":"%s"}}`,
+		testIndexName,
+		testDocID,
+		routing,
+	) + "\n" + testSimpleDoc + "\n"
+	assertJSONEqual(t, expectedAction, string(actionJSON))
+}
+
 func testDeleteActions(t *testing.T) {
 	t.Run("basic_delete", func(t *testing.T) {
 		docID := []byte(testDocID)
@@ -91,13 +124,285 @@ func testDeleteActions(t *testing.T) {
 		var routing *string
 		var typeName []byte
 
-		actionJSON := getEsActionJSON(docID, action, testIndexName, routing, source, typeName)
+		actionJSON := getEsActionJSON(&document.ESActionDocument{
+			ID: docID, Type: action, IndexName: testIndexName, Routing: routing, Source: source,
+		}, typeName)
 
 		expectedAction := fmt.Sprintf(`{"delete":{"_index":"%s","_id":"%s"}}`, testIndexName, testDocID) + "\n"
 		assertJSONEqual(t, expectedAction, string(actionJSON))
 	})
 }
 
+func testVersionedActions(t *testing.T) {
+	version := uint64(1712345678901234567)
+
+	t.Run("index_defaults_to_external", func(t *testing.T) {
+		actionJSON := getEsActionJSON(&document.ESActionDocument{
+			ID: []byte(testDocID), Type: document.Index, IndexName: testIndexName, Source: []byte(testSimpleDoc),
+			Version: &version,
+		}, nil)
+
+		expectedAction := fmt.Sprintf(
+			`{"index":{"_index":"%s","_id":"%s","version":%d,"version_type":"external"}}`,
+			testIndexName,
+			testDocID,
+			version,
+		) + "\n" + testSimpleDoc + "\n"
+		assertJSONEqual(t, expectedAction, string(actionJSON))
+	})
+	t.Run("delete_external_gte_with_routing", func(t *testing.T) {
+		routing := testRouting
+		actionJSON := getEsActionJSON(&document.ESActionDocument{
+			ID: []byte(testDocID), Type: document.Delete, IndexName: testIndexName, Routing: &routing,
+			Version: &version, VersionType: document.VersionTypeExternalGte,
+		}, nil)
+
+		expectedAction := fmt.Sprintf(
+			`{"delete":{"_index":"%s","_id":"%s","routing":"%s","version":%d,"version_type":"external_gte"}}`,
+			testIndexName,
+			testDocID,
+			routing,
+			version,
+		) + "\n"
+		assertJSONEqual(t, expectedAction, string(actionJSON))
+	})
+	t.Run("update_ignores_version", func(t *testing.T) {
+		actionJSON := getEsActionJSON(&document.ESActionDocument{
+			ID: []byte(testDocID), Type: document.DocUpdate, IndexName: testIndexName, Source: []byte(testUpdatedDoc),
+			Version: &version,
+		}, nil)
+
+		expectedAction := updateActionMeta + "\n" +
+			fmt.Sprintf(`{"doc":%s, "doc_as_upsert":true}`, testUpdatedDoc) + "\n"
+		assertJSONEqual(t, expectedAction, string(actionJSON))
+	})
+}
+
+func testConditionalActions(t *testing.T) {
+	seqNo, primaryTerm := int64(42), int64(3)
+
+	t.Run("script_update", func(t *testing.T) {
+		actionJSON := getEsActionJSON(&document.ESActionDocument{
+			ID: []byte(testDocID), Type: document.ScriptUpdate, IndexName: testIndexName, Source: []byte(scriptTemplate),
+			IfSeqNo: &seqNo, IfPrimaryTerm: &primaryTerm,
+		}, nil)
+
+		expectedAction := fmt.Sprintf(
+			`{"update":{"_index":"%s","_id":"%s","if_seq_no":42,"if_primary_term":3}}`,
+			testIndexName,
+			testDocID,
+		) + "\n" + fmt.Sprintf(`{"script":%s,"scripted_upsert":true}`, scriptTemplate) + "\n"
+		assertJSONEqual(t, expectedAction, string(actionJSON))
+	})
+	t.Run("requires_primary_term", func(t *testing.T) {
+		actionJSON := getEsActionJSON(&document.ESActionDocument{
+			ID: []byte(testDocID), Type: document.Delete, IndexName: testIndexName, IfSeqNo: &seqNo,
+		}, nil)
+
+		expectedAction := fmt.Sprintf(`{"delete":{"_index":"%s","_id":"%s"}}`, testIndexName, testDocID) + "\n"
+		assertJSONEqual(t, expectedAction, string(actionJSON))
+	})
+}
+
+func testPipelineActions(t *testing.T) {
+	t.Run("index", func(t *testing.T) {
+		actionJSON := getEsActionJSON(&document.ESActionDocument{
+			ID: []byte(testDocID), Type: document.Index, IndexName: testIndexName, Source: []byte(testSimpleDoc),
+			Pipeline: "geoip",
+		}, nil)
+
+		expectedAction := fmt.Sprintf(
+			`{"index":{"_index":"%s","_id":"%s","pipeline":"geoip"}}`,
+			testIndexName,
+			testDocID,
+		) + "\n" + testSimpleDoc + "\n"
+		assertJSONEqual(t, expectedAction, string(actionJSON))
+	})
+	t.Run("update_ignores_pipeline", func(t *testing.T) {
+		actionJSON := getEsActionJSON(&document.ESActionDocument{
+			ID: []byte(testDocID), Type: document.DocUpdate, IndexName: testIndexName, Source: []byte(testUpdatedDoc),
+			Pipeline: "geoip",
+		}, nil)
+
+		expectedAction := updateActionMeta + "\n" +
+			fmt.Sprintf(`{"doc":%s, "doc_as_upsert":true}`, testUpdatedDoc) + "\n"
+		assertJSONEqual(t, expectedAction, string(actionJSON))
+	})
+}
+
+func testUpdateOptions(t *testing.T) {
+	retryOnConflict, detectNoop, off := 3, true, false
+
+	t.Run("doc_update", func(t *testing.T) {
+		actionJSON := getEsActionJSON(&document.ESActionDocument{
+			ID: []byte(testDocID), Type: document.DocUpdate, IndexName: testIndexName, Source: []byte(testUpdatedDoc),
+			UpdateOptions: &document.UpdateOptions{
+				RetryOnConflict: &retryOnConflict,
+				DetectNoop:      &detectNoop,
+				DocAsUpsert:     &off,
+				Upsert:          []byte(testSimpleDoc),
+				SourceIncludes:  []string{"name"},
+			},
+		}, nil)
+
+		expectedAction := fmt.Sprintf(
+			`{"update":{"_index":"%s","_id":"%s","retry_on_conflict":3}}`,
+			testIndexName,
+			testDocID,
+		) + "\n" + fmt.Sprintf(
+			`{"doc":%s,"doc_as_upsert":false,"upsert":%s,"detect_noop":true,"_source":{"includes":["name"]}}`,
+			testUpdatedDoc,
+			testSimpleDoc,
+		) + "\n"
+		assertJSONEqual(t, expectedAction, string(actionJSON))
+	})
+	t.Run("upsert_turns_doc_as_upsert_off", func(t *testing.T) {
+		actionJSON := getEsActionJSON(&document.ESActionDocument{
+			ID: []byte(testDocID), Type: document.DocUpdate, IndexName: testIndexName, Source: []byte(testUpdatedDoc),
+			UpdateOptions: &document.UpdateOptions{Upsert: []byte(testSimpleDoc)},
+		}, nil)
+
+		expectedAction := updateActionMeta + "\n" +
+			fmt.Sprintf(`{"doc":%s,"doc_as_upsert":false,"upsert":%s}`, testUpdatedDoc, testSimpleDoc) + "\n"
+		assertJSONEqual(t, expectedAction, string(actionJSON))
+	})
+	t.Run("script_params", func(t *testing.T) {
+		cases := map[string]string{
+			`{"source":"ctx._source.n += params.n","lang":"painless"}`: `{"source":"ctx._source.n += params.n","lang":"painless","params":{"n":1}}`,
+			`"ctx._source.n += params.n"`:                              `{"source":"ctx._source.n += params.n","params":{"n":1}}`,
+			`{"id":"increment"}`:                                       `{"id":"increment","params":{"n":1}}`,
+			`{}`:                                                       `{"params":{"n":1}}`,
+		}
+		for script, expectedScript := range cases {
+			actionJSON := getEsActionJSON(&document.ESActionDocument{
+				ID: []byte(testDocID), Type: document.ScriptUpdate, IndexName: testIndexName, Source: []byte(script),
+				UpdateOptions: &document.UpdateOptions{ScriptParams: []byte(`{"n":1}`), ScriptedUpsert: &off},
+			}, nil)
+
+			expectedAction := updateActionMeta + "\n" +
+				fmt.Sprintf(`{"script":%s,"scripted_upsert":false}`, expectedScript) + "\n"
+			assertJSONEqual(t, expectedAction, string(actionJSON))
+		}
+	})
+}
+
+func Test_updateOptionsError(t *testing.T) {
+	seqNo, primaryTerm, retryOnConflict, on := int64(3), int64(1), 2, true
+	tests := []struct {
+		action  document.ESActionDocument
+		name    string
+		wantErr bool
+	}{
+		{
+			name:   "upsert",
+			action: document.DocUpdateAction([]byte("1")).Source([]byte(`{}`)).Upsert([]byte(`{}`)).Build(),
+		},
+		{
+			name: "upsert_with_doc_as_upsert",
+			action: document.ESActionDocument{Type: document.DocUpdate, UpdateOptions: &document.UpdateOptions{
+				Upsert: []byte(`{}`), DocAsUpsert: &on,
+			}},
+			wantErr: true,
+		},
+		{
+			name: "scripted_upsert_with_upsert",
+			action: document.ESActionDocument{Type: document.ScriptUpdate, UpdateOptions: &document.UpdateOptions{
+				Upsert: []byte(`{}`), ScriptedUpsert: &on,
+			}},
+		},
+		{
+			name:   "retry_on_conflict",
+			action: document.DocUpdateAction([]byte("1")).Source([]byte(`{}`)).RetryOnConflict(2).Build(),
+		},
+		{
+			name: "retry_on_conflict_with_if_seq_no",
+			action: document.ESActionDocument{
+				Type: document.DocUpdate, IfSeqNo: &seqNo, IfPrimaryTerm: &primaryTerm,
+				UpdateOptions: &document.UpdateOptions{RetryOnConflict: &retryOnConflict},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := updateOptionsError(&tt.action)
+			if (err != nil) != tt.wantErr || err != nil && !errors.Is(err, elasticsearch.ErrUpdateOptions) {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_getEsActionJSON_Builder(t *testing.T) {
+	action := document.DocUpdateAction([]byte(testDocID)).
+		Source([]byte(testUpdatedDoc)).
+		PartialObject("doc").
+		Index(testIndexName).
+		Routing("r1").
+		RetryOnConflict(2).
+		DocAsUpsert(false).
+		Build()
+
+	expectedAction := fmt.Sprintf(
+		`{"update":{"_index":"%s","_id":"%s","routing":"r1","retry_on_conflict":2}}`,
+		testIndexName,
+		testDocID,
+	) + "\n" + fmt.Sprintf(`{"doc":{"doc":%s},"doc_as_upsert":false}`, testUpdatedDoc) + "\n"
+	assertJSONEqual(t, expectedAction, string(getEsActionJSON(&action, nil)))
+
+	routing := "r1"
+	legacy := document.NewDocUpdateActionWithIndexName([]byte(testDocID), []byte(testUpdatedDoc), &routing, testIndexName, "doc")
+	if string(legacy.Source) != string(action.Source) || *legacy.Routing != *action.Routing {
+		t.Fatalf("legacy constructor must build the same action, got %+v", legacy)
+	}
+}
+
+func Test_resolveAction_IndexUpdateOptions(t *testing.T) {
+	retryOnConflict, detectNoop, off := 5, false, false
+	b := Bulk{config: &config.Config{Elasticsearch: config.Elasticsearch{
+		CollectionIndexMapping: map[string]string{"_default": testIndexName},
+		IndexUpdateOptions: map[string]document.UpdateOptions{
+			testIndexName: {RetryOnConflict: &retryOnConflict, DetectNoop: &detectNoop},
+		},
+	}}}
+
+	action := document.NewDocUpdateAction([]byte(testDocID), []byte(testUpdatedDoc), nil, "doc")
+	action.UpdateOptions = &document.UpdateOptions{DocAsUpsert: &off}
+	if err := b.resolveAction(&action, couchbase.Event{CollectionName: "_default"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts := action.UpdateOptions
+	if *opts.RetryOnConflict != 5 || *opts.DetectNoop || *opts.DocAsUpsert {
+		t.Fatalf("index defaults must fill only unset options, got %+v", opts)
+	}
+}
+
+func Test_getPipeline(t *testing.T) {
+	b := Bulk{config: &config.Config{Elasticsearch: config.Elasticsearch{
+		Pipeline:             "default-pipeline",
+		IndexPipelineMapping: map[string]string{"orders": "orders-pipeline", "raw": ""},
+		Clusters: map[string]config.Elasticsearch{
+			"analytics": {IndexPipelineMapping: map[string]string{"orders": "analytics-orders"}},
+		},
+	}}}
+
+	cases := []struct {
+		index, clusterKey, want string
+	}{
+		{"orders", "", "orders-pipeline"},
+		{"users", "", "default-pipeline"},
+		{"raw", "", ""},
+		{"orders", "analytics", "analytics-orders"},
+		{"users", "analytics", ""},
+	}
+	for _, c := range cases {
+		if got := b.getPipeline(c.index, c.clusterKey); got != c.want {
+			t.Fatalf("getPipeline(%q, %q) = %q, want %q", c.index, c.clusterKey, got, c.want)
+		}
+	}
+}
+
 func testUpdateActions(t *testing.T) {
 	t.Run("basic_update", func(t *testing.T) {
 		docID := []byte(testDocID)
@@ -106,7 +411,9 @@ func testUpdateActions(t *testing.T) {
 		var routing *string
 		var typeName []byte
 
-		actionJSON := getEsActionJSON(docID, action, testIndexName, routing, source, typeName)
+		actionJSON := getEsActionJSON(&document.ESActionDocument{
+			ID: docID, Type: action, IndexName: testIndexName, Routing: routing, Source: source,
+		}, typeName)
 
 		expectedAction := updateActionMeta + "\n" +
 			fmt.Sprintf(`{"doc":%s, "doc_as_upsert":true}`, testUpdatedDoc) + "\n"
@@ -125,7 +432,9 @@ func testBasicScriptUpdate(t *testing.T) {
 	var routing *string
 	var typeName []byte
 
-	actionJSON := getEsActionJSON(docID, action, testIndexName, routing, script, typeName)
+	actionJSON := getEsActionJSON(&document.ESActionDocument{
+		ID: docID, Type: action, IndexName: testIndexName, Routing: routing, Source: script,
+	}, typeName)
 
 	expectedAction := fmt.Sprintf(`{"update":{"_index":"%s","_id":"%s"}}`, testIndexName, testDocID) + "\n" +
 		fmt.Sprintf(`{"script":%s,"scripted_upsert":true}`, scriptTemplate) + "\n"
@@ -139,7 +448,7 @@ func TestBulk_executeSinkResponseHandler(t *testing.T) {
 		sut := Bulk{}
 
 		// When
-		sut.finalizeProcess(nil, nil)
+		sut.finalizeProcess(nil, nil, nil)
 
 		// Then
 	})
@@ -165,7 +474,7 @@ func TestBulk_executeSinkResponseHandler(t *testing.T) {
 		}
 
 		// When
-		sut.finalizeProcess(batchActions, errorData)
+		sut.finalizeProcess(batchActions, errorData, nil)
 		time.Sleep(1 * time.Second)
 
 		// Then
@@ -365,3 +674,22 @@ func (m *mockSinkResponseHandler) OnInit(ctx *elasticsearch.SinkResponseHandlerI
 func (m *mockSinkResponseHandler) OnBeforeBulk(_ *elasticsearch.SinkResponseHandlerBulkContext) {}
 
 func (m *mockSinkResponseHandler) OnAfterBulk(_ *elasticsearch.SinkResponseHandlerBulkContext) {}
+
+func Test_RejectEvent(t *testing.T) {
+	handler := &errRecordingHandler{}
+	b := buildBulk(nil, &handler.recordingHandler)
+	b.sinkResponseHandler = handler
+	b.config = &config.Config{Elasticsearch: config.Elasticsearch{
+		CollectionIndexMapping: map[string]string{"orders": testIndexName},
+	}}
+
+	decodeErr := errors.New("snappy: corrupt input")
+	b.RejectEvent(couchbase.Event{Key: []byte(testDocID), CollectionName: "orders", IsMutated: true}, decodeErr)
+
+	if len(handler.errored) != 1 || handler.errored[0] != testDocID {
+		t.Fatalf("expected %s to be rejected, got %v", testDocID, handler.errored)
+	}
+	if !errors.Is(handler.errs[0], decodeErr) {
+		t.Fatalf("expected the decode error, got %v", handler.errs[0])
+	}
+}
@@ -0,0 +1,155 @@
+package bulk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Trendyol/go-dcp/logger"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	jsoniter "github.com/json-iterator/go"
+
+	dcpElasticsearch "github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+func isByQuery(action *document.ESActionDocument) bool {
+	return action.Type == document.DeleteByQuery || action.Type == document.UpdateByQuery
+}
+
+// addByQueryAction appends a by-query action to the batch. It acts as a
+// barrier: a later action on a document already in the batch is appended
+// after it instead of replacing the earlier entry. Together with the refresh
+// in doByQuery, the by-query request sees exactly the writes that preceded it.
+func (b *Bulk) addByQueryAction(action *document.ESActionDocument) {
+	b.batch = append(b.batch, &dcpElasticsearch.BatchItem{Action: action})
+	b.batchKeys = make(map[string]int, b.batchSizeLimit)
+	b.batchIndex++
+	b.batchSize++
+}
+
+// byQueryRequest runs a DeleteByQuery or UpdateByQuery action and reports its
+// outcome through the sink response handler and metrics like a bulk item.
+// Version conflicts on matched documents are counted as failures rather than
+// aborting the request. Transient failures, including of the refresh that
+// precedes the query, are retried with the cluster's retry settings.
+func (b *Bulk) byQueryRequest(action *document.ESActionDocument) error {
+	esClient := b.esClients[action.ClusterKey]
+	retry := b.elasticsearchSettingsForCluster(action.ClusterKey).Retry
+
+	err := doByQuery(esClient, action)
+	if retry != nil && retry.Enabled {
+		for attempt := 1; attempt <= retry.MaxRetries && isRetryableByQueryErr(err, retry.RetryOnStatus); attempt++ {
+			logger.Log.Warn("retrying %s on index %s, attempt: %d, err: %v", action.Type, action.IndexName, attempt, err)
+			time.Sleep(backoffDuration(attempt, retry.InitialInterval, retry.MaxInterval))
+			err = doByQuery(esClient, action)
+		}
+	}
+
+	var errorData map[string]string
+	if err != nil {
+		errorData = map[string]string{getActionKey(*action): err.Error()}
+	}
+	b.finalizeProcess([]*document.ESActionDocument{action}, errorData, nil)
+	return err
+}
+
+// byQueryStatusError is returned when a by-query request fails as a whole.
+type byQueryStatusError struct {
+	body   string
+	status int
+}
+
+func (e *byQueryStatusError) Error() string {
+	return fmt.Sprintf("by-query request has error %d: %s", e.status, e.body)
+}
+
+func isRetryableByQueryErr(err error, retryOn []int) bool {
+	if err == nil {
+		return false
+	}
+	var statusErr *byQueryStatusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.status, retryOn)
+	}
+	return isRetryableTransportErr(err)
+}
+
+type byQueryResponse struct {
+	Failures         []any `json:"failures"`
+	VersionConflicts int   `json:"version_conflicts"`
+}
+
+// refreshIndex makes the writes sent before a by-query action searchable.
+// Bulk requests are sent without refresh, so the query would otherwise match
+// the index as of its last periodic refresh.
+func refreshIndex(esClient *elasticsearch.Client, indexName string) error {
+	r, err := esapi.IndicesRefreshRequest{
+		Index: []string{indexName},
+	}.Do(context.Background(), esClient)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.IsError() {
+		return &byQueryStatusError{status: r.StatusCode, body: r.String()}
+	}
+	return nil
+}
+
+func doByQuery(esClient *elasticsearch.Client, action *document.ESActionDocument) error {
+	if err := refreshIndex(esClient, action.IndexName); err != nil {
+		return fmt.Errorf("refresh before %s: %w", action.Type, err)
+	}
+
+	var routing []string
+	if action.Routing != nil && *action.Routing != "" {
+		routing = []string{*action.Routing}
+	}
+
+	var (
+		r   *esapi.Response
+		err error
+	)
+	switch action.Type {
+	case document.DeleteByQuery:
+		r, err = esapi.DeleteByQueryRequest{
+			Index:     []string{action.IndexName},
+			Body:      bytes.NewReader(action.Source),
+			Routing:   routing,
+			Conflicts: "proceed",
+		}.Do(context.Background(), esClient)
+	case document.UpdateByQuery:
+		r, err = esapi.UpdateByQueryRequest{
+			Index:     []string{action.IndexName},
+			Body:      bytes.NewReader(action.Source),
+			Routing:   routing,
+			Conflicts: "proceed",
+		}.Do(context.Background(), esClient)
+	default:
+		return fmt.Errorf("%s is not a by-query action", action.Type)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.IsError() {
+		return &byQueryStatusError{status: r.StatusCode, body: r.String()}
+	}
+
+	var resp byQueryResponse
+	if err := jsoniter.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return err
+	}
+	if len(resp.Failures) > 0 || resp.VersionConflicts > 0 {
+		failures, _ := jsoniter.MarshalToString(resp.Failures)
+		return fmt.Errorf("%s on index %s had %d version conflicts, failures: %s",
+			action.Type, action.IndexName, resp.VersionConflicts, failures)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package bulk
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+	"github.com/Trendyol/go-dcp-elasticsearch/helper"
+	esv7 "github.com/elastic/go-elasticsearch/v7"
+)
+
+func byQueryBulk(t *testing.T, rt http.RoundTripper, handler *recordingHandler) *Bulk {
+	t.Helper()
+	return &Bulk{
+		concurrentRequest:   1,
+		readers:             []*helper.MultiDimByteReader{helper.NewMultiDimByteReader(nil)},
+		metric:              newMetric(),
+		sinkResponseHandler: handler,
+		esClients:           map[string]*esv7.Client{"": esClientWithTransport(t, rt)},
+		config: &config.Config{Elasticsearch: config.Elasticsearch{
+			CollectionIndexMapping: map[string]string{"_default": "idx"},
+			MaxRetries:             1,
+		}},
+		batchKeys:          map[string]int{},
+		batchSizeLimit:     100,
+		batchByteSizeLimit: 1 << 20,
+	}
+}
+
+// productCheckResp answers the product check the client sends before its
+// first request.
+func productCheckResp() *http.Response {
+	return jsonResp(200, `{"version":{"number":"7.17.0","build_flavor":"default"},"tagline":"You Know, for Search"}`)
+}
+
+// A by-query action is a barrier: writes before it are sent first, its index
+// is refreshed so they are searchable, it runs next, and a later write to a
+// document already in the batch is kept after it.
+func Test_bulkRequest_ByQueryRunsInBatchOrder(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/" {
+			return productCheckResp(), nil
+		}
+		mu.Lock()
+		paths = append(paths, req.URL.Path)
+		mu.Unlock()
+		if strings.HasSuffix(req.URL.Path, "_delete_by_query") {
+			return jsonResp(200, `{"deleted":2,"version_conflicts":0,"failures":[]}`), nil
+		}
+		return jsonResp(200, `{"errors":false}`), nil
+	})
+
+	handler := &recordingHandler{}
+	b := byQueryBulk(t, rt, handler)
+	b.AddEventActions(nil, couchbase.Event{CollectionName: "_default"}, []document.ESActionDocument{
+		document.NewIndexAction([]byte("child"), []byte(`{"parentId":"p"}`), nil),
+		document.NewDeleteByQueryAction([]byte(`{"term":{"parentId":"p"}}`), nil),
+		document.NewIndexAction([]byte("child"), []byte(`{"parentId":"q"}`), nil),
+	}, false)
+
+	if len(b.batch) != 3 {
+		t.Fatalf("a write after a by-query action must not replace the one before it, got %d items", len(b.batch))
+	}
+	if err := b.bulkRequest(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"/_bulk", "/idx/_refresh", "/idx/_delete_by_query", "/_bulk"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Fatalf("requests = %v, want %v", paths, want)
+	}
+	if len(handler.success) != 3 || len(handler.errored) != 0 {
+		t.Fatalf("expected 3 successes, got success=%v errored=%v", handler.success, handler.errored)
+	}
+}
+
+func Test_byQueryRequest_ReportsFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		resp func() *http.Response
+	}{
+		{"request_error", func() *http.Response { return jsonResp(400, `{"error":"bad query"}`) }},
+		{"version_conflicts", func() *http.Response {
+			return jsonResp(200, `{"updated":1,"version_conflicts":1,"failures":[]}`)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if strings.HasSuffix(req.URL.Path, "_refresh") {
+					return jsonResp(200, `{}`), nil
+				}
+				return tt.resp(), nil
+			})
+			handler := &recordingHandler{}
+			b := byQueryBulk(t, rt, handler)
+
+			action := document.NewUpdateByQueryActionWithIndexName(
+				"idx", []byte(`{"match_all":{}}`), []byte(`"ctx._source.n++"`), nil)
+			if err := b.byQueryRequest(&action); err == nil {
+				t.Fatal("expected an error")
+			}
+			if len(handler.errored) != 1 {
+				t.Fatalf("failure must reach OnError, got %v", handler.errored)
+			}
+		})
+	}
+}
+
+func Test_byQueryRequest_RetriesRetryableStatus(t *testing.T) {
+	calls := 0
+	rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/" {
+			return productCheckResp(), nil
+		}
+		if strings.HasSuffix(req.URL.Path, "_refresh") {
+			return jsonResp(200, `{}`), nil
+		}
+		calls++
+		if calls == 1 {
+			return jsonResp(503, `{"error":"unavailable"}`), nil
+		}
+		return jsonResp(200, `{"deleted":1,"failures":[]}`), nil
+	})
+	handler := &recordingHandler{}
+	b := byQueryBulk(t, rt, handler)
+	b.config.Elasticsearch.Retry = fastRetry()
+
+	action := document.NewDeleteByQueryActionWithIndexName("idx", []byte(`{"match_all":{}}`), nil)
+	if err := b.byQueryRequest(&action); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 2 || len(handler.success) != 1 {
+		t.Fatalf("expected a retried success, got calls=%d success=%v", calls, handler.success)
+	}
+}
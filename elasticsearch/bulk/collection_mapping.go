@@ -0,0 +1,163 @@
+package bulk
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+)
+
+// errUnmappedCollection is returned for an action of a collection without an
+// index mapping when elasticsearch.unmappedCollectionPolicy is skip.
+var errUnmappedCollection = errors.New("no index mapping for collection")
+
+// collectionPattern is a collectionIndexMapping entry whose key is a glob
+// (containing * or ?) or a regular expression between slashes.
+type collectionPattern struct {
+	re   *regexp.Regexp
+	text string
+}
+
+// indexMapping is a compiled collectionIndexMapping. Exact keys win over
+// patterns; patterns are tried longest key first.
+type indexMapping struct {
+	exact    map[string]string
+	patterns []collectionPattern
+}
+
+// IsCollectionPattern reports whether a collection key is a glob or a
+// regular expression rather than a collection or scope.collection name.
+func IsCollectionPattern(key string) bool {
+	return strings.ContainsAny(key, "*?") || (len(key) > 1 && key[0] == '/' && key[len(key)-1] == '/')
+}
+
+// compileCollectionPattern turns a regex key into an anchored expression and
+// a glob key into one where every * is a capture group.
+func compileCollectionPattern(key string) (*regexp.Regexp, error) {
+	if key[0] == '/' && key[len(key)-1] == '/' {
+		return regexp.Compile("^(?:" + key[1:len(key)-1] + ")$")
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('^')
+	for _, r := range key {
+		switch r {
+		case '*':
+			sb.WriteString("([^.]*)")
+		case '?':
+			sb.WriteString("[^.]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteByte('$')
+	return regexp.Compile(sb.String())
+}
+
+func compileIndexMapping(mapping map[string]string) (*indexMapping, error) {
+	m := &indexMapping{exact: make(map[string]string, len(mapping))}
+	keys := make([]string, 0)
+	for key, text := range mapping {
+		if !IsCollectionPattern(key) {
+			m.exact[key] = text
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+
+	for _, key := range keys {
+		re, err := compileCollectionPattern(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", key, err)
+		}
+		m.patterns = append(m.patterns, collectionPattern{re: re, text: mapping[key]})
+	}
+	return m, nil
+}
+
+// lookup returns the entry for the event's collection. The capture groups of
+// a matching pattern are expanded in the entry ($1, ${name}). Patterns are
+// matched against the collection name, then against scope.collection.
+func (m *indexMapping) lookup(event couchbase.Event) (string, bool) {
+	if text, ok := collectionEntry(m.exact, event); ok {
+		return text, true
+	}
+
+	names := []string{event.CollectionName}
+	if event.ScopeName != "" {
+		names = append(names, event.QualifiedCollectionName())
+	}
+	for _, p := range m.patterns {
+		for _, name := range names {
+			if match := p.re.FindStringSubmatchIndex(name); match != nil {
+				return string(p.re.ExpandString(nil, p.text, name, match)), true
+			}
+		}
+	}
+	return "", false
+}
+
+// IndexMappingEntry returns the default cluster's collectionIndexMapping
+// entry for the event's collection, with the capture groups of a pattern key
+// expanded. The entry may still be a template.
+func (b *Bulk) IndexMappingEntry(event couchbase.Event) (string, bool, error) {
+	mapping, err := b.indexMappings.get("", b.collectionMappingForCluster(""))
+	if err != nil {
+		return "", false, err
+	}
+	text, ok := mapping.lookup(event)
+	return text, ok, nil
+}
+
+// indexMappingCache holds the compiled collectionIndexMapping of each
+// cluster, keyed by cluster key.
+type indexMappingCache struct {
+	mappings sync.Map
+}
+
+func (c *indexMappingCache) get(clusterKey string, mapping map[string]string) (*indexMapping, error) {
+	if m, ok := c.mappings.Load(clusterKey); ok {
+		return m.(*indexMapping), nil
+	}
+	m, err := compileIndexMapping(mapping)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := c.mappings.LoadOrStore(clusterKey, m)
+	return actual.(*indexMapping), nil
+}
+
+// checkIndexMappings checks the pattern keys of every cluster's
+// collectionIndexMapping and the unmapped collection policy.
+func checkIndexMappings(es config.Elasticsearch) error {
+	if _, err := compileIndexMapping(es.CollectionIndexMapping); err != nil {
+		return fmt.Errorf("elasticsearch.collectionIndexMapping: %w", err)
+	}
+	for clusterKey, cluster := range es.Clusters {
+		if _, err := compileIndexMapping(cluster.CollectionIndexMapping); err != nil {
+			return fmt.Errorf("elasticsearch.clusters.%s.collectionIndexMapping: %w", clusterKey, err)
+		}
+	}
+
+	switch es.UnmappedCollectionPolicy {
+	case "", config.UnmappedCollectionPolicyPanic, config.UnmappedCollectionPolicySkip:
+	case config.UnmappedCollectionPolicyDefaultIndex:
+		if es.DefaultIndex == "" {
+			return fmt.Errorf("elasticsearch.defaultIndex is required with unmappedCollectionPolicy %q", es.UnmappedCollectionPolicy)
+		}
+	default:
+		return fmt.Errorf("elasticsearch.unmappedCollectionPolicy: unknown policy %q", es.UnmappedCollectionPolicy)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package bulk
+
+import (
+	"testing"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+func Test_lookupIndexName_Patterns(t *testing.T) {
+	b := Bulk{config: &config.Config{Elasticsearch: config.Elasticsearch{
+		CollectionIndexMapping: map[string]string{
+			"orders_archive":              "archive",
+			"orders_*":                    "orders-$1",
+			`/^(?P<kind>audit|log)_\d+$/`: "${kind}s",
+			"tenant-*.users":              "users-$1",
+			"*":                           "catch-all",
+		},
+	}}}
+
+	tests := []struct {
+		scope      string
+		collection string
+		want       string
+	}{
+		{"", "orders_archive", "archive"},
+		{"", "orders_2024", "orders-2024"},
+		{"", "audit_7", "audits"},
+		{"tenant-a", "users", "users-a"},
+		{"", "products", "catch-all"},
+	}
+	for _, tt := range tests {
+		event := couchbase.Event{ScopeName: tt.scope, CollectionName: tt.collection}
+		got, err := b.lookupIndexName(event, "", "")
+		if err != nil || got != tt.want {
+			t.Fatalf("%s.%s: got %q, err: %v, want %q", tt.scope, tt.collection, got, err, tt.want)
+		}
+	}
+}
+
+func Test_AddActions_UnmappedCollectionPolicy(t *testing.T) {
+	tests := []struct {
+		policy      string
+		wantBatch   int
+		wantSkipped int64
+	}{
+		{config.UnmappedCollectionPolicySkip, 0, 1},
+		{config.UnmappedCollectionPolicyDefaultIndex, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			b := buildBulk(nil, &recordingHandler{})
+			b.config = &config.Config{Elasticsearch: config.Elasticsearch{
+				CollectionIndexMapping:   map[string]string{"orders": "orders"},
+				UnmappedCollectionPolicy: tt.policy,
+				DefaultIndex:             "unmapped",
+			}}
+			b.batchKeys = map[string]int{}
+			b.batchSizeLimit = 100
+			b.batchByteSizeLimit = 1 << 20
+
+			b.AddEventActions(nil, couchbase.Event{CollectionName: "invoices"}, []document.ESActionDocument{
+				document.NewIndexAction([]byte("1"), []byte(`{}`), nil),
+			}, false)
+
+			if len(b.batch) != tt.wantBatch {
+				t.Fatalf("batch has %d items, want %d", len(b.batch), tt.wantBatch)
+			}
+			if tt.wantBatch > 0 && b.batch[0].Action.IndexName != "unmapped" {
+				t.Fatalf("IndexName = %q, want the default index", b.batch[0].Action.IndexName)
+			}
+			if got := b.metric.UnmappedCollectionSkipCounter["invoices"]; got != tt.wantSkipped {
+				t.Fatalf("skipped = %d, want %d", got, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func Test_checkIndexMappings(t *testing.T) {
+	tests := map[string]config.Elasticsearch{
+		"bad_regex": {CollectionIndexMapping: map[string]string{"/(/": "x"}},
+		"missing_default_index": {
+			UnmappedCollectionPolicy: config.UnmappedCollectionPolicyDefaultIndex,
+		},
+		"unknown_policy": {UnmappedCollectionPolicy: "ignore"},
+	}
+	for name, es := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := checkIndexMappings(es); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package bulk
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	dcpElasticsearch "github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+const (
+	dataStreamTimestampLayout = "2006-01-02T15:04:05.000Z07:00"
+	dataStreamIDSeparator     = "::"
+)
+
+// isDataStream reports whether a resolved index name matches one of the
+// cluster's elasticsearch.dataStreams entries. Entries are names or globs, so
+// a pattern such as logs-couchbase-* also covers the names a templated
+// collectionIndexMapping entry renders.
+func (b *Bulk) isDataStream(indexName, clusterKey string) bool {
+	for _, pattern := range b.elasticsearchSettingsForCluster(clusterKey).DataStreams {
+		if ok, _ := path.Match(pattern, indexName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDataStreams checks the dataStreams patterns of every cluster.
+func checkDataStreams(es config.Elasticsearch) error {
+	check := func(prefix string, patterns []string) error {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: pattern %q: %w", prefix, pattern, err)
+			}
+		}
+		return nil
+	}
+	if err := check("elasticsearch.dataStreams", es.DataStreams); err != nil {
+		return err
+	}
+	for clusterKey, cluster := range es.Clusters {
+		if err := check("elasticsearch.clusters."+clusterKey+".dataStreams", cluster.DataStreams); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toDataStreamAction turns an action targeting a data stream into the create
+// action a data stream expects, adding @timestamp from the event time when the
+// source has none. A data stream keeps every event of a document, so the ID
+// of a create is made per event by appending the event's cas; a replay of the
+// event then conflicts with the document already written, see
+// isDuplicateDataStreamEvent. Delete and update actions are left as they are
+// and are rejected by dataStreamActionError.
+func toDataStreamAction(action *document.ESActionDocument, event couchbase.Event) {
+	if action.Type == document.Index {
+		action.Type = document.Create
+	}
+	if action.Type != document.Create {
+		return
+	}
+	action.Source = withTimestamp(action.Source, action.EventTime)
+	if event.Cas != 0 {
+		id := make([]byte, 0, len(action.ID)+len(dataStreamIDSeparator)+20)
+		id = append(id, action.ID...)
+		id = append(id, dataStreamIDSeparator...)
+		action.ID = strconv.AppendUint(id, event.Cas, 10)
+	}
+}
+
+// isDuplicateDataStreamEvent reports whether a failed item is a create on a
+// data stream rejected with 409: the event was written before, e.g. before a
+// rebalance replayed it.
+func (b *Bulk) isDuplicateDataStreamEvent(action *document.ESActionDocument, status int) bool {
+	return action != nil && action.Type == document.Create && status == http.StatusConflict &&
+		b.isDataStream(action.IndexName, action.ClusterKey)
+}
+
+// withTimestamp returns source with an @timestamp field set to eventTime, or
+// source itself when it already has one or is not a JSON object.
+func withTimestamp(source []byte, eventTime time.Time) []byte {
+	value := make([]byte, 0, len(dataStreamTimestampLayout)+2)
+	value = append(value, '"')
+	value = eventTime.UTC().AppendFormat(value, dataStreamTimestampLayout)
+	value = append(value, '"')
+	source, _ = PrependField(source, "@timestamp", value)
+	return source
+}
+
+// PrependField returns source with field set to value, a JSON value, and
+// true, or source itself and false when it already has the field or is not a
+// JSON object.
+func PrependField(source []byte, field string, value []byte) ([]byte, bool) {
+	trimmed := bytes.TrimSpace(source)
+	if len(trimmed) < 2 || trimmed[0] != '{' {
+		return source, false
+	}
+	if jsoniter.Get(trimmed, field).ValueType() != jsoniter.InvalidValue {
+		return source, false
+	}
+
+	name, _ := jsoniter.Marshal(field)
+	result := make([]byte, 0, len(trimmed)+len(name)+len(value)+2)
+	result = append(result, '{')
+	result = append(result, name...)
+	result = append(result, ':')
+	result = append(result, value...)
+	if rest := bytes.TrimSpace(trimmed[1:]); rest[0] != '}' {
+		result = append(result, ',')
+	}
+	return append(result, trimmed[1:]...), true
+}
+
+// dataStreamActionError returns an error wrapping
+// dcpElasticsearch.ErrDataStreamAction for actions a data stream rejects.
+// By-query actions are allowed.
+func dataStreamActionError(action *document.ESActionDocument) error {
+	switch action.Type {
+	case document.Delete, document.DocUpdate, document.ScriptUpdate:
+		return fmt.Errorf("%w: %s action on data stream %q", dcpElasticsearch.ErrDataStreamAction, action.Type, action.IndexName)
+	}
+	return nil
+}
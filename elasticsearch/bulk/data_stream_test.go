@@ -0,0 +1,134 @@
+package bulk
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+func Test_withTimestamp(t *testing.T) {
+	eventTime := time.Date(2024, 5, 1, 10, 30, 0, 123456789, time.FixedZone("", 3*60*60))
+
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"adds_timestamp", `{"a":1}`, `{"@timestamp":"2024-05-01T07:30:00.123Z","a":1}`},
+		{"empty_object", `{}`, `{"@timestamp":"2024-05-01T07:30:00.123Z"}`},
+		{"keeps_existing", `{"@timestamp":"2020-01-01T00:00:00Z"}`, `{"@timestamp":"2020-01-01T00:00:00Z"}`},
+		{"not_an_object", `[1]`, `[1]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(withTimestamp([]byte(tt.source), eventTime)); got != tt.want {
+				t.Fatalf("withTimestamp() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_AddActions_DataStream(t *testing.T) {
+	handler := &errRecordingHandler{}
+	b := buildBulk(nil, &handler.recordingHandler)
+	b.sinkResponseHandler = handler
+	b.config = &config.Config{Elasticsearch: config.Elasticsearch{
+		CollectionIndexMapping: map[string]string{"events": "logs-couchbase"},
+		DataStreams:            []string{"logs-couchbase"},
+	}}
+	b.batchKeys = map[string]int{}
+	b.batchSizeLimit = 100
+	b.batchByteSizeLimit = 1 << 20
+
+	event := couchbase.Event{CollectionName: "events", EventTime: time.Unix(0, 0)}
+	b.AddEventActions(nil, event, []document.ESActionDocument{
+		document.NewIndexAction([]byte("1"), []byte(`{"a":1}`), nil),
+		document.NewDeleteAction([]byte("2"), nil),
+	}, false)
+
+	if len(b.batch) != 1 {
+		t.Fatalf("only the index action must be batched, got %d items", len(b.batch))
+	}
+	action := b.batch[0].Action
+	if action.Type != document.Create || string(action.Source) != `{"@timestamp":"1970-01-01T00:00:00.000Z","a":1}` {
+		t.Fatalf("index action must become a create with @timestamp, got %s %s", action.Type, action.Source)
+	}
+	if len(handler.errs) != 1 || !errors.Is(handler.errs[0], elasticsearch.ErrDataStreamAction) {
+		t.Fatalf("delete must be rejected with ErrDataStreamAction, got %v", handler.errs)
+	}
+}
+
+func Test_isDataStream_MatchesTemplatedIndexNames(t *testing.T) {
+	b := Bulk{config: &config.Config{Elasticsearch: config.Elasticsearch{
+		DataStreams: []string{"logs-couchbase-*", "metrics"},
+	}}}
+
+	tests := []struct {
+		indexName string
+		want      bool
+	}{
+		{"logs-couchbase-events-2024.05", true},
+		{"metrics", true},
+		{"metrics-2024.05", false},
+		{"orders", false},
+	}
+	for _, tt := range tests {
+		if got := b.isDataStream(tt.indexName, ""); got != tt.want {
+			t.Fatalf("isDataStream(%q) = %v, want %v", tt.indexName, got, tt.want)
+		}
+	}
+
+	if err := checkDataStreams(config.Elasticsearch{DataStreams: []string{"logs-["}}); err == nil {
+		t.Fatal("a malformed pattern must be rejected")
+	}
+}
+
+// Every mutation of a document is a new data stream document, and a replayed
+// mutation that was already written is a no-op.
+func Test_AddActions_DataStreamKeepsEveryMutation(t *testing.T) {
+	var body string
+	rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/" {
+			return productCheckResp(), nil
+		}
+		raw, _ := io.ReadAll(req.Body)
+		body = string(raw)
+		return jsonResp(200, `{"errors":true,"items":[`+
+			`{"create":{"_index":"logs-couchbase","_id":"k::1","status":201}},`+
+			`{"create":{"_index":"logs-couchbase","_id":"k::2","status":409,`+
+			`"error":{"type":"version_conflict_engine_exception"}}}]}`), nil
+	})
+	handler := &noopRecordingHandler{}
+	b := byQueryBulk(t, rt, &handler.recordingHandler)
+	b.sinkResponseHandler = handler
+	b.config.Elasticsearch.CollectionIndexMapping = map[string]string{"events": "logs-couchbase"}
+	b.config.Elasticsearch.DataStreams = []string{"logs-couchbase"}
+
+	for cas := uint64(1); cas <= 2; cas++ {
+		event := couchbase.NewMutateEvent(nil, []byte("k"), []byte(`{"n":1}`), "events", cas, time.Unix(0, 0), 0, cas, cas)
+		b.AddEventActions(nil, event, []document.ESActionDocument{document.NewIndexAction(event.Key, event.Value, nil)}, false)
+	}
+
+	if len(b.batch) != 2 {
+		t.Fatalf("both mutations must be batched, got %d items", len(b.batch))
+	}
+	if err := b.bulkRequest(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(body, `"_id":"k::1"`) || !strings.Contains(body, `"_id":"k::2"`) {
+		t.Fatalf("creates must have per-event IDs, got %s", body)
+	}
+	if len(handler.errored) != 0 || len(handler.success) != 2 || len(handler.noops) != 1 {
+		t.Fatalf("expected 2 successes, 1 of them a no-op, got success=%v noops=%v errored=%v",
+			handler.success, handler.noops, handler.errored)
+	}
+}
@@ -0,0 +1,341 @@
+package bulk
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Trendyol/go-dcp/logger"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	dcpElasticsearch "github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+const (
+	// maxResolvedCopies bounds the indexes a deleted document is looked up
+	// in, e.g. monthly indexes it moved between.
+	maxResolvedCopies = 10
+	// maxRecentWrites bounds the documents recentWrites remembers.
+	maxRecentWrites = 100000
+)
+
+type resolvedDocument struct {
+	Routing *string `json:"_routing"`
+	Index   string  `json:"_index"`
+	ID      string  `json:"_id"`
+}
+
+type idsSearchResponse struct {
+	Hits struct {
+		Hits []resolvedDocument `json:"hits"`
+	} `json:"hits"`
+}
+
+// compileDeleteResolution compiles elasticsearch.deleteResolution, which maps
+// collections, with the key syntax of collectionIndexMapping, to the index
+// pattern their deleted documents are looked up in. It returns nil when the
+// mapping is empty.
+func compileDeleteResolution(mapping map[string]string) (*indexMapping, error) {
+	if len(mapping) == 0 {
+		return nil, nil
+	}
+	m, err := compileIndexMapping(mapping)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch.deleteResolution: %w", err)
+	}
+	return m, nil
+}
+
+// resolveDeletes completes the Delete actions of event that have no routing
+// when its collection has an elasticsearch.deleteResolution index pattern:
+// the documents are looked up by ID in the action's index, or the pattern, and
+// each delete is replaced by one for every copy found, with its index and
+// routing. The search is near real-time, so the copies the connector wrote
+// recently are added from recentWrites. A delete of a document found nowhere
+// is kept as is; unresolved maps its position in the result to the indexes it
+// was looked up in, for expandUnresolvedDeletes. Actions whose lookup fails
+// are returned as rejected.
+func (b *Bulk) resolveDeletes(
+	event couchbase.Event,
+	actions []document.ESActionDocument,
+) (
+	resolved []document.ESActionDocument,
+	unresolved map[int]string,
+	rejected []*dcpElasticsearch.SinkResponseHandlerContext,
+) {
+	if b.deleteResolution == nil || !hasUnroutedDelete(actions) {
+		return actions, nil, nil
+	}
+	pattern, ok := b.deleteResolution.lookup(event)
+	if !ok {
+		return actions, nil, nil
+	}
+
+	for i := range actions {
+		action := &actions[i]
+		if action.Type != document.Delete || action.Routing != nil {
+			resolved = append(resolved, *action)
+			continue
+		}
+		esClient, ok := b.esClients[config.NormalizeClusterKey(action.ClusterKey)]
+		if !ok {
+			// resolveAction reports the unknown cluster key.
+			resolved = append(resolved, *action)
+			continue
+		}
+
+		index := pattern
+		if action.IndexName != "" {
+			index = action.IndexName
+		}
+		documents, err := findDocument(esClient, index, action.ID)
+		if err != nil {
+			rejected = append(rejected, &dcpElasticsearch.SinkResponseHandlerContext{
+				Action: action,
+				Err:    fmt.Errorf("resolve delete of %s in %s: %w", action.ID, index, err),
+			})
+			continue
+		}
+		documents = withCopies(documents, b.recentWrites.lookup(action, index))
+		if len(documents) == 0 {
+			logger.Log.Debug("delete of %s not resolved, no document in %s", action.ID, index)
+			if unresolved == nil {
+				unresolved = make(map[int]string)
+			}
+			unresolved[len(resolved)] = index
+			resolved = append(resolved, *action)
+			continue
+		}
+		for _, doc := range documents {
+			copied := *action
+			copied.IndexName = doc.Index
+			copied.Routing = doc.Routing
+			resolved = append(resolved, copied)
+		}
+	}
+	return resolved, unresolved, rejected
+}
+
+// expandUnresolvedDeletes replaces each delete that resolveDeletes found no
+// document for by one for every entry of the same document still waiting in
+// the batch in an index matching the indexes it was looked up in, with that
+// entry's index and routing, so that it replaces the entry. Such a document
+// is not searchable yet. A delete without such an entry would most likely
+// miss, so it is returned as rejected with ErrUnresolvedDelete. It must be
+// called with flushLock held.
+func (b *Bulk) expandUnresolvedDeletes(
+	actions []document.ESActionDocument,
+	unresolved map[int]string,
+) (expanded []document.ESActionDocument, rejected []*dcpElasticsearch.SinkResponseHandlerContext) {
+	expanded = make([]document.ESActionDocument, 0, len(actions))
+	for i := range actions {
+		index, ok := unresolved[i]
+		if !ok {
+			expanded = append(expanded, actions[i])
+			continue
+		}
+		pending := b.pendingCopies(&actions[i], index)
+		if len(pending) == 0 {
+			action := actions[i]
+			rejected = append(rejected, &dcpElasticsearch.SinkResponseHandlerContext{
+				Action: &action,
+				Err:    fmt.Errorf("delete of %s, no document in %s: %w", action.ID, index, dcpElasticsearch.ErrUnresolvedDelete),
+			})
+			continue
+		}
+		for _, entry := range pending {
+			copied := actions[i]
+			copied.IndexName = entry.IndexName
+			copied.Routing = entry.Routing
+			expanded = append(expanded, copied)
+		}
+	}
+	return expanded, rejected
+}
+
+// pendingCopies returns the actions in the batch, after its last by-query
+// barrier, that write the document of action in an index matching index.
+func (b *Bulk) pendingCopies(action *document.ESActionDocument, index string) []*document.ESActionDocument {
+	clusterKey := config.NormalizeClusterKey(action.ClusterKey)
+	positions := slices.Sorted(maps.Values(b.batchKeys))
+	var pending []*document.ESActionDocument
+	for _, i := range positions {
+		entry := b.batch[i].Action
+		if entry == nil || entry.ClusterKey != clusterKey || !bytes.Equal(entry.ID, action.ID) ||
+			!matchesIndexPattern(index, entry.IndexName) {
+			continue
+		}
+		pending = append(pending, entry)
+	}
+	return pending
+}
+
+// matchesIndexPattern reports whether indexName matches one of the comma
+// separated names or wildcard patterns of index.
+func matchesIndexPattern(index, indexName string) bool {
+	for _, pattern := range strings.Split(index, ",") {
+		if ok, _ := path.Match(pattern, indexName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// withCopies returns documents with the copies in an index none of them is
+// in appended.
+func withCopies(documents, copies []resolvedDocument) []resolvedDocument {
+	for _, c := range copies {
+		if !slices.ContainsFunc(documents, func(d resolvedDocument) bool { return d.Index == c.Index }) {
+			documents = append(documents, c)
+		}
+	}
+	return documents
+}
+
+func hasUnroutedDelete(actions []document.ESActionDocument) bool {
+	for i := range actions {
+		if actions[i].Type == document.Delete && actions[i].Routing == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// findDocument returns the index and routing of every copy of the document
+// id in the indexes matching index.
+func findDocument(esClient *elasticsearch.Client, index string, id []byte) ([]resolvedDocument, error) {
+	body, err := jsoniter.Marshal(map[string]any{
+		"query":   map[string]any{"ids": map[string]any{"values": []string{string(id)}}},
+		"_source": false,
+		"size":    maxResolvedCopies,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	allowNoIndices, ignoreUnavailable := true, true
+	r, err := esapi.SearchRequest{
+		Index:             []string{index},
+		Body:              bytes.NewReader(body),
+		AllowNoIndices:    &allowNoIndices,
+		IgnoreUnavailable: &ignoreUnavailable,
+	}.Do(context.Background(), esClient)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if r.IsError() {
+		return nil, fmt.Errorf("search has error %d: %s", r.StatusCode, r.String())
+	}
+	var resp idsSearchResponse
+	if err := jsoniter.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return resp.Hits.Hits, nil
+}
+
+// recentWrites remembers the index and routing of the documents the connector
+// wrote, keyed by cluster and ID, so a delete finds copies the near real-time
+// search does not see yet. The least recently written documents are forgotten
+// first; by then a refresh has made them searchable. A nil *recentWrites
+// remembers nothing.
+type recentWrites struct {
+	entries map[string]*list.Element
+	order   *list.List
+	size    int
+	mu      sync.Mutex
+}
+
+type recentWrite struct {
+	key    string
+	copies []resolvedDocument
+}
+
+func newRecentWrites(size int) *recentWrites {
+	return &recentWrites{entries: make(map[string]*list.Element), order: list.New(), size: size}
+}
+
+func recentWriteKey(clusterKey string, id []byte) string {
+	return clusterKey + "\x00" + string(id)
+}
+
+// record remembers the copy a successful write left, or forgets the copy a
+// successful delete removed.
+func (w *recentWrites) record(action *document.ESActionDocument) {
+	if w == nil || isByQuery(action) {
+		return
+	}
+	key := recentWriteKey(action.ClusterKey, action.ID)
+	copied := resolvedDocument{Index: action.IndexName, ID: string(action.ID), Routing: action.Routing}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	el, ok := w.entries[key]
+	if action.Type == document.Delete {
+		if !ok {
+			return
+		}
+		entry := el.Value.(*recentWrite)
+		entry.copies = slices.DeleteFunc(entry.copies, func(d resolvedDocument) bool { return d.Index == copied.Index })
+		if len(entry.copies) == 0 {
+			w.order.Remove(el)
+			delete(w.entries, key)
+		}
+		return
+	}
+
+	if !ok {
+		el = w.order.PushBack(&recentWrite{key: key})
+		w.entries[key] = el
+		if w.order.Len() > w.size {
+			oldest := w.order.Front()
+			w.order.Remove(oldest)
+			delete(w.entries, oldest.Value.(*recentWrite).key)
+		}
+	} else {
+		w.order.MoveToBack(el)
+	}
+	entry := el.Value.(*recentWrite)
+	for i := range entry.copies {
+		if entry.copies[i].Index == copied.Index {
+			entry.copies[i] = copied
+			return
+		}
+	}
+	entry.copies = append(entry.copies, copied)
+}
+
+// lookup returns the remembered copies of the document of action in an index
+// matching index.
+func (w *recentWrites) lookup(action *document.ESActionDocument, index string) []resolvedDocument {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	el, ok := w.entries[recentWriteKey(config.NormalizeClusterKey(action.ClusterKey), action.ID)]
+	if !ok {
+		return nil
+	}
+	var copies []resolvedDocument
+	for _, c := range el.Value.(*recentWrite).copies {
+		if matchesIndexPattern(index, c.Index) {
+			copies = append(copies, c)
+		}
+	}
+	return copies
+}
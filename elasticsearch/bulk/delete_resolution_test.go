@@ -0,0 +1,187 @@
+package bulk
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+func Test_AddActions_ResolvesDeletes(t *testing.T) {
+	var searched []string
+	rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/" {
+			return productCheckResp(), nil
+		}
+		body, _ := io.ReadAll(req.Body)
+		searched = append(searched, req.URL.Path)
+		switch {
+		case strings.Contains(string(body), `"moved"`):
+			return jsonResp(200, `{"hits":{"hits":[`+
+				`{"_index":"orders-2024.01","_id":"moved","_routing":"c1"},`+
+				`{"_index":"orders-2024.02","_id":"moved","_routing":"c1"}]}}`), nil
+		case strings.Contains(string(body), `"broken"`):
+			return jsonResp(500, `{"error":"search failed"}`), nil
+		}
+		return jsonResp(200, `{"hits":{"hits":[]}}`), nil
+	})
+	handler := &errRecordingHandler{}
+	b := byQueryBulk(t, rt, &handler.recordingHandler)
+	b.sinkResponseHandler = handler
+	b.config.Elasticsearch.CollectionIndexMapping = map[string]string{"orders": `orders-{{ field "month" }}`}
+	b.config.Elasticsearch.CollectionRoutingMapping = map[string]string{"orders": `{{ field "customer" }}`}
+	b.deleteResolution, _ = compileDeleteResolution(map[string]string{"orders": "orders-*"})
+
+	routed := document.DeleteAction([]byte("routed")).Index("orders-2024.03").Routing("c2").Build()
+	b.AddEventActions(nil, couchbase.Event{CollectionName: "orders", IsDeleted: true}, []document.ESActionDocument{
+		document.NewDeleteAction([]byte("moved"), nil),
+		document.NewDeleteAction([]byte("missing"), nil),
+		document.NewDeleteAction([]byte("broken"), nil),
+		routed,
+	}, false)
+
+	if len(searched) != 3 || searched[0] != "/orders-*/_search" {
+		t.Fatalf("expected a search per unrouted delete in the pattern, got %v", searched)
+	}
+	var got []string
+	for _, item := range b.batch {
+		got = append(got, item.Action.IndexName+"/"+string(item.Action.ID)+"@"+*item.Action.Routing)
+	}
+	want := "orders-2024.01/moved@c1,orders-2024.02/moved@c1,orders-2024.03/routed@c2"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("batch = %v, want %s", got, want)
+	}
+	// The delete found nowhere would most likely miss, so it is reported
+	// rather than sent.
+	if strings.Join(handler.errored, ",") != "broken,missing" {
+		t.Fatalf("expected the failed lookup and the unresolved delete to be rejected, got %v", handler.errored)
+	}
+}
+
+// A document indexed earlier in the same batch is not searchable yet: its
+// delete replaces the pending entry, with the entry's index and routing.
+func Test_AddActions_UnresolvedDeleteReplacesPendingWrite(t *testing.T) {
+	rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/" {
+			return productCheckResp(), nil
+		}
+		return jsonResp(200, `{"hits":{"hits":[]}}`), nil
+	})
+	handler := &errRecordingHandler{}
+	b := byQueryBulk(t, rt, &handler.recordingHandler)
+	b.sinkResponseHandler = handler
+	b.config.Elasticsearch.CollectionIndexMapping = map[string]string{"orders": `orders-{{ field "month" }}`}
+	b.config.Elasticsearch.CollectionRoutingMapping = map[string]string{"orders": `{{ field "customer" }}`}
+	b.deleteResolution, _ = compileDeleteResolution(map[string]string{"orders": "orders-*"})
+
+	b.AddEventActions(nil, couchbase.Event{
+		CollectionName: "orders",
+		IsMutated:      true,
+		Value:          []byte(`{"month":"2024.05","customer":"c1"}`),
+	}, []document.ESActionDocument{
+		document.NewIndexAction([]byte("o1"), []byte(`{"month":"2024.05","customer":"c1"}`), nil),
+	}, false)
+	b.AddEventActions(nil, couchbase.Event{CollectionName: "orders", IsDeleted: true}, []document.ESActionDocument{
+		document.NewDeleteAction([]byte("o1"), nil),
+	}, false)
+
+	if len(handler.errored) != 0 {
+		t.Fatalf("unexpected rejections: %v", handler.errored)
+	}
+	if len(b.batch) != 1 {
+		t.Fatalf("the delete must replace the pending write, got %d items", len(b.batch))
+	}
+	action := b.batch[0].Action
+	if action.Type != document.Delete || action.IndexName != "orders-2024.05" || action.Routing == nil || *action.Routing != "c1" {
+		t.Fatalf("batch = %s %s/%s, want Delete orders-2024.05/o1@c1", action.Type, action.IndexName, action.ID)
+	}
+}
+
+// A delete found nowhere and not pending is passed to OnError instead of
+// being sent to the collection's index, where it would most likely miss.
+func Test_AddActions_UnresolvedDeleteIsRejected(t *testing.T) {
+	rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/" {
+			return productCheckResp(), nil
+		}
+		return jsonResp(200, `{"hits":{"hits":[]}}`), nil
+	})
+	handler := &errRecordingHandler{}
+	b := byQueryBulk(t, rt, &handler.recordingHandler)
+	b.sinkResponseHandler = handler
+	b.config.Elasticsearch.CollectionIndexMapping = map[string]string{"orders": "orders"}
+	b.deleteResolution, _ = compileDeleteResolution(map[string]string{"orders": "orders,orders-archive-*"})
+
+	b.AddEventActions(nil, couchbase.Event{CollectionName: "orders", IsDeleted: true}, []document.ESActionDocument{
+		document.NewDeleteAction([]byte("o1"), nil),
+	}, false)
+
+	if len(b.batch) != 0 || len(handler.errs) != 1 || !errors.Is(handler.errs[0], elasticsearch.ErrUnresolvedDelete) {
+		t.Fatalf("expected the delete to be rejected with ErrUnresolvedDelete, got %d items and errors %v", len(b.batch), handler.errs)
+	}
+}
+
+// A document the connector wrote in an earlier batch may not be searchable
+// yet: the delete takes its index and routing from the recent writes.
+func Test_AddActions_ResolvesDeletesFromRecentWrites(t *testing.T) {
+	rt := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/" {
+			return productCheckResp(), nil
+		}
+		return jsonResp(200, `{"hits":{"hits":[]}}`), nil
+	})
+	handler := &errRecordingHandler{}
+	b := byQueryBulk(t, rt, &handler.recordingHandler)
+	b.sinkResponseHandler = handler
+	b.config.Elasticsearch.CollectionIndexMapping = map[string]string{"orders": `orders-{{ field "month" }}`}
+	b.deleteResolution, _ = compileDeleteResolution(map[string]string{"orders": "orders-*"})
+	b.recentWrites = newRecentWrites(10)
+
+	written := document.IndexAction([]byte("o1")).Source([]byte(`{}`)).Index("orders-2024.05").Routing("c1").Build()
+	b.finalizeProcess([]*document.ESActionDocument{&written}, nil, nil)
+	b.AddEventActions(nil, couchbase.Event{CollectionName: "orders", IsDeleted: true}, []document.ESActionDocument{
+		document.NewDeleteAction([]byte("o1"), nil),
+	}, false)
+
+	if len(handler.errs) != 0 || len(b.batch) != 1 {
+		t.Fatalf("expected the delete to be resolved, got %d items and errors %v", len(b.batch), handler.errs)
+	}
+	action := b.batch[0].Action
+	if action.IndexName != "orders-2024.05" || action.Routing == nil || *action.Routing != "c1" {
+		t.Fatalf("batch = %s/%s, want orders-2024.05/o1@c1", action.IndexName, action.ID)
+	}
+}
+
+func Test_recentWrites(t *testing.T) {
+	w := newRecentWrites(2)
+	write := func(id, index string) document.ESActionDocument {
+		return document.IndexAction([]byte(id)).Source([]byte(`{}`)).Index(index).Build()
+	}
+	lookup := func(id, index string) int {
+		action := document.NewDeleteAction([]byte(id), nil)
+		return len(w.lookup(&action, index))
+	}
+
+	for _, action := range []document.ESActionDocument{
+		write("a", "orders-1"), write("a", "orders-2"), write("b", "orders-1"), write("a", "orders-2"), write("c", "orders-1"),
+	} {
+		w.record(&action)
+	}
+	if lookup("a", "orders-*") != 2 || lookup("a", "orders-1") != 1 || lookup("c", "orders-*") != 1 {
+		t.Fatal("expected the copies of a and c")
+	}
+	if lookup("b", "orders-*") != 0 {
+		t.Fatal("the least recently written document must be forgotten")
+	}
+
+	deleted := document.DeleteAction([]byte("a")).Index("orders-1").Build()
+	w.record(&deleted)
+	if lookup("a", "orders-*") != 1 {
+		t.Fatal("a successful delete must forget its copy")
+	}
+}
@@ -0,0 +1,61 @@
+package bulk
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+)
+
+// indexEntry returns the entry of a per-index setting (indexPipelineMapping,
+// indexUpdateOptions) for a resolved index name. Keys are names or globs like
+// dataStreams entries, so orders-* covers the names a templated
+// collectionIndexMapping entry renders. An exact key wins; otherwise the
+// longest matching pattern is used, the first in key order on a tie.
+func indexEntry[V any](mapping map[string]V, indexName string) (V, bool) {
+	if entry, ok := mapping[indexName]; ok {
+		return entry, true
+	}
+	best, found := "", false
+	for _, pattern := range slices.Sorted(maps.Keys(mapping)) {
+		if ok, _ := path.Match(pattern, indexName); ok && (!found || len(pattern) > len(best)) {
+			best, found = pattern, true
+		}
+	}
+	if !found {
+		var zero V
+		return zero, false
+	}
+	return mapping[best], true
+}
+
+// checkIndexPatterns checks the indexPipelineMapping and indexUpdateOptions
+// keys of every cluster.
+func checkIndexPatterns(es config.Elasticsearch) error {
+	check := func(prefix string, patterns []string) error {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("%s: pattern %q: %w", prefix, pattern, err)
+			}
+		}
+		return nil
+	}
+	checkCluster := func(prefix string, cluster config.Elasticsearch) error {
+		if err := check(prefix+"indexPipelineMapping", slices.Collect(maps.Keys(cluster.IndexPipelineMapping))); err != nil {
+			return err
+		}
+		return check(prefix+"indexUpdateOptions", slices.Collect(maps.Keys(cluster.IndexUpdateOptions)))
+	}
+
+	if err := checkCluster("elasticsearch.", es); err != nil {
+		return err
+	}
+	for clusterKey, cluster := range es.Clusters {
+		if err := checkCluster("elasticsearch.clusters."+clusterKey+".", cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package bulk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+func Test_indexEntry(t *testing.T) {
+	mapping := map[string]string{"orders-2024.01": "exact", "orders-*": "orders", "*": "any"}
+
+	cases := []struct {
+		index, want string
+	}{
+		{"orders-2024.01", "exact"},
+		{"orders-2024.02", "orders"},
+		{"users", "any"},
+	}
+	for _, c := range cases {
+		if got, ok := indexEntry(mapping, c.index); !ok || got != c.want {
+			t.Fatalf("indexEntry(%q) = %q, %v, want %q", c.index, got, ok, c.want)
+		}
+	}
+	if _, ok := indexEntry(map[string]string{"orders-*": "orders"}, "users"); ok {
+		t.Fatal("an index no key matches must have no entry")
+	}
+}
+
+func Test_resolveAction_TemplatedIndexSettings(t *testing.T) {
+	retryOnConflict := 3
+	b := Bulk{config: &config.Config{Elasticsearch: config.Elasticsearch{
+		CollectionIndexMapping: map[string]string{"orders": `orders-{{ .EventTime | date "2006.01" }}`},
+		IndexPipelineMapping:   map[string]string{"orders-*": "orders-pipeline"},
+		IndexUpdateOptions:     map[string]document.UpdateOptions{"orders-*": {RetryOnConflict: &retryOnConflict}},
+	}}}
+	event := couchbase.Event{CollectionName: "orders", EventTime: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}
+
+	action := document.NewIndexAction([]byte("1"), []byte(`{}`), nil)
+	if err := b.resolveAction(&action, event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if action.IndexName != "orders-2024.05" || action.Pipeline != "orders-pipeline" {
+		t.Fatalf("unexpected index %q pipeline %q", action.IndexName, action.Pipeline)
+	}
+
+	action = document.NewDocUpdateAction([]byte("1"), []byte(`{}`), nil, "")
+	if err := b.resolveAction(&action, event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if action.UpdateOptions == nil || *action.UpdateOptions.RetryOnConflict != 3 {
+		t.Fatalf("index defaults must apply to templated indices, got %+v", action.UpdateOptions)
+	}
+}
+
+func Test_checkIndexPatterns(t *testing.T) {
+	valid := config.Elasticsearch{
+		IndexPipelineMapping: map[string]string{"orders-*": "p"},
+		IndexUpdateOptions:   map[string]document.UpdateOptions{"users": {}},
+	}
+	if err := checkIndexPatterns(valid); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	invalid := config.Elasticsearch{Clusters: map[string]config.Elasticsearch{
+		"analytics": {IndexUpdateOptions: map[string]document.UpdateOptions{"orders-[": {}}},
+	}}
+	err := checkIndexPatterns(invalid)
+	if err == nil || err.Error() != `elasticsearch.clusters.analytics.indexUpdateOptions: pattern "orders-[": syntax error in pattern` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
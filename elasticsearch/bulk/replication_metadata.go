@@ -0,0 +1,107 @@
+package bulk
+
+import (
+	"fmt"
+	"strconv"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+// ReplicationMetadata adds the Couchbase provenance of an event as an object
+// to document sources. It backs elasticsearch.replicationMetadata and the
+// WithMetadata mapper middleware.
+type ReplicationMetadata struct {
+	field  string
+	group  string
+	fields []string
+}
+
+// NewReplicationMetadata returns the ReplicationMetadata for m. Its fields are
+// written in the order m lists them; group is the value of the group field.
+func NewReplicationMetadata(m config.ReplicationMetadata, group string) (*ReplicationMetadata, error) {
+	config.ApplyReplicationMetadataDefaults(&m)
+	for _, field := range m.Fields {
+		switch field {
+		case config.ReplicationMetadataCollection, config.ReplicationMetadataCas, config.ReplicationMetadataSeqNo,
+			config.ReplicationMetadataVbID, config.ReplicationMetadataRevNo, config.ReplicationMetadataEventTime,
+			config.ReplicationMetadataGroup:
+		default:
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+	}
+	return &ReplicationMetadata{field: m.Field, fields: m.Fields, group: group}, nil
+}
+
+func newReplicationMetadata(mappings map[string]config.ReplicationMetadata, group string) (map[string]*ReplicationMetadata, error) {
+	compiled := make(map[string]*ReplicationMetadata, len(mappings))
+	for collection, m := range mappings {
+		r, err := NewReplicationMetadata(m, group)
+		if err != nil {
+			return nil, fmt.Errorf("elasticsearch.replicationMetadata.%s: %w", collection, err)
+		}
+		compiled[collection] = r
+	}
+	return compiled, nil
+}
+
+// addReplicationMetadata adds the replication metadata configured for the
+// event's collection to the source of index, create and doc update actions.
+func (b *Bulk) addReplicationMetadata(action *document.ESActionDocument, event couchbase.Event) {
+	switch action.Type {
+	case document.Index, document.Create, document.DocUpdate:
+	default:
+		return
+	}
+	m, ok := collectionEntry(b.replicationMetadata, event)
+	if !ok {
+		return
+	}
+	action.Source, _ = m.Add(action.Source, event)
+}
+
+// Add returns source with the metadata of event under the field and true, or
+// source itself and false when it already has the field or is not a JSON
+// object.
+func (m *ReplicationMetadata) Add(source []byte, event couchbase.Event) ([]byte, bool) {
+	return PrependField(source, m.field, m.object(event))
+}
+
+// object returns the metadata of event as a JSON object.
+func (m *ReplicationMetadata) object(event couchbase.Event) []byte {
+	result := make([]byte, 0, 160)
+	result = append(result, '{')
+	for i, field := range m.fields {
+		if i > 0 {
+			result = append(result, ',')
+		}
+		result = append(result, '"')
+		result = append(result, field...)
+		result = append(result, `":`...)
+
+		switch field {
+		case config.ReplicationMetadataCollection:
+			name, _ := jsoniter.Marshal(event.CollectionName)
+			result = append(result, name...)
+		case config.ReplicationMetadataCas:
+			result = strconv.AppendUint(result, event.Cas, 10)
+		case config.ReplicationMetadataSeqNo:
+			result = strconv.AppendUint(result, event.SeqNo, 10)
+		case config.ReplicationMetadataVbID:
+			result = strconv.AppendUint(result, uint64(event.VbID), 10)
+		case config.ReplicationMetadataRevNo:
+			result = strconv.AppendUint(result, event.RevNo, 10)
+		case config.ReplicationMetadataEventTime:
+			result = append(result, '"')
+			result = event.EventTime.UTC().AppendFormat(result, dataStreamTimestampLayout)
+			result = append(result, '"')
+		case config.ReplicationMetadataGroup:
+			name, _ := jsoniter.Marshal(m.group)
+			result = append(result, name...)
+		}
+	}
+	return append(result, '}')
+}
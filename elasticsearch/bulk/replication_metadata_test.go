@@ -0,0 +1,82 @@
+package bulk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+func Test_resolveAction_ReplicationMetadata(t *testing.T) {
+	mappings := map[string]config.ReplicationMetadata{
+		"orders": {},
+		"users":  {Field: "meta", Fields: []string{config.ReplicationMetadataCas, config.ReplicationMetadataGroup}},
+	}
+	compiled, err := newReplicationMetadata(mappings, "orders-es")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := &config.Config{Elasticsearch: config.Elasticsearch{
+		CollectionIndexMapping: map[string]string{"orders": "orders", "users": "users", "logs": "logs"},
+	}}
+	b := Bulk{config: cfg, replicationMetadata: compiled}
+
+	event := couchbase.Event{
+		CollectionName: "orders", Cas: 10, SeqNo: 3, VbID: 7, RevNo: 2,
+		EventTime: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name       string
+		collection string
+		action     document.ESActionDocument
+		want       string
+	}{
+		{
+			name: "index", collection: "orders",
+			action: document.NewIndexAction([]byte("1"), []byte(`{"a":1}`), nil),
+			want:   `{"_cb":{"cas":10,"seqNo":3,"vbId":7,"revNo":2,"eventTime":"2024-05-01T10:00:00.000Z","group":"orders-es"},"a":1}`,
+		},
+		{
+			name: "doc_update_selected_fields", collection: "users",
+			action: document.DocUpdateAction([]byte("1")).Source([]byte(`{"a":1}`)).Build(),
+			want:   `{"meta":{"cas":10,"group":"orders-es"},"a":1}`,
+		},
+		{
+			name: "field_already_set", collection: "users",
+			action: document.NewIndexAction([]byte("1"), []byte(`{"meta":"mine"}`), nil),
+			want:   `{"meta":"mine"}`,
+		},
+		{
+			name: "not_configured", collection: "logs",
+			action: document.NewIndexAction([]byte("1"), []byte(`{"a":1}`), nil),
+			want:   `{"a":1}`,
+		},
+		{
+			name: "script_update", collection: "orders",
+			action: document.NewScriptUpdateAction([]byte("1"), []byte(`{"source":"ctx._source.n++"}`), nil),
+			want:   `{"source":"ctx._source.n++"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event.CollectionName = tt.collection
+			action := tt.action
+			if err := b.resolveAction(&action, event); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(action.Source) != tt.want {
+				t.Fatalf("Source = %s, want %s", action.Source, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newReplicationMetadata_UnknownField(t *testing.T) {
+	_, err := newReplicationMetadata(map[string]config.ReplicationMetadata{"orders": {Fields: []string{"flags"}}}, "")
+	if err == nil {
+		t.Fatal("unknown field must be rejected")
+	}
+}
@@ -2,14 +2,38 @@ package bulk
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"time"
 
 	"github.com/valyala/fasthttp"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
 )
 
+// checkRetry rejects conflictRetries without retry.enabled: conflicted items
+// are only remapped by the retry layer, so the setting would silently do
+// nothing on the plain request path.
+func checkRetry(es config.Elasticsearch) error {
+	check := func(prefix string, retry *config.Retry) error {
+		if retry != nil && retry.ConflictRetries > 0 && !retry.Enabled {
+			return fmt.Errorf("%s.conflictRetries requires %s.enabled", prefix, prefix)
+		}
+		return nil
+	}
+	if err := check("elasticsearch.retry", es.Retry); err != nil {
+		return err
+	}
+	for clusterKey, cluster := range es.Clusters {
+		if err := check("elasticsearch.clusters."+clusterKey+".retry", cluster.Retry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // isRetryableStatus reports whether an HTTP status code is configured as
 // retryable.
 func isRetryableStatus(status int, retryOn []int) bool {
@@ -9,6 +9,8 @@ import (
 
 	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/valyala/fasthttp"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
 )
 
 func Test_isRetryableStatus(t *testing.T) {
@@ -117,3 +119,30 @@ func newResponse(body string) *esapi.Response {
 		Body:       io.NopCloser(strings.NewReader(body)),
 	}
 }
+
+func Test_checkRetry(t *testing.T) {
+	tests := []struct {
+		es      config.Elasticsearch
+		name    string
+		wantErr bool
+	}{
+		{name: "no_retry"},
+		{name: "enabled", es: config.Elasticsearch{Retry: &config.Retry{Enabled: true, ConflictRetries: 2}}},
+		{name: "disabled", es: config.Elasticsearch{Retry: &config.Retry{ConflictRetries: 2}}, wantErr: true},
+		{
+			name: "disabled_in_cluster",
+			es: config.Elasticsearch{
+				Retry:    &config.Retry{Enabled: true},
+				Clusters: map[string]config.Elasticsearch{"eu": {Retry: &config.Retry{ConflictRetries: 1}}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkRetry(tt.es); (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
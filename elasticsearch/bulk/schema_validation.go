@@ -0,0 +1,216 @@
+package bulk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	dcpElasticsearch "github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// schemaValidator checks the source of index and create actions against the
+// JSON Schema of their collection (elasticsearch.schemaValidation). A schema
+// belongs to a collectionIndexMapping entry: the event's collection selects
+// the entry the way it selects the index, and the entry's schema, if any, is
+// used.
+type schemaValidator struct {
+	mapping         *indexMapping
+	compiler        *jsonschema.Compiler
+	schemas         map[string]*jsonschema.Schema
+	quarantineIndex string
+	mu              sync.Mutex
+	quarantine      bool
+}
+
+func newSchemaValidator(v *config.SchemaValidation, collectionIndexMapping map[string]string) (*schemaValidator, error) {
+	if v == nil || len(v.Schemas) == 0 {
+		return nil, nil
+	}
+
+	val := &schemaValidator{
+		compiler:        jsonschema.NewCompiler(),
+		schemas:         make(map[string]*jsonschema.Schema, len(v.Schemas)),
+		quarantineIndex: v.QuarantineIndex,
+	}
+	switch v.Policy {
+	case "", config.SchemaViolationPolicyReject:
+	case config.SchemaViolationPolicyQuarantine:
+		if v.QuarantineIndex == "" {
+			return nil, fmt.Errorf("elasticsearch.schemaValidation.quarantineIndex is required with policy %q", v.Policy)
+		}
+		val.quarantine = true
+	default:
+		return nil, fmt.Errorf("elasticsearch.schemaValidation.policy: unknown policy %q", v.Policy)
+	}
+
+	// Every collectionIndexMapping key is compiled, with an empty path when it
+	// has no schema, so an event never falls through to the schema of a
+	// broader key than the one its index comes from.
+	entries := make(map[string]string, len(collectionIndexMapping))
+	for key := range collectionIndexMapping {
+		entries[key] = v.Schemas[key]
+	}
+	for key := range v.Schemas {
+		if _, ok := collectionIndexMapping[key]; !ok {
+			return nil, fmt.Errorf("elasticsearch.schemaValidation.schemas.%s: not a key of elasticsearch.collectionIndexMapping", key)
+		}
+	}
+	mapping, err := compileIndexMapping(entries)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch.schemaValidation.schemas: %w", err)
+	}
+	val.mapping = mapping
+
+	// Paths expanded from a pattern key are only known per event; the others
+	// are compiled now so a broken schema fails the connector at startup.
+	for collection, path := range v.Schemas {
+		if strings.Contains(path, "$") {
+			continue
+		}
+		if _, err := val.schema(path); err != nil {
+			return nil, fmt.Errorf("elasticsearch.schemaValidation.schemas.%s: %w", collection, err)
+		}
+	}
+	return val, nil
+}
+
+// schema returns the compiled schema at path, compiling it on first use.
+func (v *schemaValidator) schema(path string) (*jsonschema.Schema, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if sch, ok := v.schemas[path]; ok {
+		return sch, nil
+	}
+	sch, err := v.compiler.Compile(path)
+	if err != nil {
+		return nil, err
+	}
+	v.schemas[path] = sch
+	return sch, nil
+}
+
+// validate returns a *dcpElasticsearch.SchemaViolationError when the source
+// of action does not match the schema of the event's collection, or nil.
+func (v *schemaValidator) validate(action *document.ESActionDocument, event couchbase.Event) error {
+	if action.Type != document.Index && action.Type != document.Create {
+		return nil
+	}
+	path, ok := v.mapping.lookup(event)
+	if !ok || path == "" {
+		return nil
+	}
+
+	sch, err := v.schema(path)
+	if err != nil {
+		return fmt.Errorf("schema of collection %s: %w", event.CollectionName, err)
+	}
+	instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(action.Source))
+	if err != nil {
+		return &dcpElasticsearch.SchemaViolationError{Schema: path, Reason: "source is not valid JSON"}
+	}
+
+	var validationErr *jsonschema.ValidationError
+	if err := sch.Validate(instance); errors.As(err, &validationErr) {
+		return schemaViolation(path, validationErr)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// schemaViolation describes the first leaf error of a validation error, the
+// keyword that actually failed.
+func schemaViolation(path string, err *jsonschema.ValidationError) *dcpElasticsearch.SchemaViolationError {
+	for len(err.Causes) > 0 {
+		err = err.Causes[0]
+	}
+
+	var schemaLocation string
+	if _, fragment, ok := strings.Cut(err.SchemaURL, "#"); ok {
+		schemaLocation = fragment
+	}
+	for _, keyword := range err.ErrorKind.KeywordPath() {
+		schemaLocation += "/" + keyword
+	}
+
+	var instanceLocation string
+	for _, token := range err.InstanceLocation {
+		instanceLocation += "/" + token
+	}
+
+	reason := err.Error()
+	if unit := err.BasicOutput(); unit.Error != nil {
+		reason = unit.Error.String()
+	}
+	return &dcpElasticsearch.SchemaViolationError{
+		Schema:           path,
+		SchemaLocation:   schemaLocation,
+		InstanceLocation: instanceLocation,
+		Reason:           reason,
+	}
+}
+
+// checkSchema validates action against its collection's schema. A violating
+// action is counted and, with the quarantine policy, replaced by its
+// quarantine document, which is reported with quarantined; otherwise the
+// violation is returned.
+func (b *Bulk) checkSchema(action *document.ESActionDocument, event couchbase.Event) (quarantined bool, err error) {
+	err = b.schemaValidator.validate(action, event)
+	if err == nil {
+		return false, nil
+	}
+
+	b.countSchemaViolation(action.IndexName)
+	var violation *dcpElasticsearch.SchemaViolationError
+	if !b.schemaValidator.quarantine || !errors.As(err, &violation) {
+		return false, err
+	}
+	*action = quarantineAction(action, event, violation, b.schemaValidator.quarantineIndex)
+	return true, nil
+}
+
+type quarantineDocument struct {
+	Index            string `json:"index"`
+	ID               string `json:"id"`
+	Collection       string `json:"collection"`
+	Schema           string `json:"schema"`
+	SchemaLocation   string `json:"schemaLocation"`
+	InstanceLocation string `json:"instanceLocation"`
+	Reason           string `json:"reason"`
+	Source           string `json:"source"`
+}
+
+// quarantineAction indexes a violating document into quarantineIndex under
+// the same ID. The original source is kept as a string so the quarantine
+// index does not inherit its mapping problems.
+func quarantineAction(
+	action *document.ESActionDocument,
+	event couchbase.Event,
+	violation *dcpElasticsearch.SchemaViolationError,
+	quarantineIndex string,
+) document.ESActionDocument {
+	source, _ := jsoniter.Marshal(quarantineDocument{
+		Index:            action.IndexName,
+		ID:               string(action.ID),
+		Collection:       event.CollectionName,
+		Schema:           violation.Schema,
+		SchemaLocation:   violation.SchemaLocation,
+		InstanceLocation: violation.InstanceLocation,
+		Reason:           violation.Reason,
+		Source:           string(action.Source),
+	})
+
+	quarantined := document.IndexAction(action.ID).Source(source).Index(quarantineIndex).Build()
+	quarantined.ClusterKey = action.ClusterKey
+	quarantined.EventTime = action.EventTime
+	return quarantined
+}
@@ -0,0 +1,171 @@
+package bulk
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const orderSchema = `{
+	"type": "object",
+	"required": ["id"],
+	"properties": {
+		"id": {"type": "string"},
+		"price": {"type": "number"}
+	}
+}`
+
+func writeSchema(t *testing.T, schema string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "order.json")
+	if err := os.WriteFile(path, []byte(schema), 0o600); err != nil {
+		t.Fatalf("write schema: %v", err)
+	}
+	return path
+}
+
+func schemaValidationBulk(t *testing.T, v *config.SchemaValidation) (*Bulk, *errRecordingHandler) {
+	t.Helper()
+	val, err := newSchemaValidator(v, map[string]string{"orders": "orders"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler := &errRecordingHandler{}
+	b := buildBulk(nil, &handler.recordingHandler)
+	b.sinkResponseHandler = handler
+	b.config = &config.Config{Elasticsearch: config.Elasticsearch{
+		CollectionIndexMapping: map[string]string{"orders": "orders"},
+	}}
+	b.schemaValidator = val
+	b.batchKeys = map[string]int{}
+	b.batchSizeLimit = 100
+	b.batchByteSizeLimit = 1 << 20
+	return b, handler
+}
+
+func Test_AddActions_SchemaViolationRejected(t *testing.T) {
+	b, handler := schemaValidationBulk(t, &config.SchemaValidation{
+		Schemas: map[string]string{"orders": writeSchema(t, orderSchema)},
+	})
+
+	b.AddEventActions(nil, couchbase.Event{CollectionName: "orders"}, []document.ESActionDocument{
+		document.NewIndexAction([]byte("ok"), []byte(`{"id":"1","price":3.5}`), nil),
+		document.NewIndexAction([]byte("bad"), []byte(`{"id":"2","price":"cheap"}`), nil),
+	}, false)
+
+	if len(b.batch) != 1 || string(b.batch[0].Action.ID) != "ok" {
+		t.Fatalf("only the valid action must be batched, got %d items", len(b.batch))
+	}
+	if len(handler.errs) != 1 {
+		t.Fatalf("expected 1 rejected action, got %v", handler.errored)
+	}
+	var violation *elasticsearch.SchemaViolationError
+	if !errors.As(handler.errs[0], &violation) {
+		t.Fatalf("expected a SchemaViolationError, got %v", handler.errs[0])
+	}
+	if violation.SchemaLocation != "/properties/price/type" || violation.InstanceLocation != "/price" {
+		t.Fatalf("unexpected violation: %+v", violation)
+	}
+	if got := b.metric.SchemaViolationCounter["orders"]; got != 1 {
+		t.Fatalf("violations = %d, want 1", got)
+	}
+}
+
+func Test_AddActions_SchemaViolationQuarantined(t *testing.T) {
+	b, handler := schemaValidationBulk(t, &config.SchemaValidation{
+		Schemas:         map[string]string{"orders": writeSchema(t, orderSchema)},
+		Policy:          config.SchemaViolationPolicyQuarantine,
+		QuarantineIndex: "quarantine",
+	})
+
+	b.AddEventActions(nil, couchbase.Event{CollectionName: "orders"}, []document.ESActionDocument{
+		document.NewIndexAction([]byte("bad"), []byte(`{"price":1}`), nil),
+		document.NewDeleteAction([]byte("gone"), nil),
+	}, false)
+
+	if len(handler.errs) != 0 {
+		t.Fatalf("quarantined actions must not be rejected, got %v", handler.errs)
+	}
+	if len(b.batch) != 2 || b.batch[0].Action.IndexName != "quarantine" || b.batch[1].Action.IndexName != "orders" {
+		t.Fatalf("expected the violating action in the quarantine index and the delete untouched, got %d items", len(b.batch))
+	}
+	var doc quarantineDocument
+	if err := jsoniter.Unmarshal(b.batch[0].Action.Source, &doc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if doc.Index != "orders" || doc.ID != "bad" || doc.SchemaLocation != "/required" || doc.Source != `{"price":1}` {
+		t.Fatalf("unexpected quarantine document: %+v", doc)
+	}
+}
+
+func Test_newSchemaValidator_Errors(t *testing.T) {
+	path := writeSchema(t, orderSchema)
+	tests := []struct {
+		v    *config.SchemaValidation
+		name string
+	}{
+		{&config.SchemaValidation{Schemas: map[string]string{"orders": path}, Policy: "drop"}, "unknown policy"},
+		{&config.SchemaValidation{Schemas: map[string]string{"orders": path}, Policy: config.SchemaViolationPolicyQuarantine}, "no quarantine index"},
+		{&config.SchemaValidation{Schemas: map[string]string{"orders": path + ".missing"}}, "missing schema"},
+		{&config.SchemaValidation{Schemas: map[string]string{"orders": writeSchema(t, `{"type": 1}`)}}, "invalid schema"},
+		{&config.SchemaValidation{Schemas: map[string]string{"invoices": path}}, "no collectionIndexMapping entry"},
+	}
+	for _, tt := range tests {
+		if _, err := newSchemaValidator(tt.v, map[string]string{"orders": "orders"}); err == nil {
+			t.Fatalf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+// The schema sees the source the mapper built, before replication metadata
+// is added, so a closed schema does not have to list _cb.
+func Test_AddActions_SchemaValidatesMapperSource(t *testing.T) {
+	b, handler := schemaValidationBulk(t, &config.SchemaValidation{
+		Schemas: map[string]string{"orders": writeSchema(t, `{"type": "object", "additionalProperties": false,
+			"properties": {"id": {"type": "string"}}}`)},
+	})
+	metadata, err := newReplicationMetadata(map[string]config.ReplicationMetadata{"orders": {}}, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.replicationMetadata = metadata
+
+	b.AddEventActions(nil, couchbase.Event{CollectionName: "orders", Cas: 1}, []document.ESActionDocument{
+		document.NewIndexAction([]byte("1"), []byte(`{"id":"1"}`), nil),
+	}, false)
+
+	if len(handler.errs) != 0 || len(b.batch) != 1 {
+		t.Fatalf("the mapper's source must be valid, got errors %v", handler.errs)
+	}
+	if !bytes.Contains(b.batch[0].Action.Source, []byte(`"_cb"`)) {
+		t.Fatalf("replication metadata must still be added, got %s", b.batch[0].Action.Source)
+	}
+}
+
+// A schema belongs to the collectionIndexMapping entry the index comes from:
+// an event mapped by a scope.collection entry without a schema is not checked
+// against the schema of the bare collection entry.
+func Test_schemaValidator_FollowsIndexMappingEntry(t *testing.T) {
+	val, err := newSchemaValidator(&config.SchemaValidation{
+		Schemas: map[string]string{"orders": writeSchema(t, orderSchema)},
+	}, map[string]string{"orders": "orders", "archive.orders": "archived-orders"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	action := document.NewIndexAction([]byte("1"), []byte(`{}`), nil)
+	if err := val.validate(&action, couchbase.Event{ScopeName: "archive", CollectionName: "orders"}); err != nil {
+		t.Fatalf("the archive.orders entry has no schema, got %v", err)
+	}
+	if err := val.validate(&action, couchbase.Event{ScopeName: "sales", CollectionName: "orders"}); err == nil {
+		t.Fatal("the orders entry's schema must apply to sales.orders")
+	}
+}
@@ -0,0 +1,152 @@
+package bulk
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+)
+
+// nameTemplate renders an index name or routing value from a
+// collectionIndexMapping or collectionRoutingMapping entry. Entries without
+// "{{" are used as is. Templates are executed with the couchbase.Event as
+// data and these functions:
+//
+//	date "2006.01"    formats a time (e.g. .EventTime) in UTC with a Go layout
+//	field "a.b"       the value of a (dotted) field of the event's JSON value
+//	key               the event's key as a string
+type nameTemplate struct {
+	tmpl   *template.Template
+	static string
+}
+
+func dateFunc(layout string, t time.Time) string {
+	return t.UTC().Format(layout)
+}
+
+// eventFuncs returns the template functions bound to event.
+func eventFuncs(event couchbase.Event) template.FuncMap {
+	return template.FuncMap{
+		"date": dateFunc,
+		"field": func(path string) (string, error) {
+			value := jsoniter.Get(event.Value, pathSegments(path)...)
+			if value.ValueType() == jsoniter.InvalidValue || value.ValueType() == jsoniter.NilValue {
+				return "", fmt.Errorf("field %q is missing", path)
+			}
+			return value.ToString(), nil
+		},
+		"key": func() string {
+			return string(event.Key)
+		},
+	}
+}
+
+func pathSegments(path string) []any {
+	parts := strings.Split(path, ".")
+	segments := make([]any, len(parts))
+	for i, part := range parts {
+		segments[i] = part
+	}
+	return segments
+}
+
+// parseNameTemplate parses text and executes it once against an empty event
+// with stub functions, so syntax errors, unknown functions and unknown event
+// fields are reported at startup.
+func parseNameTemplate(text string) (*nameTemplate, error) {
+	if !strings.Contains(text, "{{") {
+		return &nameTemplate{static: text}, nil
+	}
+
+	tmpl, err := template.New("").Option("missingkey=error").Funcs(eventFuncs(couchbase.Event{})).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Funcs(template.FuncMap{
+		"field": func(string) string { return "" },
+	})
+	if err := tmpl.Execute(io.Discard, couchbase.Event{}); err != nil {
+		return nil, err
+	}
+	return &nameTemplate{tmpl: tmpl}, nil
+}
+
+func (t *nameTemplate) execute(event couchbase.Event) (string, error) {
+	if t.tmpl == nil {
+		return t.static, nil
+	}
+
+	// The functions are bound to event, so each execution works on its own
+	// clone and concurrent renders do not wait for each other.
+	tmpl, err := t.tmpl.Clone()
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if err := tmpl.Funcs(eventFuncs(event)).Execute(&sb, event); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// templateCache holds the parsed templates of the mapping entries, keyed by
+// their text.
+type templateCache struct {
+	templates sync.Map
+}
+
+func (c *templateCache) get(text string) (*nameTemplate, error) {
+	if t, ok := c.templates.Load(text); ok {
+		return t.(*nameTemplate), nil
+	}
+	t, err := parseNameTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := c.templates.LoadOrStore(text, t)
+	return actual.(*nameTemplate), nil
+}
+
+// render executes the template text against event.
+func (c *templateCache) render(text string, event couchbase.Event) (string, error) {
+	t, err := c.get(text)
+	if err != nil {
+		return "", err
+	}
+	return t.execute(event)
+}
+
+// checkTemplates checks every index and routing template of every cluster.
+func checkTemplates(es config.Elasticsearch) error {
+	check := func(setting string, mapping map[string]string) error {
+		for collection, text := range mapping {
+			if _, err := parseNameTemplate(text); err != nil {
+				return fmt.Errorf("%s.%s: %w", setting, collection, err)
+			}
+		}
+		return nil
+	}
+
+	if err := check("elasticsearch.collectionIndexMapping", es.CollectionIndexMapping); err != nil {
+		return err
+	}
+	if err := check("elasticsearch.collectionRoutingMapping", es.CollectionRoutingMapping); err != nil {
+		return err
+	}
+	for clusterKey, cluster := range es.Clusters {
+		if err := check("elasticsearch.clusters."+clusterKey+".collectionIndexMapping", cluster.CollectionIndexMapping); err != nil {
+			return err
+		}
+		if err := check("elasticsearch.clusters."+clusterKey+".collectionRoutingMapping", cluster.CollectionRoutingMapping); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package bulk
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+func Test_resolveAction_Templates(t *testing.T) {
+	b := Bulk{config: &config.Config{Elasticsearch: config.Elasticsearch{
+		CollectionIndexMapping: map[string]string{
+			"orders":  `orders-{{ .EventTime | date "2006.01" }}`,
+			"tenants": `tenant-{{ field "tenant.id" }}`,
+		},
+		CollectionRoutingMapping: map[string]string{"orders": `{{ field "customerId" }}`},
+	}}}
+
+	event := couchbase.Event{
+		CollectionName: "orders",
+		EventTime:      time.Date(2024, 3, 31, 23, 30, 0, 0, time.FixedZone("", -2*60*60)),
+		Value:          []byte(`{"customerId":42}`),
+	}
+	action := document.NewIndexAction([]byte("1"), event.Value, nil)
+	if err := b.resolveAction(&action, event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if action.IndexName != "orders-2024.04" || action.Routing == nil || *action.Routing != "42" {
+		t.Fatalf("unexpected index %q routing %v", action.IndexName, action.Routing)
+	}
+
+	explicit := "r"
+	action = document.NewIndexAction([]byte("1"), event.Value, &explicit)
+	_ = b.resolveAction(&action, event)
+	if *action.Routing != "r" {
+		t.Fatalf("routing set by the mapper must be kept, got %q", *action.Routing)
+	}
+
+	event = couchbase.Event{CollectionName: "tenants", Value: []byte(`{"tenant":{"id":"acme"}}`)}
+	action = document.NewIndexAction([]byte("1"), event.Value, nil)
+	if err := b.resolveAction(&action, event); err != nil || action.IndexName != "tenant-acme" {
+		t.Fatalf("unexpected index %q, err: %v", action.IndexName, err)
+	}
+
+	event.Value = []byte(`{}`)
+	action = document.NewIndexAction([]byte("1"), event.Value, nil)
+	if err := b.resolveAction(&action, event); err == nil {
+		t.Fatal("a missing template field must return an error")
+	}
+}
+
+func Test_checkTemplates(t *testing.T) {
+	tests := map[string]string{
+		"syntax":           `orders-{{ .EventTime | date "2006" `,
+		"unknown_function": `orders-{{ now }}`,
+		"unknown_field":    `orders-{{ .Tenant }}`,
+	}
+	for name, text := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := checkTemplates(config.Elasticsearch{Clusters: map[string]config.Elasticsearch{
+				"analytics": {CollectionIndexMapping: map[string]string{"orders": text}},
+			}})
+			if err == nil {
+				t.Fatalf("template %q must be rejected", text)
+			}
+		})
+	}
+
+	if err := checkTemplates(config.Elasticsearch{CollectionIndexMapping: map[string]string{
+		"orders": `orders-{{ key }}-{{ field "a" }}`,
+		"static": "static-index",
+	}}); err != nil {
+		t.Fatalf("valid templates must be accepted, got %v", err)
+	}
+}
+
+func Test_lookupIndexName_ScopedKey(t *testing.T) {
+	b := Bulk{config: &config.Config{Elasticsearch: config.Elasticsearch{
+		CollectionIndexMapping: map[string]string{
+			"orders":            "orders",
+			"tenant-a.orders":   "tenant-a-orders",
+			"_default._default": "default",
+		},
+	}}}
+
+	tests := []struct {
+		scope string
+		want  string
+	}{
+		{"tenant-a", "tenant-a-orders"},
+		{"tenant-b", "orders"},
+		{"", "orders"},
+	}
+	for _, tt := range tests {
+		event := couchbase.Event{ScopeName: tt.scope, CollectionName: "orders"}
+		got, err := b.lookupIndexName(event, "", "")
+		if err != nil || got != tt.want {
+			t.Fatalf("scope %q: got %q, err: %v, want %q", tt.scope, got, err, tt.want)
+		}
+	}
+}
+
+func Test_nameTemplate_ConcurrentExecute(t *testing.T) {
+	tmpl, err := parseNameTemplate(`tenant-{{ field "tenant" }}-{{ key }}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			event := couchbase.Event{
+				Key:   []byte(fmt.Sprint(i)),
+				Value: []byte(fmt.Sprintf(`{"tenant":"t%d"}`, i)),
+			}
+			got, err := tmpl.execute(event)
+			if want := fmt.Sprintf("tenant-t%d-%d", i, i); err != nil || got != want {
+				errs <- fmt.Errorf("execute = %q, %v, want %q", got, err, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,153 @@
+package bulk
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	dcpElasticsearch "github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	maxIndexNameBytes     = 255
+	invalidIndexNameChars = `\/*?"<>|, #:`
+)
+
+// validator runs the pre-flight checks configured under
+// elasticsearch.validation on actions before they are serialized.
+type validator struct {
+	maxIDBytes int
+	json       bool
+	idLength   bool
+	indexName  bool
+	routing    bool
+}
+
+func newValidator(v *config.Validation) (*validator, error) {
+	if v == nil || !v.Enabled {
+		return nil, nil
+	}
+
+	val := &validator{maxIDBytes: v.MaxIDBytes}
+	for _, check := range v.Checks {
+		switch check {
+		case config.ValidationCheckJSON:
+			val.json = true
+		case config.ValidationCheckIDLength:
+			val.idLength = true
+		case config.ValidationCheckIndexName:
+			val.indexName = true
+		case config.ValidationCheckRouting:
+			val.routing = true
+		default:
+			return nil, fmt.Errorf("elasticsearch.validation: unknown check %q", check)
+		}
+	}
+	return val, nil
+}
+
+// validate returns a *dcpElasticsearch.ValidationError for the first check the
+// action fails, or nil.
+func (v *validator) validate(action *document.ESActionDocument) error {
+	if v.indexName {
+		check := indexNameError
+		if isByQuery(action) {
+			check = indexPatternError
+		}
+		if reason := check(action.IndexName); reason != "" {
+			return &dcpElasticsearch.ValidationError{Check: config.ValidationCheckIndexName, Reason: reason}
+		}
+	}
+	if v.idLength && len(action.ID) > v.maxIDBytes {
+		return &dcpElasticsearch.ValidationError{
+			Check:  config.ValidationCheckIDLength,
+			Reason: fmt.Sprintf("id is %d bytes, limit is %d", len(action.ID), v.maxIDBytes),
+		}
+	}
+	if v.routing && action.Routing != nil && needsJSONEscape(*action.Routing) {
+		return &dcpElasticsearch.ValidationError{
+			Check:  config.ValidationCheckRouting,
+			Reason: fmt.Sprintf("routing %q contains characters that must be escaped", *action.Routing),
+		}
+	}
+	if v.json {
+		if reason := sourceJSONError(action); reason != "" {
+			return &dcpElasticsearch.ValidationError{Check: config.ValidationCheckJSON, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// indexNameError returns why name is not a valid Elasticsearch index name, or
+// an empty string.
+func indexNameError(name string) string {
+	switch {
+	case name == "":
+		return "index name is empty, the collection has no collectionIndexMapping entry"
+	case len(name) > maxIndexNameBytes:
+		return fmt.Sprintf("index name is %d bytes, limit is %d", len(name), maxIndexNameBytes)
+	case name == "." || name == "..":
+		return fmt.Sprintf("index name %q is reserved", name)
+	case strings.ContainsAny(name[:1], "-_+"):
+		return fmt.Sprintf("index name %q must not start with '-', '_' or '+'", name)
+	case strings.ContainsAny(name, invalidIndexNameChars):
+		return fmt.Sprintf("index name %q must not contain any of %q", name, invalidIndexNameChars)
+	case strings.ToLower(name) != name:
+		return fmt.Sprintf("index name %q must be lowercase", name)
+	}
+	return ""
+}
+
+// indexPatternError is indexNameError for the target of a by-query action,
+// which may be a comma-separated list of names with * wildcards, e.g. the
+// orders-* of a deletion policy's purgeIndex.
+func indexPatternError(target string) string {
+	if target == "" {
+		return indexNameError(target)
+	}
+	for _, pattern := range strings.Split(target, ",") {
+		// A wildcard stands for valid characters, so the rest of the pattern
+		// is checked as a name.
+		if reason := indexNameError(strings.ReplaceAll(pattern, "*", "x")); reason != "" {
+			return fmt.Sprintf("index pattern %q: %s", pattern, reason)
+		}
+	}
+	return ""
+}
+
+// needsJSONEscape reports whether s would break the bulk metadata line, which
+// writes the routing value as is.
+func needsJSONEscape(s string) bool {
+	if !utf8.ValidString(s) {
+		return true
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c == '"' || c == '\\' {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceJSONError returns why the body of action is not valid JSON, or an
+// empty string.
+func sourceJSONError(action *document.ESActionDocument) string {
+	if action.Type == document.Delete {
+		return ""
+	}
+	if !jsoniter.Valid(action.Source) {
+		return "source is not valid JSON"
+	}
+	if opts := action.UpdateOptions; opts != nil && isUpdate(action) {
+		if opts.Upsert != nil && !jsoniter.Valid(opts.Upsert) {
+			return "upsert is not valid JSON"
+		}
+		if opts.ScriptParams != nil && !jsoniter.Valid(opts.ScriptParams) {
+			return "script params are not valid JSON"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,131 @@
+package bulk
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+func allChecksValidator(t *testing.T) *validator {
+	t.Helper()
+	v := &config.Validation{Enabled: true}
+	config.ApplyValidationDefaults(v)
+	val, err := newValidator(v)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return val
+}
+
+func Test_validator_validate(t *testing.T) {
+	routing := func(s string) *string { return &s }
+	longID := []byte(strings.Repeat("a", 513))
+
+	tests := []struct {
+		name   string
+		action document.ESActionDocument
+		check  string
+	}{
+		{"valid_index", document.NewIndexAction([]byte("1"), []byte(`{"a":1}`), routing("r-1")), ""},
+		{"valid_delete_without_body", document.NewDeleteAction([]byte("1"), nil), ""},
+		{"invalid_source", document.NewIndexAction([]byte("1"), []byte(`{"a":`), nil), config.ValidationCheckJSON},
+		{"invalid_upsert", document.ESActionDocument{
+			ID: []byte("1"), Type: document.DocUpdate, Source: []byte(`{}`),
+			UpdateOptions: &document.UpdateOptions{Upsert: []byte(`nope`)},
+		}, config.ValidationCheckJSON},
+		{"id_too_long", document.NewIndexAction(longID, []byte(`{}`), nil), config.ValidationCheckIDLength},
+		{"routing_with_quote", document.NewDeleteAction([]byte("1"), routing(`a"b`)), config.ValidationCheckRouting},
+		{"uppercase_index", document.NewDeleteActionWithIndexName("Orders", []byte("1"), nil), config.ValidationCheckIndexName},
+		{"index_starting_with_underscore", document.NewDeleteActionWithIndexName("_orders", []byte("1"), nil), config.ValidationCheckIndexName},
+		{"index_with_illegal_char", document.NewDeleteActionWithIndexName("ord*ers", []byte("1"), nil), config.ValidationCheckIndexName},
+		{"by_query_pattern", document.NewDeleteByQueryActionWithIndexName("orders-*,archive", []byte(`{}`), nil), ""},
+		{"by_query_invalid_pattern", document.NewUpdateByQueryActionWithIndexName("orders-*,Archive", []byte(`{}`), nil, nil), config.ValidationCheckIndexName},
+	}
+
+	v := allChecksValidator(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.action.IndexName == "" {
+				tt.action.IndexName = testIndexName
+			}
+			err := v.validate(&tt.action)
+			if tt.check == "" {
+				if err != nil {
+					t.Fatalf("expected valid action, got %v", err)
+				}
+				return
+			}
+			var validationErr *elasticsearch.ValidationError
+			if !errors.As(err, &validationErr) || validationErr.Check != tt.check {
+				t.Fatalf("expected %q validation error, got %v", tt.check, err)
+			}
+		})
+	}
+}
+
+func Test_newValidator_UnknownCheck(t *testing.T) {
+	if _, err := newValidator(&config.Validation{Enabled: true, Checks: []string{"size"}}); err == nil {
+		t.Fatal("unknown check must be rejected")
+	}
+}
+
+// Invalid actions reach OnError and never enter the batch; a collection
+// without a mapping is rejected instead of panicking.
+func Test_AddActions_RejectsInvalidActions(t *testing.T) {
+	handler := &errRecordingHandler{}
+	b := buildBulk(nil, &handler.recordingHandler)
+	b.sinkResponseHandler = handler
+	b.config = &config.Config{Elasticsearch: config.Elasticsearch{
+		CollectionIndexMapping: map[string]string{"mapped": testIndexName},
+	}}
+	b.validator = allChecksValidator(t)
+	b.batchKeys = map[string]int{}
+	b.batchSizeLimit = 100
+	b.batchByteSizeLimit = 1 << 20
+
+	b.AddEventActions(nil, couchbase.Event{CollectionName: "mapped"}, []document.ESActionDocument{
+		document.NewIndexAction([]byte("ok"), []byte(`{"a":1}`), nil),
+		document.NewIndexAction([]byte("bad"), []byte(`{"a":`), nil),
+	}, false)
+	b.AddEventActions(nil, couchbase.Event{CollectionName: "unmapped"}, []document.ESActionDocument{
+		document.NewIndexAction([]byte("unmapped"), []byte(`{}`), nil),
+	}, false)
+
+	if len(b.batch) != 1 || string(b.batch[0].Action.ID) != "ok" {
+		t.Fatalf("only the valid action must be batched, got %d items", len(b.batch))
+	}
+	if len(handler.errs) != 2 {
+		t.Fatalf("expected 2 rejected actions, got %v", handler.errored)
+	}
+	for _, err := range handler.errs {
+		var validationErr *elasticsearch.ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("expected a ValidationError, got %v", err)
+		}
+	}
+}
+
+// A deletion policy purge targets an index pattern, which the indexName
+// check must let through.
+func Test_AddActions_ValidatesByQueryPatterns(t *testing.T) {
+	handler := &errRecordingHandler{}
+	b := buildBulk(nil, &handler.recordingHandler)
+	b.sinkResponseHandler = handler
+	b.validator = allChecksValidator(t)
+	b.batchKeys = map[string]int{}
+	b.batchSizeLimit = 100
+	b.batchByteSizeLimit = 1 << 20
+
+	b.AddEventActions(nil, couchbase.Event{CollectionName: "orders"}, []document.ESActionDocument{
+		document.DeleteByQueryAction([]byte(`{"match_all":{}}`)).Index("orders-*").Routing("").Build(),
+	}, false)
+
+	if len(handler.errs) != 0 || len(b.batch) != 1 {
+		t.Fatalf("the purge must be batched, got %d items and errors %v", len(b.batch), handler.errs)
+	}
+}
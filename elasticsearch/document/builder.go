@@ -0,0 +1,188 @@
+package document
+
+import "fmt"
+
+// ActionBuilder builds an ESActionDocument step by step:
+//
+//	document.IndexAction(key).Source(b).Index("x").Routing(r).Cluster("analytics").Build()
+//
+// Options an action type does not support are ignored when the action is
+// sent, like on ESActionDocument itself.
+type ActionBuilder struct {
+	partialObject    string
+	action           ESActionDocument
+	hasPartialObject bool
+}
+
+// NewActionBuilder starts building an action of the given type for key.
+func NewActionBuilder(actionType EsAction, key []byte) *ActionBuilder {
+	return &ActionBuilder{action: ESActionDocument{Type: actionType, ID: key}}
+}
+
+func IndexAction(key []byte) *ActionBuilder {
+	return NewActionBuilder(Index, key)
+}
+
+func CreateAction(key []byte) *ActionBuilder {
+	return NewActionBuilder(Create, key)
+}
+
+func DeleteAction(key []byte) *ActionBuilder {
+	return NewActionBuilder(Delete, key)
+}
+
+// DocUpdateAction starts a partial update; Source is the partial document.
+func DocUpdateAction(key []byte) *ActionBuilder {
+	return NewActionBuilder(DocUpdate, key)
+}
+
+// ScriptUpdateAction starts a scripted update; Source is the script.
+func ScriptUpdateAction(key []byte) *ActionBuilder {
+	return NewActionBuilder(ScriptUpdate, key)
+}
+
+// DeleteByQueryAction starts a delete-by-query for query, a JSON query clause.
+func DeleteByQueryAction(query []byte) *ActionBuilder {
+	return NewActionBuilder(DeleteByQuery, nil).Source([]byte(fmt.Sprintf(`{"query":%s}`, query)))
+}
+
+// UpdateByQueryAction starts an update-by-query that runs script on every
+// document matching query.
+func UpdateByQueryAction(query []byte, script []byte) *ActionBuilder {
+	return NewActionBuilder(UpdateByQuery, nil).Source([]byte(fmt.Sprintf(`{"query":%s,"script":%s}`, query, script)))
+}
+
+// Source sets the document of Index and Create actions, the partial document
+// of DocUpdate actions and the script of ScriptUpdate actions.
+func (b *ActionBuilder) Source(source []byte) *ActionBuilder {
+	b.action.Source = source
+	return b
+}
+
+// PartialObject nests the partial document of a DocUpdate action under the
+// given field, e.g. {"name":<source>}.
+func (b *ActionBuilder) PartialObject(name string) *ActionBuilder {
+	b.partialObject = name
+	b.hasPartialObject = true
+	return b
+}
+
+// Index sets the target index. When unset the collectionIndexMapping entry of
+// the event's collection is used.
+func (b *ActionBuilder) Index(indexName string) *ActionBuilder {
+	b.action.IndexName = indexName
+	return b
+}
+
+func (b *ActionBuilder) Routing(routing string) *ActionBuilder {
+	return b.routing(&routing)
+}
+
+func (b *ActionBuilder) routing(routing *string) *ActionBuilder {
+	b.action.Routing = routing
+	return b
+}
+
+// Cluster sets the key of the elasticsearch.clusters entry the action is sent
+// to.
+func (b *ActionBuilder) Cluster(clusterKey string) *ActionBuilder {
+	b.action.ClusterKey = clusterKey
+	return b
+}
+
+func (b *ActionBuilder) Pipeline(pipeline string) *ActionBuilder {
+	b.action.Pipeline = pipeline
+	return b
+}
+
+// Version sets the external version of Index and Delete actions.
+func (b *ActionBuilder) Version(version uint64, versionType VersionType) *ActionBuilder {
+	b.action.Version = &version
+	b.action.VersionType = versionType
+	return b
+}
+
+// IfSeqNo makes the action conditional on the document's current sequence
+// number and primary term.
+func (b *ActionBuilder) IfSeqNo(seqNo, primaryTerm int64) *ActionBuilder {
+	b.action.IfSeqNo = &seqNo
+	b.action.IfPrimaryTerm = &primaryTerm
+	return b
+}
+
+// UpdateOptions replaces the update options of DocUpdate and ScriptUpdate
+// actions, including the ones set by the helpers below.
+func (b *ActionBuilder) UpdateOptions(opts UpdateOptions) *ActionBuilder {
+	b.action.UpdateOptions = &opts
+	return b
+}
+
+func (b *ActionBuilder) RetryOnConflict(retries int) *ActionBuilder {
+	b.updateOptions().RetryOnConflict = &retries
+	return b
+}
+
+func (b *ActionBuilder) DetectNoop(detectNoop bool) *ActionBuilder {
+	b.updateOptions().DetectNoop = &detectNoop
+	return b
+}
+
+func (b *ActionBuilder) DocAsUpsert(docAsUpsert bool) *ActionBuilder {
+	b.updateOptions().DocAsUpsert = &docAsUpsert
+	return b
+}
+
+func (b *ActionBuilder) ScriptedUpsert(scriptedUpsert bool) *ActionBuilder {
+	b.updateOptions().ScriptedUpsert = &scriptedUpsert
+	return b
+}
+
+// IgnoreMissing reports an update whose document does not exist, with
+// upserts turned off, to OnSuccess as a no-op instead of failing it.
+func (b *ActionBuilder) IgnoreMissing(ignoreMissing bool) *ActionBuilder {
+	b.updateOptions().IgnoreMissing = &ignoreMissing
+	return b
+}
+
+// Upsert sets the document indexed when the target of an update does not
+// exist yet.
+func (b *ActionBuilder) Upsert(upsert []byte) *ActionBuilder {
+	b.updateOptions().Upsert = upsert
+	return b
+}
+
+// ScriptParams sets the params of a ScriptUpdate action's script, a JSON
+// object.
+func (b *ActionBuilder) ScriptParams(params []byte) *ActionBuilder {
+	b.updateOptions().ScriptParams = params
+	return b
+}
+
+// ReturnSource filters the _source returned for update actions.
+func (b *ActionBuilder) ReturnSource(includes, excludes []string) *ActionBuilder {
+	opts := b.updateOptions()
+	opts.SourceIncludes = includes
+	opts.SourceExcludes = excludes
+	return b
+}
+
+func (b *ActionBuilder) updateOptions() *UpdateOptions {
+	if b.action.UpdateOptions == nil {
+		b.action.UpdateOptions = &UpdateOptions{}
+	}
+	return b.action.UpdateOptions
+}
+
+// Build returns the action. The builder can be reused; later changes do not
+// affect actions already built, except for shared byte slices.
+func (b *ActionBuilder) Build() ESActionDocument {
+	action := b.action
+	if b.hasPartialObject {
+		action.Source = []byte(fmt.Sprintf(`{"%s":%s}`, b.partialObject, action.Source))
+	}
+	if action.UpdateOptions != nil {
+		opts := *action.UpdateOptions
+		action.UpdateOptions = &opts
+	}
+	return action
+}
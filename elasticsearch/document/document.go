@@ -1,72 +1,154 @@
 package document
 
 import (
-	"fmt"
 	"time"
+
+	jsoniter "github.com/json-iterator/go"
 )
 
 type EsAction string
 
 const (
 	Index        EsAction = "Index"
+	Create       EsAction = "Create"
 	Delete       EsAction = "Delete"
 	DocUpdate    EsAction = "DocUpdate"
 	ScriptUpdate EsAction = "ScriptUpdate"
+	// DeleteByQuery and UpdateByQuery are not part of the bulk body. They are
+	// sent as separate _delete_by_query / _update_by_query requests, in batch
+	// order relative to the bulk actions around them.
+	DeleteByQuery EsAction = "DeleteByQuery"
+	UpdateByQuery EsAction = "UpdateByQuery"
+)
+
+// VersionType selects how Elasticsearch compares Version against the stored
+// document version. Only external variants are supported: the version comes
+// from Couchbase, not from Elasticsearch.
+type VersionType string
+
+const (
+	VersionTypeExternal    VersionType = "external"
+	VersionTypeExternalGte VersionType = "external_gte"
 )
 
+// UpdateOptions tunes the body of DocUpdate and ScriptUpdate actions. Nil
+// fields fall back to the index defaults from config and then to the
+// connector defaults (doc_as_upsert and scripted_upsert on, doc_as_upsert off
+// when Upsert is set). An Upsert with DocAsUpsert on, or RetryOnConflict on a
+// conditional action, is rejected before the action is sent.
+type UpdateOptions struct {
+	RetryOnConflict *int  `yaml:"retryOnConflict"`
+	DetectNoop      *bool `yaml:"detectNoop"`
+	DocAsUpsert     *bool `yaml:"docAsUpsert"`
+	ScriptedUpsert  *bool `yaml:"scriptedUpsert"`
+	// IgnoreMissing reports an update whose document does not exist (404
+	// document_missing_exception, only possible with upserts off) to
+	// OnSuccess as a no-op instead of OnError.
+	IgnoreMissing *bool `yaml:"ignoreMissing"`
+	// Upsert is the document indexed when the target does not exist yet.
+	Upsert []byte `yaml:"-"`
+	// ScriptParams is a JSON object sent as the script's params, so the
+	// script body can stay constant and be cached by Elasticsearch.
+	ScriptParams   []byte   `yaml:"-"`
+	SourceIncludes []string `yaml:"sourceIncludes"`
+	SourceExcludes []string `yaml:"sourceExcludes"`
+}
+
+// WithDefaults returns a copy of o whose unset fields are taken from defaults.
+func (o *UpdateOptions) WithDefaults(defaults UpdateOptions) *UpdateOptions {
+	if o == nil {
+		return &defaults
+	}
+
+	merged := *o
+	if merged.RetryOnConflict == nil {
+		merged.RetryOnConflict = defaults.RetryOnConflict
+	}
+	if merged.DetectNoop == nil {
+		merged.DetectNoop = defaults.DetectNoop
+	}
+	if merged.DocAsUpsert == nil {
+		merged.DocAsUpsert = defaults.DocAsUpsert
+	}
+	if merged.ScriptedUpsert == nil {
+		merged.ScriptedUpsert = defaults.ScriptedUpsert
+	}
+	if merged.IgnoreMissing == nil {
+		merged.IgnoreMissing = defaults.IgnoreMissing
+	}
+	if merged.Upsert == nil {
+		merged.Upsert = defaults.Upsert
+	}
+	if merged.ScriptParams == nil {
+		merged.ScriptParams = defaults.ScriptParams
+	}
+	if merged.SourceIncludes == nil {
+		merged.SourceIncludes = defaults.SourceIncludes
+	}
+	if merged.SourceExcludes == nil {
+		merged.SourceExcludes = defaults.SourceExcludes
+	}
+	return &merged
+}
+
 type ESActionDocument struct {
 	EventTime  time.Time
 	ClusterKey string
 	Routing    *string
-	Type       EsAction
-	IndexName  string
-	Source     []byte
-	ID         []byte
+	// Version, when set, is sent as the external document version of Index and
+	// Delete actions; Elasticsearch rejects the write with 409 if it already
+	// holds a newer version. Other action types ignore it.
+	Version *uint64
+	// IfSeqNo and IfPrimaryTerm make Index, Delete and update actions
+	// conditional on the document still having this sequence number and
+	// primary term, typically read through Event.ElasticsearchClient. A
+	// concurrent change makes Elasticsearch reject the write with 409. Both
+	// must be set to take effect.
+	IfSeqNo       *int64
+	IfPrimaryTerm *int64
+	// UpdateOptions tunes DocUpdate and ScriptUpdate actions; other action
+	// types ignore it.
+	UpdateOptions *UpdateOptions
+	Type          EsAction
+	VersionType   VersionType
+	IndexName     string
+	// Pipeline is the ingest pipeline an Index or Create action runs through.
+	// When empty the index or cluster default from config is used.
+	Pipeline string
+	Source   []byte
+	ID       []byte
 }
 
 func NewDeleteAction(key []byte, routing *string) ESActionDocument {
-	return ESActionDocument{
-		ID:      key,
-		Routing: routing,
-		Type:    Delete,
-	}
+	return DeleteAction(key).routing(routing).Build()
 }
 
 func NewDeleteActionWithIndexName(indexName string, key []byte, routing *string) ESActionDocument {
-	return ESActionDocument{
-		ID:        key,
-		Routing:   routing,
-		Type:      Delete,
-		IndexName: indexName,
-	}
+	return DeleteAction(key).routing(routing).Index(indexName).Build()
 }
 
 func NewIndexAction(key []byte, source []byte, routing *string) ESActionDocument {
-	return ESActionDocument{
-		ID:      key,
-		Routing: routing,
-		Source:  source,
-		Type:    Index,
-	}
+	return IndexAction(key).Source(source).routing(routing).Build()
 }
 
 func NewIndexActionWithIndexName(indexName string, key []byte, source []byte, routing *string) ESActionDocument {
-	return ESActionDocument{
-		ID:        key,
-		Routing:   routing,
-		Source:    source,
-		Type:      Index,
-		IndexName: indexName,
-	}
+	return IndexAction(key).Source(source).routing(routing).Index(indexName).Build()
+}
+
+// NewCreateAction builds an op_type=create action. Elasticsearch rejects it with
+// 409 when a document with the same ID already exists, so it never overwrites
+// existing documents; this makes it suitable for append-only indices and data
+// streams.
+func NewCreateAction(key []byte, source []byte, routing *string) ESActionDocument {
+	return CreateAction(key).Source(source).routing(routing).Build()
+}
+
+func NewCreateActionWithIndexName(indexName string, key []byte, source []byte, routing *string) ESActionDocument {
+	return CreateAction(key).Source(source).routing(routing).Index(indexName).Build()
 }
 
 func NewDocUpdateAction(key []byte, source []byte, routing *string, partialIndexObjectName string) ESActionDocument {
-	return ESActionDocument{
-		ID:      key,
-		Routing: routing,
-		Source:  []byte(fmt.Sprintf(`{"%s":%s}`, partialIndexObjectName, source)),
-		Type:    DocUpdate,
-	}
+	return DocUpdateAction(key).Source(source).PartialObject(partialIndexObjectName).routing(routing).Build()
 }
 
 func NewDocUpdateActionWithIndexName(
@@ -76,30 +158,61 @@ func NewDocUpdateActionWithIndexName(
 	indexName string,
 	partialIndexObjectName string,
 ) ESActionDocument {
-	return ESActionDocument{
-		ID:        key,
-		Routing:   routing,
-		Source:    []byte(fmt.Sprintf(`{"%s":%s}`, partialIndexObjectName, source)),
-		Type:      DocUpdate,
-		IndexName: indexName,
-	}
+	return DocUpdateAction(key).
+		Source(source).
+		PartialObject(partialIndexObjectName).
+		routing(routing).
+		Index(indexName).
+		Build()
 }
 
 func NewScriptUpdateAction(id []byte, script []byte, routing *string) ESActionDocument {
-	return ESActionDocument{
-		ID:      id,
-		Type:    ScriptUpdate,
-		Source:  script,
-		Routing: routing,
-	}
+	return ScriptUpdateAction(id).Source(script).routing(routing).Build()
 }
 
 func NewScriptUpdateActionWithIndexName(id []byte, script []byte, routing *string, indexName string) ESActionDocument {
-	return ESActionDocument{
-		ID:        id,
-		Type:      ScriptUpdate,
-		Source:    script,
-		Routing:   routing,
-		IndexName: indexName,
-	}
+	return ScriptUpdateAction(id).Source(script).routing(routing).Index(indexName).Build()
+}
+
+// NewStoredScriptUpdateAction builds a ScriptUpdate action that runs the
+// stored script scriptID with params, a JSON object.
+func NewStoredScriptUpdateAction(id []byte, scriptID string, params []byte, routing *string) ESActionDocument {
+	script, _ := jsoniter.Marshal(struct {
+		ID string `json:"id"`
+	}{ID: scriptID})
+
+	return ScriptUpdateAction(id).Source(script).ScriptParams(params).routing(routing).Build()
+}
+
+func NewStoredScriptUpdateActionWithIndexName(
+	id []byte,
+	scriptID string,
+	params []byte,
+	routing *string,
+	indexName string,
+) ESActionDocument {
+	action := NewStoredScriptUpdateAction(id, scriptID, params, routing)
+	action.IndexName = indexName
+	return action
+}
+
+// NewDeleteByQueryAction builds an action that deletes every document of the
+// index matching query, a JSON query clause such as {"term":{"parentId":"1"}}.
+// It is typically used to cascade the deletion of a parent document.
+func NewDeleteByQueryAction(query []byte, routing *string) ESActionDocument {
+	return DeleteByQueryAction(query).routing(routing).Build()
+}
+
+func NewDeleteByQueryActionWithIndexName(indexName string, query []byte, routing *string) ESActionDocument {
+	return DeleteByQueryAction(query).routing(routing).Index(indexName).Build()
+}
+
+// NewUpdateByQueryAction builds an action that runs script on every document
+// of the index matching query.
+func NewUpdateByQueryAction(query []byte, script []byte, routing *string) ESActionDocument {
+	return UpdateByQueryAction(query, script).routing(routing).Build()
+}
+
+func NewUpdateByQueryActionWithIndexName(indexName string, query []byte, script []byte, routing *string) ESActionDocument {
+	return UpdateByQueryAction(query, script).routing(routing).Index(indexName).Build()
 }
@@ -5,7 +5,11 @@ import (
 )
 
 type BatchItem struct {
-	Action    *document.ESActionDocument
+	Action *document.ESActionDocument
+	// Remap re-runs the mapper for the event that produced Action. The retry
+	// layer uses it to rebuild a conditional (if_seq_no) write that lost a
+	// version conflict from a fresh read. It is nil for unconditional actions.
+	Remap     func() ([]document.ESActionDocument, error)
 	Bytes     []byte
 	IsSkipped bool
 }
@@ -0,0 +1,167 @@
+package script
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+	"github.com/Trendyol/go-dcp/logger"
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const defaultLang = "painless"
+
+type storedScript struct {
+	Lang   string `json:"lang"`
+	Source string `json:"source"`
+}
+
+type storedScriptBody struct {
+	Script storedScript `json:"script"`
+}
+
+// Registry holds the scripts configured under elasticsearch.scripts. Each
+// script is stored in Elasticsearch under "<name>-<checksum>", so changing a
+// script's source creates a new stored script instead of changing the one
+// older connector instances still reference during a rolling deploy.
+type Registry struct {
+	scripts map[string]storedScript
+	ids     map[string]string
+}
+
+func NewRegistry(scripts map[string]config.Script) *Registry {
+	r := &Registry{
+		scripts: make(map[string]storedScript, len(scripts)),
+		ids:     make(map[string]string, len(scripts)),
+	}
+	for name, s := range scripts {
+		lang := s.Lang
+		if lang == "" {
+			lang = defaultLang
+		}
+		r.scripts[name] = storedScript{Lang: lang, Source: s.Source}
+		r.ids[name] = name + "-" + checksum(lang, s.Source)
+	}
+	return r
+}
+
+func checksum(lang, source string) string {
+	sum := sha256.Sum256([]byte(lang + "\x00" + source))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ID returns the stored script id of a configured script.
+func (r *Registry) ID(name string) (string, bool) {
+	id, ok := r.ids[name]
+	return id, ok
+}
+
+// NewScriptUpdateAction builds a ScriptUpdate action that runs the stored
+// script registered as name with params marshaled to JSON.
+func (r *Registry) NewScriptUpdateAction(id []byte, name string, params any, routing *string) (document.ESActionDocument, error) {
+	scriptID, ok := r.ID(name)
+	if !ok {
+		return document.ESActionDocument{}, fmt.Errorf("script %q is not registered in elasticsearch.scripts", name)
+	}
+
+	paramsBytes, err := jsoniter.Marshal(params)
+	if err != nil {
+		return document.ESActionDocument{}, fmt.Errorf("script %q params: %w", name, err)
+	}
+
+	return document.NewStoredScriptUpdateAction(id, scriptID, paramsBytes, routing), nil
+}
+
+// Upload stores every registered script on each cluster whose stored copy is
+// missing or does not match its checksum.
+func (r *Registry) Upload(esClients map[string]*elasticsearch.Client) error {
+	names := make([]string, 0, len(r.scripts))
+	for name := range r.scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for clusterKey, esClient := range esClients {
+		for _, name := range names {
+			if err := r.upload(esClient, name); err != nil {
+				return fmt.Errorf("elasticsearch cluster %q: %w", clusterKey, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Registry) upload(esClient *elasticsearch.Client, name string) error {
+	id := r.ids[name]
+	expected := r.scripts[name]
+
+	stored, err := getStoredScript(esClient, id)
+	if err != nil {
+		return err
+	}
+	if stored != nil && checksum(stored.Lang, stored.Source) == checksum(expected.Lang, expected.Source) {
+		return nil
+	}
+
+	body, err := jsoniter.Marshal(storedScriptBody{Script: expected})
+	if err != nil {
+		return err
+	}
+
+	resp, err := esapi.PutScriptRequest{
+		ScriptID: id,
+		Body:     bytes.NewReader(body),
+	}.Do(context.Background(), esClient)
+	if err != nil {
+		return fmt.Errorf("put script %q: %w", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return fmt.Errorf("put script %q: %s", id, resp.String())
+	}
+
+	logger.Log.Info("stored script %q uploaded as %q", name, id)
+	return nil
+}
+
+// getStoredScript returns the stored script with the given id, or nil when it
+// does not exist.
+func getStoredScript(esClient *elasticsearch.Client, id string) (*storedScript, error) {
+	resp, err := esapi.GetScriptRequest{ScriptID: id}.Do(context.Background(), esClient)
+	if err != nil {
+		return nil, fmt.Errorf("get script %q: %w", id, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("get script %q: %s", id, resp.String())
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Script *storedScript `json:"script"`
+		Found  bool          `json:"found"`
+	}
+	if err := jsoniter.Unmarshal(raw, &body); err != nil {
+		return nil, fmt.Errorf("get script %q: %w", id, err)
+	}
+	if !body.Found {
+		return nil, nil
+	}
+	return body.Script, nil
+}
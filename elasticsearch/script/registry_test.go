@@ -0,0 +1,125 @@
+package script
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+	"github.com/Trendyol/go-dcp/logger"
+	"github.com/elastic/go-elasticsearch/v7"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitDefaultLogger("error")
+	os.Exit(m.Run())
+}
+
+const incrementSource = "ctx._source.count += params.n"
+
+// scriptServer is a minimal _scripts endpoint that keeps uploaded scripts in
+// memory and records every PUT.
+type scriptServer struct {
+	stored map[string]string
+	puts   []string
+	mu     sync.Mutex
+}
+
+func (s *scriptServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path == "/" {
+		_, _ = w.Write([]byte(`{"version":{"number":"7.17.0","build_flavor":"default"},"tagline":"You Know, for Search"}`))
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/_scripts/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		s.stored[id] = string(body)
+		s.puts = append(s.puts, id)
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+	case http.MethodGet:
+		body, ok := s.stored[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"_id":"` + id + `","found":false}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"_id":"` + id + `","found":true,` + body[1:]))
+	}
+}
+
+func newClient(t *testing.T, url string) *elasticsearch.Client {
+	t.Helper()
+	c, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{url}})
+	if err != nil {
+		t.Fatalf("build es client: %v", err)
+	}
+	return c
+}
+
+func TestRegistry_UploadOnlyWhenMissing(t *testing.T) {
+	server := &scriptServer{stored: map[string]string{}}
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	registry := NewRegistry(map[string]config.Script{"increment": {Source: incrementSource}})
+	clients := map[string]*elasticsearch.Client{"": newClient(t, srv.URL)}
+
+	if err := registry.Upload(clients); err != nil {
+		t.Fatalf("first upload: %v", err)
+	}
+	if err := registry.Upload(clients); err != nil {
+		t.Fatalf("second upload: %v", err)
+	}
+
+	id, _ := registry.ID("increment")
+	if len(server.puts) != 1 || server.puts[0] != id {
+		t.Fatalf("expected a single upload of %q, got %v", id, server.puts)
+	}
+	if !strings.Contains(server.stored[id], `"lang":"painless"`) {
+		t.Fatalf("lang must default to painless, got %s", server.stored[id])
+	}
+}
+
+func TestRegistry_IDChangesWithSource(t *testing.T) {
+	a := NewRegistry(map[string]config.Script{"increment": {Source: incrementSource}})
+	b := NewRegistry(map[string]config.Script{"increment": {Source: incrementSource + ";"}})
+
+	idA, _ := a.ID("increment")
+	idB, _ := b.ID("increment")
+	if idA == idB || !strings.HasPrefix(idA, "increment-") {
+		t.Fatalf("ids must be name-prefixed and differ by source, got %q and %q", idA, idB)
+	}
+}
+
+func TestRegistry_NewScriptUpdateAction(t *testing.T) {
+	registry := NewRegistry(map[string]config.Script{"increment": {Source: incrementSource}})
+
+	action, err := registry.NewScriptUpdateAction([]byte("1"), "increment", map[string]int{"n": 2}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	id, _ := registry.ID("increment")
+	if action.Type != document.ScriptUpdate || string(action.Source) != `{"id":"`+id+`"}` {
+		t.Fatalf("unexpected action %+v", action)
+	}
+	if string(action.UpdateOptions.ScriptParams) != `{"n":2}` {
+		t.Fatalf("unexpected params %s", action.UpdateOptions.ScriptParams)
+	}
+
+	if _, err := registry.NewScriptUpdateAction([]byte("1"), "missing", nil, nil); err == nil {
+		t.Fatal("unknown script must return an error")
+	}
+}
@@ -1,14 +1,77 @@
 package elasticsearch
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
 	"github.com/elastic/go-elasticsearch/v7"
 )
 
+// ErrDocumentAlreadyExists is wrapped into the error passed to OnError when a
+// Create action is rejected with 409 because a document with the same ID
+// already exists. Use errors.Is to tell these conflicts apart from real
+// failures.
+var ErrDocumentAlreadyExists = errors.New("document already exists")
+
+// ErrDataStreamAction is wrapped into the error passed to OnError when a
+// Delete, DocUpdate or ScriptUpdate action targets an index configured under
+// elasticsearch.dataStreams. Data streams are append-only, so such actions are
+// never sent.
+var ErrDataStreamAction = errors.New("data streams only accept create actions")
+
+// ErrUpdateOptions is wrapped into the error passed to OnError when an update
+// action combines options Elasticsearch rejects or ignores: an Upsert document
+// with DocAsUpsert on, or RetryOnConflict with IfSeqNo/IfPrimaryTerm. Such
+// actions are never sent.
+var ErrUpdateOptions = errors.New("conflicting update options")
+
+// ErrUnresolvedDelete is wrapped into the error passed to OnError for a delete
+// without routing whose document elasticsearch.deleteResolution found in no
+// index. Such deletes are never sent, as they would most likely miss.
+var ErrUnresolvedDelete = errors.New("delete could not be resolved")
+
+// ValidationError is passed to OnError for an action rejected by the
+// pre-flight validation stage (elasticsearch.validation). Such actions are
+// never sent to Elasticsearch.
+type ValidationError struct {
+	// Check is the name of the failed check, e.g. "json" or "routing".
+	Check  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("validation check %q failed: %s", e.Check, e.Reason)
+}
+
+// SchemaViolationError is passed to OnError for an action whose source does
+// not match the JSON Schema of its collection (elasticsearch.schemaValidation).
+// Such actions are never sent to Elasticsearch.
+type SchemaViolationError struct {
+	// Schema is the path of the schema file.
+	Schema string
+	// SchemaLocation is the JSON pointer of the failed keyword in the schema,
+	// e.g. "/properties/price/type".
+	SchemaLocation string
+	// InstanceLocation is the JSON pointer of the offending value in the
+	// source, e.g. "/price".
+	InstanceLocation string
+	Reason           string
+}
+
+func (e *SchemaViolationError) Error() string {
+	return fmt.Sprintf("schema %s#%s failed at %q: %s", e.Schema, e.SchemaLocation, e.InstanceLocation, e.Reason)
+}
+
 type SinkResponseHandlerContext struct {
 	Action *document.ESActionDocument
 	Err    error
+	// IsNoop is set on OnSuccess when Elasticsearch ignored an externally
+	// versioned action because it already holds the same or a newer version of
+	// the document (a stale replay or late retry).
+	IsNoop bool
 }
 
 type SinkResponseHandlerBulkContext struct {
@@ -28,3 +91,15 @@ type SinkResponseHandler interface {
 	OnBeforeBulk(ctx *SinkResponseHandlerBulkContext)
 	OnAfterBulk(ctx *SinkResponseHandlerBulkContext)
 }
+
+type MappingErrorContext struct {
+	Err   error
+	Event couchbase.Event
+}
+
+// MappingErrorHandler can be implemented by a SinkResponseHandler to be told
+// about events whose mapper returned an error. The event is then skipped or
+// the connector stops, depending on elasticsearch.mappingErrorPolicy.
+type MappingErrorHandler interface {
+	OnMappingError(ctx *MappingErrorContext)
+}
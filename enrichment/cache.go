@@ -0,0 +1,145 @@
+package enrichment
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type cacheKey struct {
+	collection string
+	key        string
+}
+
+type cacheEntry struct {
+	expiresAt time.Time
+	cacheKey
+	value []byte
+	found bool
+}
+
+// cache is an LRU cache of looked-up documents whose entries also expire
+// after a TTL. Missing documents are cached too, with found unset.
+//
+// Every delete advances epoch. While fetches are in flight, the epoch at which
+// each key was last deleted is kept in invalidated, so that setSince can drop
+// a value fetched before the delete.
+type cache struct {
+	entries     map[cacheKey]*list.Element
+	invalidated map[cacheKey]uint64
+	order       *list.List
+	now         func() time.Time
+	ttl         time.Duration
+	epoch       uint64
+	size        int
+	fetches     int
+	mu          sync.Mutex
+}
+
+func newCache(size int, ttl time.Duration) *cache {
+	return &cache{
+		entries:     make(map[cacheKey]*list.Element, size),
+		invalidated: make(map[cacheKey]uint64),
+		order:       list.New(),
+		now:         time.Now,
+		ttl:         ttl,
+		size:        size,
+	}
+}
+
+func (c *cache) get(key cacheKey) (value []byte, found bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if c.ttl > 0 && c.now().After(entry.expiresAt) {
+		c.remove(element)
+		return nil, false, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, entry.found, true
+}
+
+// beginFetch registers a fetch and returns the epoch it started at. It must
+// be followed by endFetch.
+func (c *cache) beginFetch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fetches++
+	return c.epoch
+}
+
+func (c *cache) endFetch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fetches--
+	if c.fetches == 0 {
+		clear(c.invalidated)
+	}
+}
+
+// setSince caches a value fetched by a fetch that began at epoch, unless the
+// key was deleted after that.
+func (c *cache) setSince(key cacheKey, value []byte, found bool, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.invalidated[key] > epoch {
+		return
+	}
+	c.put(key, value, found)
+}
+
+func (c *cache) set(key cacheKey, value []byte, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.put(key, value, found)
+}
+
+func (c *cache) put(key cacheKey, value []byte, found bool) {
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{
+		cacheKey:  key,
+		value:     value,
+		found:     found,
+		expiresAt: c.now().Add(c.ttl),
+	})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *cache) delete(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	if c.fetches > 0 {
+		c.invalidated[key] = c.epoch
+	}
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *cache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).cacheKey)
+}
@@ -0,0 +1,70 @@
+package enrichment
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gocbcore/v10"
+)
+
+// couchbaseFetcher reads documents with concurrent KV gets on the agent of
+// the connector's DCP client.
+type couchbaseFetcher struct {
+	agent   func() *gocbcore.Agent
+	timeout time.Duration
+}
+
+// NewCouchbaseFetcher returns a Fetcher issuing KV gets through the agent
+// returned by agent, which is called per fetch since the DCP client only
+// connects when the connector starts. A fetch fails after timeout.
+func NewCouchbaseFetcher(agent func() *gocbcore.Agent, timeout time.Duration) Fetcher {
+	return &couchbaseFetcher{agent: agent, timeout: timeout}
+}
+
+func (f *couchbaseFetcher) Fetch(scopeName, collectionName string, keys [][]byte) (map[string][]byte, error) {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	values := make(map[string][]byte, len(keys))
+	deadline := time.Now().Add(f.timeout)
+	agent := f.agent()
+
+	for _, key := range keys {
+		wg.Add(1)
+		_, err := agent.Get(gocbcore.GetOptions{
+			Key:            key,
+			ScopeName:      scopeName,
+			CollectionName: collectionName,
+			Deadline:       deadline,
+		}, func(result *gocbcore.GetResult, err error) {
+			defer wg.Done()
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				values[string(key)] = result.Value
+			case errors.Is(err, gocbcore.ErrDocumentNotFound):
+			case firstErr == nil:
+				firstErr = err
+			}
+		})
+		if err != nil {
+			wg.Done()
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			mu.Unlock()
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return values, nil
+}
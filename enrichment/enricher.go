@@ -0,0 +1,138 @@
+package enrichment
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+)
+
+const defaultScopeName = "_default"
+
+// Fetcher reads documents from Couchbase. Keys that do not exist are left
+// out of the result.
+type Fetcher interface {
+	Fetch(scopeName, collectionName string, keys [][]byte) (map[string][]byte, error)
+}
+
+// Stats are the counters the metric collector exposes for an Enricher.
+type Stats struct {
+	FetchLatency   Histogram
+	Hits           int64
+	Misses         int64
+	FetchLatencyMs int64
+	Size           int
+}
+
+// Enricher looks up other Couchbase documents for mappers, which get it from
+// the connector's MapperContext. Results, including missing documents, are kept in
+// an LRU cache whose entries expire after elasticsearch.enrichment.ttl. The
+// connector invalidates the entry of every document it sees change in the DCP
+// stream, so documents of streamed collections are never served stale: a
+// fetch that was in flight when its key was invalidated is returned to the
+// caller but not cached.
+type Enricher struct {
+	fetcher        Fetcher
+	cache          *cache
+	fetchLatency   *latencyHistogram
+	scopeName      string
+	hits           atomic.Int64
+	misses         atomic.Int64
+	fetchLatencyMs atomic.Int64
+}
+
+// New returns an Enricher reading through fetcher. Collections given without
+// a scope are looked up in scopeName (_default when empty).
+func New(fetcher Fetcher, cfg config.Enrichment, scopeName string) *Enricher {
+	if scopeName == "" {
+		scopeName = defaultScopeName
+	}
+	return &Enricher{
+		fetcher:      fetcher,
+		cache:        newCache(cfg.CacheSize, cfg.TTL),
+		fetchLatency: newLatencyHistogram(),
+		scopeName:    scopeName,
+	}
+}
+
+// Get returns the value of the document key in collection (collection or
+// scope.collection), or nil when it does not exist.
+func (e *Enricher) Get(collection string, key []byte) ([]byte, error) {
+	values, err := e.GetMulti(collection, [][]byte{key})
+	if err != nil {
+		return nil, err
+	}
+	return values[string(key)], nil
+}
+
+// GetMulti returns the values of the documents of keys in collection, keyed
+// by document key. Uncached keys are fetched in a single batch; keys that do
+// not exist are left out of the result.
+func (e *Enricher) GetMulti(collection string, keys [][]byte) (map[string][]byte, error) {
+	scopeName, collectionName := e.split(collection)
+	qualified := scopeName + "." + collectionName
+
+	values := make(map[string][]byte, len(keys))
+	var missing [][]byte
+	for _, key := range keys {
+		value, found, ok := e.cache.get(cacheKey{collection: qualified, key: string(key)})
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		if found {
+			values[string(key)] = value
+		}
+	}
+	e.hits.Add(int64(len(keys) - len(missing)))
+	if len(missing) == 0 {
+		return values, nil
+	}
+	e.misses.Add(int64(len(missing)))
+
+	epoch := e.cache.beginFetch()
+	defer e.cache.endFetch()
+
+	start := time.Now()
+	fetched, err := e.fetcher.Fetch(scopeName, collectionName, missing)
+	latency := time.Since(start)
+	e.fetchLatencyMs.Store(latency.Milliseconds())
+	e.fetchLatency.observe(latency)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range missing {
+		value, found := fetched[string(key)]
+		e.cache.setSince(cacheKey{collection: qualified, key: string(key)}, value, found, epoch)
+		if found {
+			values[string(key)] = value
+		}
+	}
+	return values, nil
+}
+
+// Invalidate drops the cached value of the document key in collection
+// (collection or scope.collection).
+func (e *Enricher) Invalidate(collection string, key []byte) {
+	scopeName, collectionName := e.split(collection)
+	e.cache.delete(cacheKey{collection: scopeName + "." + collectionName, key: string(key)})
+}
+
+func (e *Enricher) Stats() Stats {
+	return Stats{
+		Hits:           e.hits.Load(),
+		Misses:         e.misses.Load(),
+		FetchLatencyMs: e.fetchLatencyMs.Load(),
+		FetchLatency:   e.fetchLatency.snapshot(),
+		Size:           e.cache.len(),
+	}
+}
+
+func (e *Enricher) split(collection string) (string, string) {
+	if scopeName, collectionName, ok := strings.Cut(collection, "."); ok {
+		return scopeName, collectionName
+	}
+	return e.scopeName, collection
+}
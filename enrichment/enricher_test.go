@@ -0,0 +1,156 @@
+package enrichment
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+)
+
+type fakeFetcher struct {
+	err       error
+	documents map[string][]byte
+	calls     [][]string
+}
+
+func (f *fakeFetcher) Fetch(scopeName, collectionName string, keys [][]byte) (map[string][]byte, error) {
+	call := []string{scopeName + "." + collectionName}
+	values := map[string][]byte{}
+	for _, key := range keys {
+		call = append(call, string(key))
+		if value, ok := f.documents[string(key)]; ok {
+			values[string(key)] = value
+		}
+	}
+	f.calls = append(f.calls, call)
+	return values, f.err
+}
+
+func newTestEnricher(fetcher Fetcher) *Enricher {
+	return New(fetcher, config.Enrichment{CacheSize: 2, TTL: time.Minute}, "")
+}
+
+func TestEnricher_GetMultiCaches(t *testing.T) {
+	fetcher := &fakeFetcher{documents: map[string][]byte{"p1": []byte(`{"name":"a"}`)}}
+	e := newTestEnricher(fetcher)
+
+	values, err := e.GetMulti("products", [][]byte{[]byte("p1"), []byte("p2")})
+	if err != nil || string(values["p1"]) != `{"name":"a"}` || len(values) != 1 {
+		t.Fatalf("GetMulti() = %v, %v", values, err)
+	}
+	if len(fetcher.calls) != 1 || fetcher.calls[0][0] != "_default.products" || len(fetcher.calls[0]) != 3 {
+		t.Fatalf("expected one batched fetch, got %v", fetcher.calls)
+	}
+
+	if value, err := e.Get("_default.products", []byte("p1")); err != nil || string(value) != `{"name":"a"}` {
+		t.Fatalf("Get() = %s, %v", value, err)
+	}
+	if value, err := e.Get("products", []byte("p2")); err != nil || value != nil {
+		t.Fatalf("missing document must be cached as nil, got %s, %v", value, err)
+	}
+	if len(fetcher.calls) != 1 {
+		t.Fatalf("cached keys must not be fetched again, got %v", fetcher.calls)
+	}
+	if stats := e.Stats(); stats.Hits != 2 || stats.Misses != 2 || stats.Size != 2 {
+		t.Fatalf("Stats() = %+v", stats)
+	}
+}
+
+func TestEnricher_Invalidate(t *testing.T) {
+	fetcher := &fakeFetcher{documents: map[string][]byte{"p1": []byte(`1`)}}
+	e := newTestEnricher(fetcher)
+
+	_, _ = e.Get("products", []byte("p1"))
+	fetcher.documents["p1"] = []byte(`2`)
+	e.Invalidate("_default.products", []byte("p1"))
+
+	if value, _ := e.Get("products", []byte("p1")); string(value) != `2` {
+		t.Fatalf("invalidated entry must be fetched again, got %s", value)
+	}
+}
+
+func TestEnricher_FetchError(t *testing.T) {
+	e := newTestEnricher(&fakeFetcher{err: errors.New("timeout")})
+	if _, err := e.Get("products", []byte("p1")); err == nil {
+		t.Fatal("expected the fetch error")
+	}
+	if e.Stats().Size != 0 {
+		t.Fatal("failed fetches must not be cached")
+	}
+}
+
+func TestCache_EvictsLeastRecentlyUsedAndExpired(t *testing.T) {
+	now := time.Now()
+	c := newCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	a, b, d := cacheKey{key: "a"}, cacheKey{key: "b"}, cacheKey{key: "d"}
+	c.set(a, []byte("a"), true)
+	c.set(b, []byte("b"), true)
+	c.get(a)
+	c.set(d, []byte("d"), true)
+
+	if _, _, ok := c.get(b); ok {
+		t.Fatal("least recently used entry must be evicted")
+	}
+	if _, _, ok := c.get(a); !ok {
+		t.Fatal("recently used entry must be kept")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, _, ok := c.get(a); ok {
+		t.Fatal("expired entry must not be returned")
+	}
+	if c.len() != 1 {
+		t.Fatalf("expired entry must be removed, len = %d", c.len())
+	}
+}
+
+// invalidatingFetcher invalidates the fetched key while the fetch is in
+// flight, as the connector does when the document changes in the DCP stream.
+type invalidatingFetcher struct {
+	enricher *Enricher
+	value    string
+}
+
+func (f *invalidatingFetcher) Fetch(_, _ string, keys [][]byte) (map[string][]byte, error) {
+	for _, key := range keys {
+		f.enricher.Invalidate("products", key)
+	}
+	return map[string][]byte{string(keys[0]): []byte(f.value)}, nil
+}
+
+func TestEnricher_InvalidateDuringFetchIsNotOverwritten(t *testing.T) {
+	fetcher := &invalidatingFetcher{value: `1`}
+	e := newTestEnricher(fetcher)
+	fetcher.enricher = e
+
+	if value, _ := e.Get("products", []byte("p1")); string(value) != `1` {
+		t.Fatalf("Get() = %s, the fetched value must still be returned", value)
+	}
+	if e.Stats().Size != 0 {
+		t.Fatal("a value fetched before its key was invalidated must not be cached")
+	}
+
+	fetcher.enricher = newTestEnricher(&fakeFetcher{})
+	fetcher.value = `2`
+	if value, _ := e.Get("products", []byte("p1")); string(value) != `2` || e.Stats().Size != 1 {
+		t.Fatalf("Get() = %s, size = %d, a later fetch must be cached", value, e.Stats().Size)
+	}
+}
+
+func TestEnricher_FetchLatencyHistogram(t *testing.T) {
+	e := newTestEnricher(&fakeFetcher{})
+	_, _ = e.Get("products", []byte("p1"))
+	_, _ = e.Get("products", []byte("p2"))
+
+	latency := e.Stats().FetchLatency
+	if latency.Count != 2 {
+		t.Fatalf("expected 2 observations, got %d", latency.Count)
+	}
+	last := fetchLatencyBuckets[len(fetchLatencyBuckets)-1]
+	if latency.Buckets[last] != 2 || len(latency.Buckets) != len(fetchLatencyBuckets) {
+		t.Fatalf("buckets must be cumulative, got %v", latency.Buckets)
+	}
+}
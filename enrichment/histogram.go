@@ -0,0 +1,58 @@
+package enrichment
+
+import (
+	"sync"
+	"time"
+)
+
+// fetchLatencyBuckets are the upper bounds, in milliseconds, of the fetch
+// latency histogram.
+var fetchLatencyBuckets = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// Histogram is a snapshot of the fetch latency distribution. Buckets are
+// cumulative and keyed by upper bound in milliseconds, as Prometheus expects.
+type Histogram struct {
+	Buckets map[float64]uint64
+	Count   uint64
+	SumMs   float64
+}
+
+type latencyHistogram struct {
+	counts []uint64
+	count  uint64
+	sumMs  float64
+	mu     sync.Mutex
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]uint64, len(fetchLatencyBuckets))}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range fetchLatencyBuckets {
+		if ms <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sumMs += ms
+}
+
+func (h *latencyHistogram) snapshot() Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[float64]uint64, len(fetchLatencyBuckets))
+	var cumulative uint64
+	for i, bound := range fetchLatencyBuckets {
+		cumulative += h.counts[i]
+		buckets[bound] = cumulative
+	}
+	return Histogram{Buckets: buckets, Count: h.count, SumMs: h.sumMs}
+}
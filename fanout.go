@@ -0,0 +1,239 @@
+package dcpelasticsearch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+const (
+	fanOutIDSeparator        = "::"
+	defaultFanOutCacheSize   = 10000
+	fanOutStateChildrenField = "children"
+)
+
+// FanOut describes how NewFanOutMapper indexes the elements of an array of a
+// Couchbase document, such as the lines of an order, as documents of their
+// own.
+type FanOut[T, E any] struct {
+	// Elements returns the elements of the parent document to index.
+	Elements func(parent *T) []E
+	// Key returns the key of an element, unique within its parent. The ID of
+	// the element's document is "<parent key>::<element key>".
+	Key func(element E) string
+	// Index is the index of the element documents. When empty, the
+	// collection's collectionIndexMapping entry is used.
+	Index string
+	// StateIndex is the side index that keeps, per parent, the IDs of the
+	// element documents last emitted for the parent. The state document of a
+	// parent is "<collection>::<parent key>", so that parents with the same
+	// key in different collections do not share it.
+	StateIndex string
+	// CacheSize bounds the in-memory copy of the state of recently mapped
+	// parents, 10000 by default.
+	CacheSize int
+}
+
+// NewFanOutMapper returns a mapper that decodes the value of mutations into
+// T and indexes every element f.Elements returns as its own document. The
+// IDs of the emitted documents are kept per parent in f.StateIndex; the
+// documents of elements that disappeared since the previous mutation, and all
+// of them when the parent is deleted or expires, are deleted. A value that
+// cannot be decoded or state that cannot be read is a mapping error.
+func NewFanOutMapper[T, E any](f FanOut[T, E]) (ErrorMapper, error) {
+	if f.Elements == nil || f.Key == nil {
+		return nil, errors.New("fan-out: Elements and Key are required")
+	}
+	if f.StateIndex == "" {
+		return nil, errors.New("fan-out: StateIndex is required")
+	}
+	if f.CacheSize <= 0 {
+		f.CacheSize = defaultFanOutCacheSize
+	}
+	state := newFanOutState(f.StateIndex, f.CacheSize)
+
+	return func(event couchbase.Event) ([]document.ESActionDocument, error) {
+		parentKey := string(event.Key)
+		stateID := fanOutStateID(event)
+		previous, found, err := state.get(event.ElasticsearchClient, stateID)
+		if err != nil {
+			return nil, fmt.Errorf("fan-out state of %s: %w", stateID, err)
+		}
+
+		var actions []document.ESActionDocument
+		current := make([]string, 0)
+		if event.IsMutated {
+			parent := new(T)
+			if err := jsoniter.Unmarshal(event.Value, parent); err != nil {
+				return nil, fmt.Errorf("decode %T: %w", *parent, err)
+			}
+			if actions, current, err = f.children(parentKey, parent); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, id := range removedChildren(previous, current) {
+			actions = append(actions, f.child(document.DeleteAction([]byte(id))))
+		}
+		// State documents are routed by their ID, as the state is read with a
+		// plain get, whatever collectionRoutingMapping says.
+		if event.IsMutated {
+			source, _ := jsoniter.Marshal(map[string][]string{fanOutStateChildrenField: current})
+			actions = append(actions, document.IndexAction([]byte(stateID)).Source(source).Index(f.StateIndex).Routing(stateID).Build())
+		} else if found {
+			actions = append(actions, document.DeleteAction([]byte(stateID)).Index(f.StateIndex).Routing(stateID).Build())
+		}
+
+		state.set(stateID, current, event.IsMutated)
+		return actions, nil
+	}, nil
+}
+
+// fanOutStateID returns the ID of the state document of the event's parent,
+// qualified with its collection (scope.collection when the scope is known).
+func fanOutStateID(event couchbase.Event) string {
+	collection := event.CollectionName
+	if event.ScopeName != "" {
+		collection = event.QualifiedCollectionName()
+	}
+	return collection + fanOutIDSeparator + string(event.Key)
+}
+
+// children returns the index actions of the elements of parent and their
+// IDs. Of elements with the same key, the last one wins.
+func (f FanOut[T, E]) children(parentKey string, parent *T) ([]document.ESActionDocument, []string, error) {
+	elements := f.Elements(parent)
+	actions := make([]document.ESActionDocument, 0, len(elements)+1)
+	ids := make([]string, 0, len(elements))
+	positions := make(map[string]int, len(elements))
+
+	for _, element := range elements {
+		id := parentKey + fanOutIDSeparator + f.Key(element)
+		source, err := jsoniter.Marshal(element)
+		if err != nil {
+			return nil, nil, fmt.Errorf("encode %T: %w", element, err)
+		}
+		action := f.child(document.IndexAction([]byte(id)).Source(source))
+		if i, ok := positions[id]; ok {
+			actions[i] = action
+			continue
+		}
+		positions[id] = len(actions)
+		actions = append(actions, action)
+		ids = append(ids, id)
+	}
+	return actions, ids, nil
+}
+
+func (f FanOut[T, E]) child(builder *document.ActionBuilder) document.ESActionDocument {
+	if f.Index != "" {
+		builder.Index(f.Index)
+	}
+	return builder.Build()
+}
+
+// removedChildren returns the IDs of previous that are not in current.
+func removedChildren(previous, current []string) []string {
+	kept := make(map[string]struct{}, len(current))
+	for _, id := range current {
+		kept[id] = struct{}{}
+	}
+	var removed []string
+	for _, id := range previous {
+		if _, ok := kept[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	return removed
+}
+
+type fanOutEntry struct {
+	children []string
+	found    bool
+}
+
+// fanOutState reads the child IDs of a parent from the state index. The
+// state of recently mapped parents is also kept in memory, since its write
+// may still be waiting in the batch when the parent changes again. The
+// memory is bounded with two generations: when the current one is full, it
+// replaces the previous one.
+type fanOutState struct {
+	current  map[string]fanOutEntry
+	previous map[string]fanOutEntry
+	index    string
+	size     int
+	mu       sync.Mutex
+}
+
+func newFanOutState(index string, size int) *fanOutState {
+	return &fanOutState{index: index, size: size, current: make(map[string]fanOutEntry)}
+}
+
+// get returns the child IDs last emitted for the parent of stateID, and
+// whether the parent has a state document.
+func (s *fanOutState) get(esClient *elasticsearch.Client, stateID string) ([]string, bool, error) {
+	s.mu.Lock()
+	entry, ok := s.current[stateID]
+	if !ok {
+		entry, ok = s.previous[stateID]
+	}
+	s.mu.Unlock()
+	if ok {
+		return entry.children, entry.found, nil
+	}
+	return getFanOutChildren(esClient, s.index, stateID)
+}
+
+func (s *fanOutState) set(stateID string, children []string, found bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.current) >= s.size {
+		s.previous, s.current = s.current, make(map[string]fanOutEntry, s.size)
+	}
+	s.current[stateID] = fanOutEntry{children: children, found: found}
+}
+
+func getFanOutChildren(esClient *elasticsearch.Client, index, stateID string) ([]string, bool, error) {
+	resp, err := esapi.GetRequest{
+		Index:          index,
+		DocumentID:     stateID,
+		SourceIncludes: []string{fanOutStateChildrenField},
+	}.Do(context.Background(), esClient)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.IsError() {
+		return nil, false, fmt.Errorf("get %s/%s: %s", index, stateID, resp.String())
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	var body struct {
+		Source struct {
+			Children []string `json:"children"`
+		} `json:"_source"`
+		Found bool `json:"found"`
+	}
+	if err := jsoniter.Unmarshal(raw, &body); err != nil {
+		return nil, false, fmt.Errorf("get %s/%s: %w", index, stateID, err)
+	}
+	return body.Source.Children, body.Found, nil
+}
@@ -0,0 +1,157 @@
+package dcpelasticsearch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+type fanOutOrder struct {
+	Lines []fanOutLine `json:"lines"`
+}
+
+type fanOutLine struct {
+	Sku string `json:"sku"`
+	Qty int    `json:"qty"`
+}
+
+// stateServer serves the state document of order::1 of the orders collection
+// with three children.
+func stateServer(t *testing.T, gets *atomic.Int32) *elasticsearch.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/":
+			_, _ = w.Write([]byte(`{"version":{"number":"7.17.0","build_flavor":"default"},"tagline":"You Know, for Search"}`))
+		case strings.HasSuffix(r.URL.Path, "/orders::order::1"):
+			gets.Add(1)
+			_, _ = w.Write([]byte(`{"found":true,"_source":{"children":["order::1::a","order::1::b","order::1::c"]}}`))
+		default:
+			gets.Add(1)
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"found":false}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatalf("build es client: %v", err)
+	}
+	return c
+}
+
+func actionSummary(actions []document.ESActionDocument) []string {
+	summary := make([]string, len(actions))
+	for i, action := range actions {
+		summary[i] = string(action.Type) + " " + action.IndexName + "/" + string(action.ID)
+	}
+	return summary
+}
+
+func TestNewFanOutMapper_DeletesOrphans(t *testing.T) {
+	var gets atomic.Int32
+	esClient := stateServer(t, &gets)
+	mapper, err := NewFanOutMapper(FanOut[fanOutOrder, fanOutLine]{
+		Elements:   func(order *fanOutOrder) []fanOutLine { return order.Lines },
+		Key:        func(line fanOutLine) string { return line.Sku },
+		Index:      "order-lines",
+		StateIndex: "order-lines-state",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	steps := []struct {
+		event couchbase.Event
+		want  string
+	}{
+		{
+			couchbase.NewMutateEvent(esClient, []byte("order::1"), []byte(`{"lines":[{"sku":"a","qty":1},{"sku":"b","qty":2}]}`),
+				"orders", 1, time.Time{}, 0, 1, 1),
+			"Index order-lines/order::1::a,Index order-lines/order::1::b,Delete order-lines/order::1::c," +
+				"Index order-lines-state/orders::order::1",
+		},
+		{
+			couchbase.NewMutateEvent(esClient, []byte("order::1"), []byte(`{"lines":[{"sku":"a","qty":3}]}`),
+				"orders", 2, time.Time{}, 0, 2, 2),
+			"Index order-lines/order::1::a,Delete order-lines/order::1::b,Index order-lines-state/orders::order::1",
+		},
+		{
+			couchbase.NewDeleteEvent(esClient, []byte("order::1"), nil, "orders", 3, time.Time{}, 0, 3, 3),
+			"Delete order-lines/order::1::a,Delete order-lines-state/orders::order::1",
+		},
+		{
+			couchbase.NewDeleteEvent(esClient, []byte("order::2"), nil, "orders", 4, time.Time{}, 0, 4, 4),
+			"",
+		},
+	}
+	for i, step := range steps {
+		actions, err := mapper(step.event)
+		if err != nil {
+			t.Fatalf("step %d: unexpected error: %v", i, err)
+		}
+		if got := strings.Join(actionSummary(actions), ","); got != step.want {
+			t.Fatalf("step %d: got %s, want %s", i, got, step.want)
+		}
+	}
+
+	if got := gets.Load(); got != 2 {
+		t.Fatalf("state must be read once per unseen parent, got %d gets", got)
+	}
+}
+
+func TestNewFanOutMapper_RequiresStateIndex(t *testing.T) {
+	_, err := NewFanOutMapper(FanOut[fanOutOrder, fanOutLine]{
+		Elements: func(order *fanOutOrder) []fanOutLine { return order.Lines },
+		Key:      func(line fanOutLine) string { return line.Sku },
+	})
+	if err == nil {
+		t.Fatal("expected an error without StateIndex")
+	}
+}
+
+func TestNewFanOutMapper_StateIsPerCollection(t *testing.T) {
+	var gets atomic.Int32
+	esClient := stateServer(t, &gets)
+	mapper, err := NewFanOutMapper(FanOut[fanOutOrder, fanOutLine]{
+		Elements:   func(order *fanOutOrder) []fanOutLine { return order.Lines },
+		Key:        func(line fanOutLine) string { return line.Sku },
+		StateIndex: "order-lines-state",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	archived := couchbase.NewMutateEvent(esClient, []byte("order::1"), []byte(`{"lines":[{"sku":"x","qty":1}]}`),
+		"archived_orders", 1, time.Time{}, 0, 1, 1)
+	archived.ScopeName = "sales"
+	actions, err := mapper(archived)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := strings.Join(actionSummary(actions), ","),
+		"Index /order::1::x,Index order-lines-state/sales.archived_orders::order::1"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	// The parent with the same key in orders must still read its own state.
+	actions, err = mapper(couchbase.NewDeleteEvent(esClient, []byte("order::1"), nil, "orders", 2, time.Time{}, 0, 2, 2))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := strings.Join(actionSummary(actions), ","),
+		"Delete /order::1::a,Delete /order::1::b,Delete /order::1::c,Delete order-lines-state/orders::order::1"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
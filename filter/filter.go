@@ -0,0 +1,108 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+)
+
+// Event types an expression can compare type with.
+const (
+	EventTypeMutation   = "mutation"
+	EventTypeDeletion   = "deletion"
+	EventTypeExpiration = "expiration"
+)
+
+// Filter decides with an expr expression (https://expr-lang.org) whether an
+// event is mapped. The expression sees:
+//
+//	key         the document key
+//	collection  the collection name
+//	type        mutation, deletion or expiration
+//	value       the document value decoded from JSON, nil when it is not JSON
+//
+// Deletions and expirations carry no value, so an expression written against
+// the document cannot judge them. They always match without running the
+// expression: the document may have been indexed by an earlier mutation, and
+// dropping the delete would leave it stale in Elasticsearch.
+type Filter struct {
+	program     *vm.Program
+	decodeValue bool
+}
+
+type env struct {
+	Value      any    `expr:"value"`
+	Key        string `expr:"key"`
+	Collection string `expr:"collection"`
+	Type       string `expr:"type"`
+}
+
+// New compiles expression, which must evaluate to a bool.
+func New(expression string) (*Filter, error) {
+	program, err := expr.Compile(expression, expr.Env(env{}), expr.AsBool())
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{program: program, decodeValue: strings.Contains(expression, "value")}, nil
+}
+
+// Match reports whether event matches the expression. Deletions and
+// expirations always match.
+func (f *Filter) Match(event couchbase.Event) (bool, error) {
+	if !event.IsMutated {
+		return true, nil
+	}
+
+	e := env{Key: string(event.Key), Collection: event.CollectionName, Type: eventType(event)}
+	if f.decodeValue && len(event.Value) > 0 {
+		if err := jsoniter.Unmarshal(event.Value, &e.Value); err != nil {
+			e.Value = nil
+		}
+	}
+
+	result, err := expr.Run(f.program, e)
+	if err != nil {
+		return false, err
+	}
+	return result.(bool), nil
+}
+
+// NewFilters compiles the expression of every collection in filters
+// (elasticsearch.filter).
+func NewFilters(filters map[string]string) (map[string]*Filter, error) {
+	compiled := make(map[string]*Filter, len(filters))
+	for collection, expression := range filters {
+		f, err := New(expression)
+		if err != nil {
+			return nil, fmt.Errorf("elasticsearch.filter.%s: %w", collection, err)
+		}
+		compiled[collection] = f
+	}
+	return compiled, nil
+}
+
+// Lookup returns the filter of the event's collection, preferring a
+// scope.collection key of filters over a collection key.
+func Lookup(filters map[string]*Filter, event couchbase.Event) (*Filter, bool) {
+	if f, ok := filters[event.QualifiedCollectionName()]; ok {
+		return f, true
+	}
+	f, ok := filters[event.CollectionName]
+	return f, ok
+}
+
+func eventType(event couchbase.Event) string {
+	switch {
+	case event.IsDeleted:
+		return EventTypeDeletion
+	case event.IsExpired:
+		return EventTypeExpiration
+	default:
+		return EventTypeMutation
+	}
+}
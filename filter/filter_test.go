@@ -0,0 +1,98 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+)
+
+func TestFilter_Match(t *testing.T) {
+	mutation := couchbase.NewMutateEvent(nil, []byte("order::1"), []byte(`{"status":"paid","total":12.5,"tags":["a"]}`),
+		"orders", 1, time.Time{}, 0, 1, 1)
+	deletion := couchbase.NewDeleteEvent(nil, []byte("order::1"), nil, "orders", 1, time.Time{}, 0, 1, 1)
+	expiration := couchbase.NewExpireEvent(nil, []byte("order::1"), nil, "orders", 1, time.Time{}, 0, 1, 1)
+
+	tests := []struct {
+		name       string
+		expression string
+		event      couchbase.Event
+		want       bool
+	}{
+		{"json_field", `value.status == "paid" && value.total > 10`, mutation, true},
+		{"json_field_mismatch", `value.status == "draft"`, mutation, false},
+		{"key_prefix", `key startsWith "order::"`, mutation, true},
+		{"collection", `collection == "users"`, mutation, false},
+		{"type", `type == "deletion"`, deletion, true},
+		{"deletion_has_no_value", `type == "deletion" || value.status == "paid"`, deletion, true},
+		{"deletion_always_matches", `value.status == "active"`, deletion, true},
+		{"expiration_always_matches", `value.total > 10`, expiration, true},
+		{"deletion_ignores_type", `type == "mutation"`, deletion, true},
+		{"array", `"a" in value.tags`, mutation, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.expression)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, err := f.Match(tt.event)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFilters_Errors(t *testing.T) {
+	if _, err := NewFilters(map[string]string{"orders": `key + 1`}); err == nil {
+		t.Fatal("non-bool expression must be rejected")
+	}
+	if _, err := NewFilters(map[string]string{"orders": `unknown == 1`}); err == nil {
+		t.Fatal("unknown variable must be rejected")
+	}
+}
+
+func TestFilter_MatchRuntimeError(t *testing.T) {
+	f, err := New(`value.total > 10`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	event := couchbase.NewMutateEvent(nil, []byte("k"), []byte(`{}`), "orders", 1, time.Time{}, 0, 1, 1)
+	if _, err := f.Match(event); err == nil {
+		t.Fatal("comparing a missing field with a number must return an error")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	filters, err := NewFilters(map[string]string{
+		"orders":        `key startsWith "order::"`,
+		"sales.orders":  `key startsWith "sale::"`,
+		"sales.refunds": `true`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		scope, collection string
+		want              *Filter
+	}{
+		{"sales", "orders", filters["sales.orders"]},
+		{"inventory", "orders", filters["orders"]},
+		{"", "orders", filters["orders"]},
+		{"sales", "refunds", filters["sales.refunds"]},
+		{"inventory", "refunds", nil},
+	}
+	for _, tt := range tests {
+		event := couchbase.Event{ScopeName: tt.scope, CollectionName: tt.collection}
+		got, ok := Lookup(filters, event)
+		if got != tt.want || ok != (tt.want != nil) {
+			t.Fatalf("Lookup(%s.%s) = %p, %v, want %p", tt.scope, tt.collection, got, ok, tt.want)
+		}
+	}
+}
@@ -1,15 +1,149 @@
 package dcpelasticsearch
 
 import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
 	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/script"
+	"github.com/Trendyol/go-dcp-elasticsearch/enrichment"
+	"github.com/Trendyol/go-dcp-elasticsearch/mapping"
 )
 
 type Mapper func(event couchbase.Event) []document.ESActionDocument
 
+// ErrorMapper is a Mapper that can fail. Its errors are counted, passed to a
+// SinkResponseHandler implementing elasticsearch.MappingErrorHandler, and
+// then skip the event or stop the connector depending on
+// elasticsearch.mappingErrorPolicy.
+type ErrorMapper func(event couchbase.Event) ([]document.ESActionDocument, error)
+
+// MapperContext holds what the connector creates from its configuration for
+// mappers, see ConnectorBuilder.SetMapperFactory.
+type MapperContext struct {
+	// ScriptRegistry resolves the stored scripts configured under
+	// elasticsearch.scripts.
+	ScriptRegistry *script.Registry
+	// Enricher looks up other Couchbase documents through a cache, see
+	// elasticsearch.enrichment.
+	Enricher *enrichment.Enricher
+}
+
+// MapperFactory builds a mapper from the connector's MapperContext.
+type MapperFactory func(ctx MapperContext) (ErrorMapper, error)
+
+// toErrorMapper adapts a Mapper that never fails to an ErrorMapper.
+func toErrorMapper(mapper Mapper) ErrorMapper {
+	if mapper == nil {
+		return nil
+	}
+	return func(event couchbase.Event) ([]document.ESActionDocument, error) {
+		return mapper(event), nil
+	}
+}
+
 func DefaultMapper(event couchbase.Event) []document.ESActionDocument {
 	if event.IsMutated {
 		return []document.ESActionDocument{document.NewIndexAction(event.Key, event.Value, nil)}
 	}
 	return []document.ESActionDocument{document.NewDeleteAction(event.Key, nil)}
 }
+
+// checkExternalVersioning returns an error when an enabled
+// elasticsearch.externalVersioning has a source or type Elasticsearch cannot
+// use, so a typo fails at startup instead of failing every bulk item. Only the
+// default cluster's block is used, so a block in a clusters entry is an error
+// too.
+func checkExternalVersioning(es config.Elasticsearch) error {
+	for _, clusterKey := range slices.Sorted(maps.Keys(es.Clusters)) {
+		if es.Clusters[clusterKey].ExternalVersioning != nil {
+			return fmt.Errorf("elasticsearch.clusters.%s.externalVersioning: only elasticsearch.externalVersioning is used", clusterKey)
+		}
+	}
+
+	versioning := es.ExternalVersioning
+	if versioning == nil || !versioning.Enabled {
+		return nil
+	}
+	switch versioning.Source {
+	case config.VersionSourceCas, config.VersionSourceRevNo:
+	default:
+		return fmt.Errorf("elasticsearch.externalVersioning.source: unknown source %q", versioning.Source)
+	}
+	switch document.VersionType(versioning.Type) {
+	case document.VersionTypeExternal, document.VersionTypeExternalGte:
+	default:
+		return fmt.Errorf("elasticsearch.externalVersioning.type: unknown type %q", versioning.Type)
+	}
+	return nil
+}
+
+// NewDefaultMapper returns DefaultMapper, stamping every action with an
+// external version taken from the event when versioning is enabled.
+func NewDefaultMapper(versioning *config.ExternalVersioning) Mapper {
+	if versioning == nil || !versioning.Enabled {
+		return DefaultMapper
+	}
+
+	return func(event couchbase.Event) []document.ESActionDocument {
+		version := event.Cas
+		if versioning.Source == config.VersionSourceRevNo {
+			version = event.RevNo
+		}
+
+		actions := DefaultMapper(event)
+		for i := range actions {
+			actions[i].Version = &version
+			actions[i].VersionType = document.VersionType(versioning.Type)
+		}
+		return actions
+	}
+}
+
+// newDocumentMappingErrorMapper returns a mapper that reshapes the value of
+// mutations in the collections listed in mappings (elasticsearch.documentMappings)
+// and passes the event on to next. A value that cannot be reshaped is reported
+// as a mapping error, so fields the mapping excludes are never written.
+func newDocumentMappingErrorMapper(mappings map[string]config.DocumentMapping, next ErrorMapper) (ErrorMapper, error) {
+	reshape, err := newDocumentMapping(mappings)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(event couchbase.Event) ([]document.ESActionDocument, error) {
+		if err := reshape(&event); err != nil {
+			return nil, fmt.Errorf("document mapping: %w", err)
+		}
+		return next(event)
+	}, nil
+}
+
+// newDocumentMapping returns a function that reshapes the value of a mutation
+// event in place when its collection has a document mapping.
+func newDocumentMapping(mappings map[string]config.DocumentMapping) (func(event *couchbase.Event) error, error) {
+	transformers := make(map[string]*mapping.Transformer, len(mappings))
+	for collection, m := range mappings {
+		t, err := mapping.New(m)
+		if err != nil {
+			return nil, fmt.Errorf("elasticsearch.documentMappings.%s: %w", collection, err)
+		}
+		transformers[collection] = t
+	}
+
+	return func(event *couchbase.Event) error {
+		t, ok := transformers[event.CollectionName]
+		if !ok || !event.IsMutated {
+			return nil
+		}
+
+		value, err := t.Transform(event.Value)
+		if err != nil {
+			return err
+		}
+		event.Value = value
+		return nil
+	}, nil
+}
@@ -0,0 +1,37 @@
+package dcpelasticsearch
+
+import (
+	"testing"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+)
+
+func TestCheckExternalVersioning(t *testing.T) {
+	tests := []struct {
+		versioning *config.ExternalVersioning
+		clusters   map[string]config.Elasticsearch
+		name       string
+		wantErr    bool
+	}{
+		{name: "nil", versioning: nil},
+		{name: "disabled", versioning: &config.ExternalVersioning{Type: "externl"}},
+		{name: "external", versioning: &config.ExternalVersioning{Enabled: true, Source: "cas", Type: "external"}},
+		{name: "external_gte", versioning: &config.ExternalVersioning{Enabled: true, Source: "revNo", Type: "external_gte"}},
+		{name: "unknown_type", versioning: &config.ExternalVersioning{Enabled: true, Source: "cas", Type: "externl"}, wantErr: true},
+		{name: "unknown_source", versioning: &config.ExternalVersioning{Enabled: true, Source: "seqNo", Type: "external"}, wantErr: true},
+		{name: "cluster_without_block", clusters: map[string]config.Elasticsearch{"eu": {}}},
+		{
+			name:     "cluster_block",
+			clusters: map[string]config.Elasticsearch{"eu": {ExternalVersioning: &config.ExternalVersioning{Enabled: true}}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkExternalVersioning(config.Elasticsearch{ExternalVersioning: tt.versioning, Clusters: tt.clusters})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
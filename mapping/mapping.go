@@ -0,0 +1,210 @@
+package mapping
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+)
+
+const defaultFlattenSeparator = "_"
+
+var json = jsoniter.Config{UseNumber: true, SortMapKeys: true}.Froze()
+
+// Transformer applies a config.DocumentMapping to JSON documents.
+type Transformer struct {
+	mapping   config.DocumentMapping
+	separator string
+}
+
+// New validates m and returns a Transformer for it.
+func New(m config.DocumentMapping) (*Transformer, error) {
+	for field, typ := range m.Coerce {
+		switch typ {
+		case config.CoerceString, config.CoerceInt, config.CoerceFloat, config.CoerceBool:
+		default:
+			return nil, fmt.Errorf("coerce %q: unknown type %q", field, typ)
+		}
+	}
+
+	separator := m.FlattenSeparator
+	if separator == "" {
+		separator = defaultFlattenSeparator
+	}
+	return &Transformer{mapping: m, separator: separator}, nil
+}
+
+// Transform returns value reshaped by the mapping. value must be a JSON
+// object.
+func (t *Transformer) Transform(value []byte) ([]byte, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("document is not a JSON object")
+	}
+
+	for _, path := range t.mapping.Flatten {
+		flattenPath(doc, path, t.separator)
+	}
+	if len(t.mapping.Include) > 0 {
+		doc = include(doc, t.mapping.Include)
+	}
+	for _, path := range t.mapping.Exclude {
+		deletePath(doc, path)
+	}
+	rename(doc, t.mapping.Rename)
+	for _, path := range slices.Sorted(maps.Keys(t.mapping.Coerce)) {
+		typ := t.mapping.Coerce[path]
+		v, ok := getPath(doc, path)
+		if !ok || v == nil {
+			continue
+		}
+		coerced, err := coerce(v, typ)
+		if err != nil {
+			return nil, fmt.Errorf("coerce %q: %w", path, err)
+		}
+		setPath(doc, path, coerced)
+	}
+	for _, path := range slices.Sorted(maps.Keys(t.mapping.Constant)) {
+		setPath(doc, path, t.mapping.Constant[path])
+	}
+
+	return json.Marshal(doc)
+}
+
+// rename moves fields as if all renames ran at once: every source field is
+// read before any is moved, so chained renames (a→b, b→c) move the original
+// values and a swap works. When renames share a target, the one with the
+// greatest source name wins.
+func rename(doc map[string]any, renames map[string]string) {
+	froms := slices.Sorted(maps.Keys(renames))
+	values := make([]any, len(froms))
+	found := make([]bool, len(froms))
+	for i, from := range froms {
+		values[i], found[i] = getPath(doc, from)
+	}
+	for i, from := range froms {
+		if found[i] {
+			deletePath(doc, from)
+		}
+	}
+	for i, from := range froms {
+		if found[i] {
+			setPath(doc, renames[from], values[i])
+		}
+	}
+}
+
+func getPath(doc map[string]any, path string) (any, bool) {
+	parent, key, ok := parentOf(doc, path, false)
+	if !ok {
+		return nil, false
+	}
+	v, ok := parent[key]
+	return v, ok
+}
+
+func setPath(doc map[string]any, path string, v any) {
+	parent, key, _ := parentOf(doc, path, true)
+	parent[key] = v
+}
+
+func deletePath(doc map[string]any, path string) {
+	if parent, key, ok := parentOf(doc, path, false); ok {
+		delete(parent, key)
+	}
+}
+
+// parentOf returns the object holding the last segment of a dotted path and
+// that segment. With create, missing or non-object intermediate fields are
+// replaced with empty objects.
+func parentOf(doc map[string]any, path string, create bool) (map[string]any, string, bool) {
+	segments := strings.Split(path, ".")
+	current := doc
+	for _, segment := range segments[:len(segments)-1] {
+		next, ok := current[segment].(map[string]any)
+		if !ok {
+			if !create {
+				return nil, "", false
+			}
+			next = make(map[string]any)
+			current[segment] = next
+		}
+		current = next
+	}
+	return current, segments[len(segments)-1], true
+}
+
+func include(doc map[string]any, paths []string) map[string]any {
+	result := make(map[string]any, len(paths))
+	for _, path := range paths {
+		if v, ok := getPath(doc, path); ok {
+			setPath(result, path, v)
+		}
+	}
+	return result
+}
+
+// flattenPath replaces the object at path with its leaf fields, keyed by their
+// path relative to the object's parent joined with separator.
+func flattenPath(doc map[string]any, path, separator string) {
+	parent, key, ok := parentOf(doc, path, false)
+	if !ok {
+		return
+	}
+	object, ok := parent[key].(map[string]any)
+	if !ok {
+		return
+	}
+	delete(parent, key)
+	flattenInto(parent, key, object, separator)
+}
+
+func flattenInto(target map[string]any, prefix string, object map[string]any, separator string) {
+	for k, v := range object {
+		name := prefix + separator + k
+		if nested, ok := v.(map[string]any); ok && len(nested) > 0 {
+			flattenInto(target, name, nested, separator)
+			continue
+		}
+		target[name] = v
+	}
+}
+
+func coerce(v any, typ string) (any, error) {
+	s := fmt.Sprint(v)
+	switch typ {
+	case config.CoerceString:
+		if _, ok := v.(string); ok {
+			return v, nil
+		}
+		if _, ok := v.(map[string]any); ok {
+			return json.MarshalToString(v)
+		}
+		if _, ok := v.([]any); ok {
+			return json.MarshalToString(v)
+		}
+		return s, nil
+	case config.CoerceInt:
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		return int64(f), nil
+	case config.CoerceFloat:
+		return strconv.ParseFloat(s, 64)
+	case config.CoerceBool:
+		return strconv.ParseBool(s)
+	}
+	return nil, fmt.Errorf("unknown type %q", typ)
+}
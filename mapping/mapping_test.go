@@ -0,0 +1,94 @@
+package mapping
+
+import (
+	"testing"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+)
+
+func TestTransformer_Transform(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping config.DocumentMapping
+		value   string
+		want    string
+	}{
+		{
+			name:    "include",
+			mapping: config.DocumentMapping{Include: []string{"id", "address.city"}},
+			value:   `{"id":1,"secret":"x","address":{"city":"ist","zip":"34"}}`,
+			want:    `{"address":{"city":"ist"},"id":1}`,
+		},
+		{
+			name:    "exclude",
+			mapping: config.DocumentMapping{Exclude: []string{"secret", "address.zip"}},
+			value:   `{"id":1,"secret":"x","address":{"city":"ist","zip":"34"}}`,
+			want:    `{"address":{"city":"ist"},"id":1}`,
+		},
+		{
+			name:    "rename",
+			mapping: config.DocumentMapping{Rename: map[string]string{"name": "title", "meta.by": "author"}},
+			value:   `{"name":"a","meta":{"by":"b"}}`,
+			want:    `{"author":"b","meta":{},"title":"a"}`,
+		},
+		{
+			name:    "chained_rename",
+			mapping: config.DocumentMapping{Rename: map[string]string{"a": "b", "b": "c", "c": "a"}},
+			value:   `{"a":1,"b":2,"c":3,"d":4}`,
+			want:    `{"a":3,"b":1,"c":2,"d":4}`,
+		},
+		{
+			name:    "constant",
+			mapping: config.DocumentMapping{Constant: map[string]any{"source": "couchbase", "meta.v": 2}},
+			value:   `{"id":1}`,
+			want:    `{"id":1,"meta":{"v":2},"source":"couchbase"}`,
+		},
+		{
+			name:    "flatten",
+			mapping: config.DocumentMapping{Flatten: []string{"address"}},
+			value:   `{"address":{"city":"ist","geo":{"lat":41}}}`,
+			want:    `{"address_city":"ist","address_geo_lat":41}`,
+		},
+		{
+			name: "coerce",
+			mapping: config.DocumentMapping{Coerce: map[string]string{
+				"price": config.CoerceFloat, "count": config.CoerceInt, "active": config.CoerceBool, "id": config.CoerceString,
+			}},
+			value: `{"price":"9.5","count":"3","active":"true","id":12345678901234567890}`,
+			want:  `{"active":true,"count":3,"id":"12345678901234567890","price":9.5}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer, err := New(tt.mapping)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// Map iteration order is random, so run each mapping more than once.
+			for range 20 {
+				got, err := transformer.Transform([]byte(tt.value))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if string(got) != tt.want {
+					t.Fatalf("Transform() = %s, want %s", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTransformer_Errors(t *testing.T) {
+	if _, err := New(config.DocumentMapping{Coerce: map[string]string{"a": "date"}}); err == nil {
+		t.Fatal("unknown coerce type must be rejected")
+	}
+
+	transformer, _ := New(config.DocumentMapping{Coerce: map[string]string{"a": config.CoerceInt}})
+	if _, err := transformer.Transform([]byte(`{"a":"x"}`)); err == nil {
+		t.Fatal("failed coercion must return an error")
+	}
+	if _, err := transformer.Transform([]byte(`[1]`)); err == nil {
+		t.Fatal("non-object value must return an error")
+	}
+}
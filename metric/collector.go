@@ -1,7 +1,10 @@
 package metric
 
 import (
+	"time"
+
 	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/bulk"
+	"github.com/Trendyol/go-dcp-elasticsearch/enrichment"
 	"github.com/Trendyol/go-dcp/helpers"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -12,6 +15,11 @@ type Collector struct {
 	processLatency            *prometheus.Desc
 	bulkRequestProcessLatency *prometheus.Desc
 	actionCounter             *prometheus.Desc
+	mappingErrorCounter       *prometheus.Desc
+	filteredEventCounter      *prometheus.Desc
+	filterErrorCounter        *prometheus.Desc
+	unmappedCollectionCounter *prometheus.Desc
+	schemaViolationCounter    *prometheus.Desc
 }
 
 func (s *Collector) Describe(ch chan<- *prometheus.Desc) {
@@ -56,6 +64,24 @@ func (s *Collector) Collect(ch chan<- prometheus.Metric) {
 		)
 	}
 
+	for indexName, count := range bulkMetric.CreationSuccessActionCounter {
+		ch <- prometheus.MustNewConstMetric(
+			s.actionCounter,
+			prometheus.CounterValue,
+			float64(count),
+			"create", "success", indexName,
+		)
+	}
+
+	for indexName, count := range bulkMetric.CreationErrorActionCounter {
+		ch <- prometheus.MustNewConstMetric(
+			s.actionCounter,
+			prometheus.CounterValue,
+			float64(count),
+			"create", "error", indexName,
+		)
+	}
+
 	for indexName, count := range bulkMetric.DeletionSuccessActionCounter {
 		ch <- prometheus.MustNewConstMetric(
 			s.actionCounter,
@@ -73,6 +99,51 @@ func (s *Collector) Collect(ch chan<- prometheus.Metric) {
 			"delete", "error", indexName,
 		)
 	}
+
+	for collectionName, count := range bulkMetric.MappingErrorCounter {
+		ch <- prometheus.MustNewConstMetric(
+			s.mappingErrorCounter,
+			prometheus.CounterValue,
+			float64(count),
+			collectionName,
+		)
+	}
+
+	for collectionName, count := range bulkMetric.FilteredEventCounter {
+		ch <- prometheus.MustNewConstMetric(
+			s.filteredEventCounter,
+			prometheus.CounterValue,
+			float64(count),
+			collectionName,
+		)
+	}
+
+	for collectionName, count := range bulkMetric.FilterErrorCounter {
+		ch <- prometheus.MustNewConstMetric(
+			s.filterErrorCounter,
+			prometheus.CounterValue,
+			float64(count),
+			collectionName,
+		)
+	}
+
+	for collectionName, count := range bulkMetric.UnmappedCollectionSkipCounter {
+		ch <- prometheus.MustNewConstMetric(
+			s.unmappedCollectionCounter,
+			prometheus.CounterValue,
+			float64(count),
+			collectionName,
+		)
+	}
+
+	for indexName, count := range bulkMetric.SchemaViolationCounter {
+		ch <- prometheus.MustNewConstMetric(
+			s.schemaViolationCounter,
+			prometheus.CounterValue,
+			float64(count),
+			indexName,
+		)
+	}
 }
 
 func NewMetricCollector(bulk *bulk.Bulk) *Collector {
@@ -99,5 +170,150 @@ func NewMetricCollector(bulk *bulk.Bulk) *Collector {
 			[]string{"action_type", "result", "index_name"},
 			nil,
 		),
+
+		mappingErrorCounter: prometheus.NewDesc(
+			prometheus.BuildFQName(helpers.Name, "elasticsearch_connector_mapping_error_total", "current"),
+			"Elasticsearch connector mapper error counter",
+			[]string{"collection_name"},
+			nil,
+		),
+		filteredEventCounter: prometheus.NewDesc(
+			prometheus.BuildFQName(helpers.Name, "elasticsearch_connector_filtered_event_total", "current"),
+			"Elasticsearch connector filtered event counter",
+			[]string{"collection_name"},
+			nil,
+		),
+		filterErrorCounter: prometheus.NewDesc(
+			prometheus.BuildFQName(helpers.Name, "elasticsearch_connector_filter_error_total", "current"),
+			"Elasticsearch connector filter expression error counter",
+			[]string{"collection_name"},
+			nil,
+		),
+		unmappedCollectionCounter: prometheus.NewDesc(
+			prometheus.BuildFQName(helpers.Name, "elasticsearch_connector_unmapped_collection_skip_total", "current"),
+			"Elasticsearch connector skipped unmapped collection action counter",
+			[]string{"collection_name"},
+			nil,
+		),
+		schemaViolationCounter: prometheus.NewDesc(
+			prometheus.BuildFQName(helpers.Name, "elasticsearch_connector_schema_violation_total", "current"),
+			"Elasticsearch connector JSON Schema violation counter",
+			[]string{"index_name"},
+			nil,
+		),
+	}
+}
+
+// EnrichmentCollector exposes the lookup cache statistics of an
+// enrichment.Enricher.
+type EnrichmentCollector struct {
+	enricher *enrichment.Enricher
+
+	lookupCounter         *prometheus.Desc
+	fetchLatency          *prometheus.Desc
+	fetchLatencyHistogram *prometheus.Desc
+	cacheSize             *prometheus.Desc
+}
+
+func (s *EnrichmentCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(s, ch)
+}
+
+func (s *EnrichmentCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := s.enricher.Stats()
+
+	ch <- prometheus.MustNewConstMetric(s.lookupCounter, prometheus.CounterValue, float64(stats.Hits), "hit")
+	ch <- prometheus.MustNewConstMetric(s.lookupCounter, prometheus.CounterValue, float64(stats.Misses), "miss")
+	ch <- prometheus.MustNewConstMetric(s.fetchLatency, prometheus.GaugeValue, float64(stats.FetchLatencyMs))
+	ch <- prometheus.MustNewConstHistogram(
+		s.fetchLatencyHistogram,
+		stats.FetchLatency.Count,
+		stats.FetchLatency.SumMs,
+		stats.FetchLatency.Buckets,
+	)
+	ch <- prometheus.MustNewConstMetric(s.cacheSize, prometheus.GaugeValue, float64(stats.Size))
+}
+
+func NewEnrichmentCollector(enricher *enrichment.Enricher) *EnrichmentCollector {
+	return &EnrichmentCollector{
+		enricher: enricher,
+
+		lookupCounter: prometheus.NewDesc(
+			prometheus.BuildFQName(helpers.Name, "elasticsearch_connector_enrichment_lookup_total", "current"),
+			"Elasticsearch connector enrichment lookup counter",
+			[]string{"result"},
+			nil,
+		),
+		fetchLatency: prometheus.NewDesc(
+			prometheus.BuildFQName(helpers.Name, "elasticsearch_connector_enrichment_fetch_latency_ms", "current"),
+			"Elasticsearch connector enrichment KV fetch latency",
+			[]string{},
+			nil,
+		),
+		fetchLatencyHistogram: prometheus.NewDesc(
+			prometheus.BuildFQName(helpers.Name, "elasticsearch_connector_enrichment_fetch_latency_ms", ""),
+			"Elasticsearch connector enrichment KV fetch latency distribution",
+			[]string{},
+			nil,
+		),
+		cacheSize: prometheus.NewDesc(
+			prometheus.BuildFQName(helpers.Name, "elasticsearch_connector_enrichment_cache_size", "current"),
+			"Elasticsearch connector enrichment cache size",
+			[]string{},
+			nil,
+		),
+	}
+}
+
+// mapperDurationBuckets are the upper bounds, in milliseconds, of the mapper
+// duration histogram.
+var mapperDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 1000}
+
+// MapperCollector counts what mapper middlewares do with events and records
+// how long mapping takes. Pass it to the middleware constructors and register
+// it with ConnectorBuilder.SetMetricCollectors. A nil *MapperCollector
+// records nothing.
+type MapperCollector struct {
+	stageCounter *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+}
+
+func (s *MapperCollector) Describe(ch chan<- *prometheus.Desc) {
+	s.stageCounter.Describe(ch)
+	s.duration.Describe(ch)
+}
+
+func (s *MapperCollector) Collect(ch chan<- prometheus.Metric) {
+	s.stageCounter.Collect(ch)
+	s.duration.Collect(ch)
+}
+
+// CountStage counts an event or action a middleware stage handled with result.
+func (s *MapperCollector) CountStage(stage, result string) {
+	if s == nil {
+		return
+	}
+	s.stageCounter.WithLabelValues(stage, result).Inc()
+}
+
+// ObserveDuration records the time mapping an event of collectionName took.
+func (s *MapperCollector) ObserveDuration(collectionName string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.duration.WithLabelValues(collectionName).Observe(float64(d) / float64(time.Millisecond))
+}
+
+func NewMapperCollector() *MapperCollector {
+	return &MapperCollector{
+		stageCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prometheus.BuildFQName(helpers.Name, "elasticsearch_connector_mapper_stage_total", "current"),
+			Help: "Elasticsearch connector mapper middleware stage counter",
+		}, []string{"stage", "result"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prometheus.BuildFQName(helpers.Name, "elasticsearch_connector_mapper_duration_ms", ""),
+			Help:    "Elasticsearch connector mapper duration distribution",
+			Buckets: mapperDurationBuckets,
+		}, []string{"collection_name"}),
 	}
 }
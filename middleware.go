@@ -0,0 +1,174 @@
+package dcpelasticsearch
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/config"
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/bulk"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+// Results counted for mapper middleware stages.
+const (
+	MapperStageDropped     = "dropped"
+	MapperStageTransformed = "transformed"
+)
+
+// Stage names of the built-in middlewares.
+const (
+	MapperStageFilter          = "filter"
+	MapperStageKeyPrefix       = "keyPrefix"
+	MapperStageSystemDocuments = "systemDocuments"
+	MapperStageMetadata        = "metadata"
+)
+
+// metadataFields are the replication metadata fields WithMetadata adds.
+var metadataFields = []string{
+	config.ReplicationMetadataCollection,
+	config.ReplicationMetadataCas,
+	config.ReplicationMetadataSeqNo,
+	config.ReplicationMetadataRevNo,
+	config.ReplicationMetadataVbID,
+	config.ReplicationMetadataEventTime,
+}
+
+// systemDocumentPrefixes are the key prefixes of documents written by
+// Couchbase transactions and Sync Gateway.
+var systemDocumentPrefixes = [][]byte{[]byte("_txn"), []byte("_sync")}
+
+// MapperMiddleware wraps a mapper with logic shared by many mappers, such as
+// filtering events or adding fields to documents. A middleware may return
+// without calling next to drop the event.
+type MapperMiddleware func(next ErrorMapper) ErrorMapper
+
+// MapperMetrics receives what mapper middlewares do. *metric.MapperCollector
+// implements it; the built-in middlewares take one in their constructor and
+// record nothing when it is nil.
+type MapperMetrics interface {
+	// CountStage counts an event or action a middleware stage handled with
+	// result, e.g. MapperStageDropped.
+	CountStage(stage, result string)
+	// ObserveDuration records the time mapping an event of collectionName
+	// took.
+	ObserveDuration(collectionName string, d time.Duration)
+}
+
+// Chain wraps mapper with middlewares, the first one outermost:
+//
+//	dcpelasticsearch.Chain(mapper, dcpelasticsearch.WithoutSystemDocuments(metrics), dcpelasticsearch.WithMetadata(metrics, "_meta"))
+//
+// The result is an ErrorMapper, to be set with ConnectorBuilder.SetErrorMapper.
+func Chain(mapper Mapper, middlewares ...MapperMiddleware) ErrorMapper {
+	return ChainErrorMapper(toErrorMapper(mapper), middlewares...)
+}
+
+// ChainErrorMapper is Chain for an ErrorMapper.
+func ChainErrorMapper(mapper ErrorMapper, middlewares ...MapperMiddleware) ErrorMapper {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		mapper = middlewares[i](mapper)
+	}
+	return mapper
+}
+
+func countStage(metrics MapperMetrics, stage, result string) {
+	if metrics != nil {
+		metrics.CountStage(stage, result)
+	}
+}
+
+// WithFilter drops the events keep returns false for.
+func WithFilter(metrics MapperMetrics, keep func(event couchbase.Event) bool) MapperMiddleware {
+	return filterMiddleware(metrics, MapperStageFilter, keep)
+}
+
+// WithKeyPrefixFilter drops the events whose key starts with none of
+// prefixes.
+func WithKeyPrefixFilter(metrics MapperMetrics, prefixes ...string) MapperMiddleware {
+	return filterMiddleware(metrics, MapperStageKeyPrefix, func(event couchbase.Event) bool {
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix(event.Key, []byte(prefix)) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// WithoutSystemDocuments drops the events of documents whose key starts with
+// _txn (Couchbase transactions) or _sync (Sync Gateway).
+func WithoutSystemDocuments(metrics MapperMetrics) MapperMiddleware {
+	return filterMiddleware(metrics, MapperStageSystemDocuments, func(event couchbase.Event) bool {
+		for _, prefix := range systemDocumentPrefixes {
+			if bytes.HasPrefix(event.Key, prefix) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func filterMiddleware(metrics MapperMetrics, stage string, keep func(event couchbase.Event) bool) MapperMiddleware {
+	return func(next ErrorMapper) ErrorMapper {
+		return func(event couchbase.Event) ([]document.ESActionDocument, error) {
+			if !keep(event) {
+				countStage(metrics, stage, MapperStageDropped)
+				return nil, nil
+			}
+			return next(event)
+		}
+	}
+}
+
+// WithMetadata adds an object with the event's collection, cas, seqNo, revNo,
+// vbId and eventTime under field to the source of index and create actions,
+// like an elasticsearch.replicationMetadata entry listing those fields. An
+// empty field defaults to _cb. Sources that already have the field or are
+// not JSON objects are left as they are.
+func WithMetadata(metrics MapperMetrics, field string) MapperMiddleware {
+	metadata, err := bulk.NewReplicationMetadata(config.ReplicationMetadata{Field: field, Fields: metadataFields}, "")
+	if err != nil {
+		panic(err)
+	}
+	return func(next ErrorMapper) ErrorMapper {
+		return func(event couchbase.Event) ([]document.ESActionDocument, error) {
+			actions, err := next(event)
+			if err != nil {
+				return nil, err
+			}
+			for i := range actions {
+				if actions[i].Type != document.Index && actions[i].Type != document.Create {
+					continue
+				}
+				if source, ok := metadata.Add(actions[i].Source, event); ok {
+					actions[i].Source = source
+					countStage(metrics, MapperStageMetadata, MapperStageTransformed)
+				}
+			}
+			return actions, nil
+		}
+	}
+}
+
+// WithTiming records the time the rest of the chain takes in the mapper
+// duration histogram of metrics, and as a Mapper span of the event's listener
+// trace when it has one.
+func WithTiming(metrics MapperMetrics) MapperMiddleware {
+	return func(next ErrorMapper) ErrorMapper {
+		return func(event couchbase.Event) ([]document.ESActionDocument, error) {
+			if event.ListenerTrace != nil {
+				trace := event.ListenerTrace.CreateChildTrace("Mapper", map[string]interface{}{
+					"collection": event.CollectionName,
+				})
+				defer trace.Finish()
+			}
+			if metrics != nil {
+				defer func(start time.Time) {
+					metrics.ObserveDuration(event.CollectionName, time.Since(start))
+				}(time.Now())
+			}
+			return next(event)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package dcpelasticsearch
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+type stageCounts map[string]int
+
+func (c stageCounts) CountStage(stage, result string) {
+	c[stage+"/"+result]++
+}
+
+func (c stageCounts) ObserveDuration(collectionName string, _ time.Duration) {
+	c["duration/"+collectionName]++
+}
+
+func TestChain_FiltersAndCounts(t *testing.T) {
+	counts := stageCounts{}
+	mapper := Chain(DefaultMapper,
+		WithoutSystemDocuments(counts),
+		WithKeyPrefixFilter(counts, "order::", "_txn"),
+		WithFilter(counts, func(event couchbase.Event) bool { return event.CollectionName != "archive" }),
+	)
+
+	tests := []struct {
+		key        string
+		collection string
+		want       int
+	}{
+		{"order::1", "orders", 1},
+		{"_txn:atr-1", "orders", 0},
+		{"user::1", "orders", 0},
+		{"order::2", "archive", 0},
+	}
+	for _, tt := range tests {
+		event := couchbase.NewMutateEvent(nil, []byte(tt.key), []byte(`{}`), tt.collection, 1, time.Time{}, 0, 1, 1)
+
+		actions, err := mapper(event)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(actions) != tt.want {
+			t.Fatalf("%s/%s: got %d actions, want %d", tt.collection, tt.key, len(actions), tt.want)
+		}
+	}
+
+	want := stageCounts{"systemDocuments/dropped": 1, "keyPrefix/dropped": 1, "filter/dropped": 1}
+	if len(counts) != len(want) {
+		t.Fatalf("counts = %v, want %v", counts, want)
+	}
+	for k, v := range want {
+		if counts[k] != v {
+			t.Fatalf("counts = %v, want %v", counts, want)
+		}
+	}
+}
+
+func TestWithMetadata(t *testing.T) {
+	counts := stageCounts{}
+	mapper := Chain(func(event couchbase.Event) []document.ESActionDocument {
+		return []document.ESActionDocument{
+			document.NewIndexAction(event.Key, event.Value, nil),
+			document.NewIndexAction(event.Key, []byte(`{}`), nil),
+			document.NewDeleteAction(event.Key, nil),
+		}
+	}, WithMetadata(counts, "_meta"))
+
+	eventTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	event := couchbase.NewMutateEvent(nil, []byte("k"), []byte(`{"a":1}`), "orders", 42, eventTime, 7, 3, 2)
+
+	actions, err := mapper(event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	meta := `"_meta":{"collection":"orders","cas":42,"seqNo":3,"revNo":2,"vbId":7,"eventTime":"2024-05-01T10:00:00.000Z"}`
+	if got, want := string(actions[0].Source), `{`+meta+`,"a":1}`; got != want {
+		t.Fatalf("Source = %s, want %s", got, want)
+	}
+	if got, want := string(actions[1].Source), `{`+meta+`}`; got != want {
+		t.Fatalf("Source = %s, want %s", got, want)
+	}
+	if actions[2].Source != nil {
+		t.Fatalf("delete action must be left as is, got %s", actions[2].Source)
+	}
+	if counts["metadata/transformed"] != 2 {
+		t.Fatalf("counts = %v, want 2 transformed", counts)
+	}
+}
+
+func TestWithMetadata_EscapesAndKeepsExistingField(t *testing.T) {
+	mapper := Chain(func(event couchbase.Event) []document.ESActionDocument {
+		return []document.ESActionDocument{document.NewIndexAction(event.Key, event.Value, nil)}
+	}, WithMetadata(nil, "_meta\x00"))
+
+	event := couchbase.NewMutateEvent(nil, []byte("k"), []byte(`{"a":1}`), "orders\x00", 1, time.Time{}, 0, 1, 1)
+	actions, err := mapper(event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !json.Valid(actions[0].Source) {
+		t.Fatalf("Source is not valid JSON: %s", actions[0].Source)
+	}
+
+	mapper = Chain(func(event couchbase.Event) []document.ESActionDocument {
+		return []document.ESActionDocument{document.NewIndexAction(event.Key, event.Value, nil)}
+	}, WithMetadata(nil, "_meta"))
+	event = couchbase.NewMutateEvent(nil, []byte("k"), []byte(`{"_meta":{"own":true}}`), "orders", 1, time.Time{}, 0, 1, 1)
+	if actions, _ = mapper(event); string(actions[0].Source) != `{"_meta":{"own":true}}` {
+		t.Fatalf("existing field must be kept, got %s", actions[0].Source)
+	}
+}
+
+func TestWithTiming(t *testing.T) {
+	counts := stageCounts{}
+	mapper := Chain(DefaultMapper, WithTiming(counts))
+
+	event := couchbase.NewMutateEvent(nil, []byte("k"), []byte(`{}`), "orders", 1, time.Time{}, 0, 1, 1)
+	if _, err := mapper(event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if counts["duration/orders"] != 1 {
+		t.Fatalf("counts = %v, want 1 duration for orders", counts)
+	}
+
+	if _, err := Chain(DefaultMapper, WithTiming(nil))(event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
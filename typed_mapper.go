@@ -0,0 +1,173 @@
+package dcpelasticsearch
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+// Struct tag values marking the fields of a TypedMapper document that hold
+// the action's ID, routing and index, e.g. `es:"id"`.
+const (
+	typedTag        = "es"
+	typedTagID      = "id"
+	typedTagRouting = "routing"
+	typedTagIndex   = "index"
+)
+
+// EventMeta is the metadata of the event a TypedMapper function maps.
+type EventMeta struct {
+	EventTime      time.Time
+	ScopeName      string
+	CollectionName string
+	Key            []byte
+	Cas            uint64
+	SeqNo          uint64
+	RevNo          uint64
+	Expiry         uint32
+	Flags          uint32
+	VbID           uint16
+	IsDeleted      bool
+	IsExpired      bool
+	IsMutated      bool
+}
+
+func newEventMeta(event couchbase.Event) EventMeta {
+	return EventMeta{
+		EventTime:      event.EventTime,
+		ScopeName:      event.ScopeName,
+		CollectionName: event.CollectionName,
+		Key:            event.Key,
+		Cas:            event.Cas,
+		SeqNo:          event.SeqNo,
+		RevNo:          event.RevNo,
+		Expiry:         event.Expiry,
+		Flags:          event.Flags,
+		VbID:           event.VbID,
+		IsDeleted:      event.IsDeleted,
+		IsExpired:      event.IsExpired,
+		IsMutated:      event.IsMutated,
+	}
+}
+
+// Doc is a document returned by a TypedMapper function. It becomes an index
+// action with Value as its source, or a delete action when Delete is set.
+type Doc[D any] struct {
+	Value  D
+	Delete bool
+}
+
+// TypedMapper returns a mapper that decodes the value of mutations into T and
+// passes it to fn; for deletions and expirations in is nil. The documents fn
+// returns are encoded as JSON. Fields of D tagged `es:"id"`, `es:"routing"`
+// and `es:"index"` set the ID (the event key when empty), routing and index of
+// the action. A value that cannot be decoded is a mapping error.
+func TypedMapper[T, D any](fn func(meta EventMeta, in *T) ([]Doc[D], error)) ErrorMapper {
+	fields := typedFieldsOf(reflect.TypeOf((*D)(nil)).Elem())
+
+	return func(event couchbase.Event) ([]document.ESActionDocument, error) {
+		var in *T
+		if event.IsMutated {
+			in = new(T)
+			if err := jsoniter.Unmarshal(event.Value, in); err != nil {
+				return nil, fmt.Errorf("decode %T: %w", *in, err)
+			}
+		}
+
+		docs, err := fn(newEventMeta(event), in)
+		if err != nil {
+			return nil, err
+		}
+
+		actions := make([]document.ESActionDocument, 0, len(docs))
+		for i := range docs {
+			action, err := fields.action(event.Key, &docs[i].Value, docs[i].Delete)
+			if err != nil {
+				return nil, err
+			}
+			actions = append(actions, action)
+		}
+		return actions, nil
+	}
+}
+
+// typedFields holds the indexes of the tagged fields of a document type.
+type typedFields struct {
+	id      []int
+	routing []int
+	index   []int
+}
+
+func typedFieldsOf(t reflect.Type) typedFields {
+	var fields typedFields
+	if t.Kind() != reflect.Struct {
+		return fields
+	}
+	for _, f := range reflect.VisibleFields(t) {
+		switch f.Tag.Get(typedTag) {
+		case typedTagID:
+			fields.id = f.Index
+		case typedTagRouting:
+			fields.routing = f.Index
+		case typedTagIndex:
+			fields.index = f.Index
+		}
+	}
+	return fields
+}
+
+func (f typedFields) action(key []byte, value any, isDelete bool) (document.ESActionDocument, error) {
+	v := reflect.ValueOf(value).Elem()
+
+	id := key
+	if s := fieldString(v, f.id); s != "" {
+		id = []byte(s)
+	}
+
+	var builder *document.ActionBuilder
+	if isDelete {
+		builder = document.DeleteAction(id)
+	} else {
+		source, err := jsoniter.Marshal(value)
+		if err != nil {
+			return document.ESActionDocument{}, fmt.Errorf("encode %T: %w", value, err)
+		}
+		builder = document.IndexAction(id).Source(source)
+	}
+
+	if routing := fieldString(v, f.routing); routing != "" {
+		builder.Routing(routing)
+	}
+	if index := fieldString(v, f.index); index != "" {
+		builder.Index(index)
+	}
+	return builder.Build(), nil
+}
+
+// fieldString returns the field at index of v as a string, or "" when index
+// is nil or the field is a zero value.
+func fieldString(v reflect.Value, index []int) string {
+	if index == nil {
+		return ""
+	}
+	field, err := v.FieldByIndexErr(index)
+	if err != nil || field.IsZero() {
+		return ""
+	}
+	switch field.Kind() {
+	case reflect.String:
+		return field.String()
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.Uint8 {
+			return string(field.Bytes())
+		}
+	case reflect.Ptr:
+		return fmt.Sprint(field.Elem().Interface())
+	}
+	return fmt.Sprint(field.Interface())
+}
@@ -0,0 +1,68 @@
+package dcpelasticsearch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Trendyol/go-dcp-elasticsearch/couchbase"
+	"github.com/Trendyol/go-dcp-elasticsearch/elasticsearch/document"
+)
+
+type typedOrder struct {
+	ID       string  `json:"id"`
+	Customer string  `json:"customer"`
+	Total    float64 `json:"total"`
+}
+
+type typedOrderDoc struct {
+	ID       string  `json:"id" es:"id"`
+	Customer string  `json:"customer" es:"routing"`
+	Index    string  `json:"-" es:"index"`
+	Total    float64 `json:"total"`
+}
+
+func TestTypedMapper(t *testing.T) {
+	mapper := TypedMapper(func(meta EventMeta, in *typedOrder) ([]Doc[typedOrderDoc], error) {
+		if in == nil {
+			return []Doc[typedOrderDoc]{{Delete: true}}, nil
+		}
+		return []Doc[typedOrderDoc]{{Value: typedOrderDoc{
+			ID: "order-" + in.ID, Customer: in.Customer, Index: "orders-" + meta.CollectionName, Total: in.Total,
+		}}}, nil
+	})
+
+	event := couchbase.NewMutateEvent(nil, []byte("k"), []byte(`{"id":"1","customer":"c1","total":9.5}`),
+		"eu", 1, time.Time{}, 0, 1, 1)
+	actions, err := mapper(event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	action := actions[0]
+	if action.Type != document.Index || string(action.ID) != "order-1" || action.IndexName != "orders-eu" ||
+		action.Routing == nil || *action.Routing != "c1" {
+		t.Fatalf("unexpected action %+v", action)
+	}
+	if got, want := string(action.Source), `{"id":"order-1","customer":"c1","total":9.5}`; got != want {
+		t.Fatalf("Source = %s, want %s", got, want)
+	}
+
+	actions, err = mapper(couchbase.NewDeleteEvent(nil, []byte("k"), nil, "eu", 1, time.Time{}, 0, 1, 1))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actions[0].Type != document.Delete || string(actions[0].ID) != "k" || actions[0].Routing != nil {
+		t.Fatalf("deletion must fall back to the event key, got %+v", actions[0])
+	}
+}
+
+func TestTypedMapper_DecodeError(t *testing.T) {
+	mapper := TypedMapper(func(EventMeta, *typedOrder) ([]Doc[typedOrderDoc], error) {
+		t.Fatal("fn must not be called for an undecodable value")
+		return nil, nil
+	})
+
+	event := couchbase.NewMutateEvent(nil, []byte("k"), []byte(`{"total":"x"}`), "eu", 1, time.Time{}, 0, 1, 1)
+	if _, err := mapper(event); err == nil {
+		t.Fatal("expected a decode error")
+	}
+}